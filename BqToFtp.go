@@ -36,17 +36,16 @@ func InitializeRouter() *mux.Router {
 
 	//Load concurrently
 	bigqueryCHan := make(chan services.IBigQueryService)
-	ftpCHan := make(chan services.IFTPService)
 	storageCHan := make(chan services.IStorageService)
 
 	go func() { bigqueryCHan <- services.NewBigQueryService(configService) }()
 	go func() { storageCHan <- services.NewStorageService(configService) }()
-	go func() { ftpCHan <- services.NewFtpService(configService) }()
+	//The destinations are loaded while the other services are loading
+	destinations := controllers.NewDestinations(configService)
 
 	bigqueryService := <-bigqueryCHan
 	storageService := <-storageCHan
-	ftpService := <-ftpCHan
-	bqToFtpController := controllers.NewBqToFtpController(configService, bigqueryService, ftpService, storageService)
+	bqToFtpController := controllers.NewBqToFtpController(configService, bigqueryService, destinations, storageService)
 
 	router.Methods("GET").Path("/").HandlerFunc(bqToFtpController.Handle)
 	return router
@@ -0,0 +1,259 @@
+package controllers
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"encoding/json"
+	"fmt"
+	"github.com/linkedin/goavro/v2"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	avroRecordName = "Row"
+	avroBlockRows  = 1000
+)
+
+var avroCompressions = map[string]string{
+	"NULL":    goavro.CompressionNullLabel,
+	"DEFLATE": goavro.CompressionDeflateLabel,
+	"SNAPPY":  goavro.CompressionSnappyLabel,
+}
+
+/*
+Describe how the Avro file is written:
+  - compression: codec of the blocks, SNAPPY by default
+*/
+type avroFormat struct {
+	compression string
+}
+
+/*
+Load the Avro format from the environment variables. Wrong values are logged and replaced by the default one
+*/
+func newAvroFormat(configService helpers.IConfigService) *avroFormat {
+	format := &avroFormat{
+		compression: goavro.CompressionSnappyLabel,
+	}
+
+	if compression := strings.ToUpper(configService.GetEnvVar(models.AVRO_COMPRESSION)); compression != "" {
+		if codec, ok := avroCompressions[compression]; ok {
+			format.compression = codec
+		} else {
+			log.Errorf("Unknown AVRO_COMPRESSION parameter %q. Compression is set to %s", compression, format.compression)
+		}
+	}
+	return format
+}
+
+/*
+Write the rows in an Avro Object Container File, with the Avro schema generated from the BigQuery one embedded in the
+header. NULLABLE fields are unions with null, REPEATED fields are arrays and RECORD fields are nested records.
+The rows are kept in memory and written by blocks of avroBlockRows rows
+*/
+type avroWriter struct {
+	rowWriter
+	writer     io.Writer
+	format     *avroFormat
+	schema     bigquery.Schema
+	fieldNames map[*bigquery.FieldSchema]string
+	ocfWriter  *goavro.OCFWriter
+	block      []interface{}
+}
+
+func newAvroWriter(writer io.Writer, format *avroFormat) *avroWriter {
+	return &avroWriter{
+		writer: writer,
+		format: format,
+	}
+}
+
+func (this *avroWriter) writeHeader(schema bigquery.Schema) error {
+	this.schema = schema
+	this.fieldNames = make(map[*bigquery.FieldSchema]string)
+	avroSchema, err := avroRecordSchema(avroRecordName, schema, this.fieldNames)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(avroSchema)
+	if err != nil {
+		return err
+	}
+	this.ocfWriter, err = goavro.NewOCFWriter(goavro.OCFConfig{
+		W:               this.writer,
+		Schema:          string(encoded),
+		CompressionName: this.format.compression,
+	})
+	return err
+}
+
+func (this *avroWriter) writeRow(values []bigquery.Value) error {
+	record, err := this.avroRecord(this.schema, values)
+	if err != nil {
+		return err
+	}
+	this.block = append(this.block, record)
+	if len(this.block) < avroBlockRows {
+		return nil
+	}
+	return this.flush()
+}
+
+/*
+Write the last block
+*/
+func (this *avroWriter) close() error {
+	return this.flush()
+}
+
+func (this *avroWriter) flush() error {
+	if len(this.block) == 0 {
+		return nil
+	}
+	err := this.ocfWriter.Append(this.block)
+	this.block = this.block[:0]
+	return err
+}
+
+/*
+Build the schema of a record. Record names must be unique in an Avro schema, the nested ones are prefixed by their
+parent name. The union member name of each NULLABLE field is kept in fieldNames to wrap the values
+*/
+func avroRecordSchema(name string, schema bigquery.Schema, fieldNames map[*bigquery.FieldSchema]string) (map[string]interface{}, error) {
+	fields := make([]map[string]interface{}, len(schema))
+	for i, schemaField := range schema {
+		fieldType, typeName, err := avroTypeOf(name, schemaField, fieldNames)
+		if err != nil {
+			return nil, err
+		}
+		field := map[string]interface{}{"name": schemaField.Name}
+		switch {
+		case schemaField.Repeated:
+			field["type"] = map[string]interface{}{"type": "array", "items": fieldType}
+		case schemaField.Required:
+			field["type"] = fieldType
+		default:
+			field["type"] = []interface{}{"null", fieldType}
+			field["default"] = nil
+			fieldNames[schemaField] = typeName
+		}
+		fields[i] = field
+	}
+	return map[string]interface{}{
+		"type":   "record",
+		"name":   name,
+		"fields": fields,
+	}, nil
+}
+
+/*
+Return the Avro type of a single value of the field and its name in a union.
+DATETIME, without time zone, is written as a string in the BigQuery canonical format
+*/
+func avroTypeOf(parentName string, schemaField *bigquery.FieldSchema, fieldNames map[*bigquery.FieldSchema]string) (interface{}, string, error) {
+	switch schemaField.Type {
+	case bigquery.StringFieldType, bigquery.GeographyFieldType, bigquery.DateTimeFieldType:
+		return "string", "string", nil
+	case bigquery.BytesFieldType:
+		return "bytes", "bytes", nil
+	case bigquery.IntegerFieldType:
+		return "long", "long", nil
+	case bigquery.FloatFieldType:
+		return "double", "double", nil
+	case bigquery.NumericFieldType:
+		return map[string]interface{}{
+			"type":        "bytes",
+			"logicalType": "decimal",
+			"precision":   bigquery.NumericPrecisionDigits,
+			"scale":       bigquery.NumericScaleDigits,
+		}, "bytes.decimal", nil
+	case bigquery.BooleanFieldType:
+		return "boolean", "boolean", nil
+	case bigquery.TimestampFieldType:
+		return map[string]interface{}{"type": "long", "logicalType": "timestamp-micros"}, "long.timestamp-micros", nil
+	case bigquery.DateFieldType:
+		return map[string]interface{}{"type": "int", "logicalType": "date"}, "int.date", nil
+	case bigquery.TimeFieldType:
+		return map[string]interface{}{"type": "long", "logicalType": "time-micros"}, "long.time-micros", nil
+	case bigquery.RecordFieldType:
+		name := parentName + "_" + schemaField.Name
+		record, err := avroRecordSchema(name, schemaField.Schema, fieldNames)
+		return record, name, err
+	}
+	return nil, "", fmt.Errorf("the type %s of the field %q isn't supported in Avro", schemaField.Type, schemaField.Name)
+}
+
+/*
+Convert the values of a record in the native map expected by goavro
+*/
+func (this *avroWriter) avroRecord(schema bigquery.Schema, values []bigquery.Value) (map[string]interface{}, error) {
+	if len(values) != len(schema) {
+		return nil, fmt.Errorf("the record has %d values for %d fields in the schema", len(values), len(schema))
+	}
+	record := make(map[string]interface{}, len(schema))
+	for i, schemaField := range schema {
+		switch {
+		case schemaField.Repeated:
+			repeated, ok := values[i].([]bigquery.Value)
+			if values[i] != nil && !ok {
+				return nil, fmt.Errorf("the REPEATED field %q has a %T value", schemaField.Name, values[i])
+			}
+			elements := make([]interface{}, len(repeated))
+			for j, element := range repeated {
+				value, err := this.avroValue(schemaField, element)
+				if err != nil {
+					return nil, err
+				}
+				elements[j] = value
+			}
+			record[schemaField.Name] = elements
+		case schemaField.Required:
+			value, err := this.avroValue(schemaField, values[i])
+			if err != nil {
+				return nil, err
+			}
+			record[schemaField.Name] = value
+		default:
+			if values[i] == nil {
+				record[schemaField.Name] = goavro.Union("null", nil)
+				continue
+			}
+			value, err := this.avroValue(schemaField, values[i])
+			if err != nil {
+				return nil, err
+			}
+			record[schemaField.Name] = goavro.Union(this.fieldNames[schemaField], value)
+		}
+	}
+	return record, nil
+}
+
+/*
+Convert a single value in the native type of its Avro logical type
+*/
+func (this *avroWriter) avroValue(schemaField *bigquery.FieldSchema, value bigquery.Value) (interface{}, error) {
+	switch typedValue := value.(type) {
+	case nil:
+		return nil, fmt.Errorf("the field %q has a null value", schemaField.Name)
+	case []bigquery.Value:
+		if schemaField.Type != bigquery.RecordFieldType {
+			return nil, fmt.Errorf("the field %q of type %s has a %T value", schemaField.Name, schemaField.Type, value)
+		}
+		return this.avroRecord(schemaField.Schema, typedValue)
+	case time.Time:
+		return typedValue.UTC(), nil
+	case civil.Date:
+		return typedValue.In(time.UTC), nil
+	case civil.Time:
+		return time.Duration(typedValue.Hour)*time.Hour + time.Duration(typedValue.Minute)*time.Minute +
+			time.Duration(typedValue.Second)*time.Second + time.Duration(typedValue.Nanosecond), nil
+	case civil.DateTime:
+		return bigquery.CivilDateTimeString(typedValue), nil
+	}
+	return value, nil
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"fmt"
+	"github.com/linkedin/goavro/v2"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_avroWriter(t *testing.T) {
+	buf := bytes.Buffer{}
+	format := &avroFormat{
+		compression: goavro.CompressionDeflateLabel,
+	}
+	if err := createFile(newAvroWriter(&buf, format), createNestedBqRow()); err != nil {
+		t.Errorf("avroWriter error = %v", err)
+		return
+	}
+
+	ocfReader, err := goavro.NewOCFReader(&buf)
+	if err != nil {
+		t.Errorf("avroWriter wrote an unreadable file with error %v", err)
+		return
+	}
+	for _, want := range []string{
+		`"logicalType":"decimal","precision":38,"scale":9`,
+		`"logicalType":"timestamp-micros"`,
+		`"logicalType":"date"`,
+		`"name":"Row_address"`,
+	} {
+		if !strings.Contains(ocfReader.Codec().Schema(), want) {
+			t.Errorf("avroWriter schema %s doesn't contain %s", ocfReader.Codec().Schema(), want)
+		}
+	}
+
+	var rows []map[string]interface{}
+	for ocfReader.Scan() {
+		row, err := ocfReader.Read()
+		if err != nil {
+			t.Errorf("avroWriter wrote unreadable rows with error %v", err)
+			return
+		}
+		rows = append(rows, row.(map[string]interface{}))
+	}
+	if len(rows) != 2 {
+		t.Errorf("avroWriter wrote %d rows, want 2", len(rows))
+		return
+	}
+
+	first := rows[0]
+	if got := first["id"].(map[string]interface{})["long"]; got != int64(1) {
+		t.Errorf("avroWriter id = %v, want 1", got)
+	}
+	if got := first["amount"].(map[string]interface{})["bytes.decimal"].(*big.Rat); got.Cmp(big.NewRat(3, 2)) != 0 {
+		t.Errorf("avroWriter amount = %v, want 3/2", got)
+	}
+	if got := first["created"].(map[string]interface{})["long.timestamp-micros"].(time.Time); !got.Equal(time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("avroWriter created = %v, want 2019-06-01T10:00:00Z", got)
+	}
+	if got := first["day"].(map[string]interface{})["int.date"].(time.Time); !got.Equal(time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("avroWriter day = %v, want 2019-06-01", got)
+	}
+	if got := first["tags"].([]interface{}); len(got) != 2 || got[0] != "a" {
+		t.Errorf("avroWriter tags = %v, want [a b]", got)
+	}
+	address := first["address"].(map[string]interface{})["Row_address"].(map[string]interface{})
+	if got := address["zip"].([]interface{}); len(got) != 2 || got[1] != int64(75002) {
+		t.Errorf("avroWriter zip = %v, want [75001 75002]", got)
+	}
+
+	second := rows[1]
+	if second["amount"] != nil || second["address"] != nil {
+		t.Errorf("avroWriter null values aren't written as null")
+	}
+}
+
+func Test_avroRecordSchema(t *testing.T) {
+	tests := []struct {
+		name     string
+		schema   bigquery.Schema
+		wantType interface{}
+		wantErr  bool
+	}{
+		{
+			name:     "Nullable field",
+			schema:   bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}},
+			wantType: "[null long]",
+		},
+		{
+			name:     "Required field",
+			schema:   bigquery.Schema{{Name: "ok", Type: bigquery.BooleanFieldType, Required: true}},
+			wantType: "boolean",
+		},
+		{
+			name:     "Repeated field",
+			schema:   bigquery.Schema{{Name: "values", Type: bigquery.FloatFieldType, Repeated: true}},
+			wantType: "map[items:double type:array]",
+		},
+		{
+			name:    "Unknown type",
+			schema:  bigquery.Schema{{Name: "unknown", Type: "UNKNOWN"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := avroRecordSchema(avroRecordName, tt.schema, make(map[*bigquery.FieldSchema]string))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("avroRecordSchema() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			field := got["fields"].([]map[string]interface{})[0]
+			if gotType := fmt.Sprint(field["type"]); gotType != tt.wantType {
+				t.Errorf("avroRecordSchema() type = %v, want %v", gotType, tt.wantType)
+			}
+		})
+	}
+}
@@ -4,14 +4,14 @@ import (
 	"bqToFtp/helpers"
 	"bqToFtp/models"
 	"bqToFtp/services"
-	"bytes"
 	"cloud.google.com/go/bigquery"
-	"errors"
-	"fmt"
+	"encoding/json"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/api/iterator"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -24,40 +24,68 @@ type IBqToFtpController interface {
 
 type bqToFtpController struct {
 	IBqToFtpController
-	configService   helpers.IConfigService
-	bigQueryService services.IBigQueryService
-	ftpService      services.IFTPService
-	storageService  services.IStorageService
-	withHeader      bool
-	separator       []byte
-	filePrefix      string
-	timeFormat      string
+	configService     helpers.IConfigService
+	bigQueryService   services.IBigQueryService
+	destinations      []*destination
+	deliveryPolicy    string
+	storageService    services.IStorageService
+	outputFormat      string
+	withHeader        bool
+	csvFormat         *csvFormat
+	valueFormat       *valueFormat
+	columnTransforms  *columnTransforms
+	outputEncoding    *outputEncoding
+	compressionFormat *compressionFormat
+	pgpEncryption     *pgpEncryption
+	sidecarFormat     *sidecarFormat
+	recordTemplates   *recordTemplates
+	splitPolicy       *splitPolicy
+	partitionFormat   *partitionFormat
+	parquetFormat     *parquetFormat
+	avroFormat        *avroFormat
+	xlsxFormat        *xlsxFormat
+	fileNameFormat    *fileNameFormat
 }
 
 /*
 Factory which create an handler with a Parser.
 Have to be instantiate with each parser
 */
-func NewBqToFtpController(configService helpers.IConfigService, bigQueryService services.IBigQueryService, ftpService services.IFTPService, storageService services.IStorageService) *bqToFtpController {
+func NewBqToFtpController(configService helpers.IConfigService, bigQueryService services.IBigQueryService, destinations []*destination, storageService services.IStorageService) *bqToFtpController {
 	bqToFtpController := &bqToFtpController{}
 	bqToFtpController.configService = configService
 	bqToFtpController.bigQueryService = bigQueryService
-	bqToFtpController.ftpService = ftpService
+	bqToFtpController.destinations = destinations
+	bqToFtpController.deliveryPolicy = newDeliveryPolicy(configService)
 	bqToFtpController.storageService = storageService
-	bqToFtpController.filePrefix = configService.GetEnvVar(models.FILE_PREFIX)
 	var err error
 	bqToFtpController.withHeader, err = strconv.ParseBool(configService.GetEnvVar(models.HEADER))
 	if err != nil {
 		log.Errorf("Impossible to convert to Boolean the HEADER parameter %q. Header is set to FALSE", configService.GetEnvVar(models.HEADER))
 	}
 
-	separator := configService.GetEnvVar(models.SEPARATOR)
-	bqToFtpController.separator = []byte(separator)
-
-	if separator == "" {
-		bqToFtpController.separator = []byte(",")
+	bqToFtpController.outputFormat = strings.ToUpper(configService.GetEnvVar(models.OUTPUT_FORMAT))
+	if _, ok := fileExtensions[bqToFtpController.outputFormat]; !ok {
+		if bqToFtpController.outputFormat != "" {
+			log.Errorf("Unknown OUTPUT_FORMAT parameter %q. Output format is set to CSV", bqToFtpController.outputFormat)
+		}
+		bqToFtpController.outputFormat = outputFormatCsv
 	}
-	bqToFtpController.timeFormat = "20060102150405"
+
+	bqToFtpController.csvFormat = newCsvFormat(configService)
+	bqToFtpController.valueFormat = newValueFormat(configService)
+	bqToFtpController.columnTransforms = newColumnTransforms(configService, bqToFtpController.valueFormat)
+	bqToFtpController.outputEncoding = newOutputEncoding(configService, bqToFtpController.outputFormat)
+	bqToFtpController.compressionFormat = newCompressionFormat(configService)
+	bqToFtpController.pgpEncryption = newPgpEncryption(configService, storageService)
+	bqToFtpController.sidecarFormat = newSidecarFormat(configService)
+	bqToFtpController.splitPolicy = newSplitPolicy(configService)
+	bqToFtpController.partitionFormat = newPartitionFormat(configService)
+	bqToFtpController.recordTemplates = newRecordTemplates(configService, bqToFtpController.outputFormat, bqToFtpController.csvFormat.lineTerminator)
+	bqToFtpController.parquetFormat = newParquetFormat(configService)
+	bqToFtpController.avroFormat = newAvroFormat(configService)
+	bqToFtpController.xlsxFormat = newXlsxFormat(configService)
+	bqToFtpController.fileNameFormat = newFileNameFormat(configService)
 	return bqToFtpController
 
 }
@@ -68,88 +96,148 @@ Apply a generic handler to the instantiated parser
 func (controller *bqToFtpController) Handle(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-type", "application/json;charset=UTF-8")
 
+	newRowWriter, err := controller.newRowWriterFactory()
+	if err != nil {
+		log.Errorf("Impossible to prepare the %s file with error %v", controller.outputFormat, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mapping, err := controller.loadColumnMapping()
+	if err != nil {
+		log.Errorf("Impossible to load the column mapping with error %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
 	//Read the query
-	iter, err := controller.bigQueryService.Read(controller.storageService.GetQuery())
+	query, window := controller.storageService.GetQuery()
+	iter, err := controller.bigQueryService.Read(query)
 	if err != nil {
 		log.Errorf("Error in BQ request %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	//Make a byteBuffer in memory
-	fileInMemory, _ := createFileInMemory(controller.withHeader, controller.separator, iter)
-
-	//Push the file to FTP
-	//create the fileName
-	fileName := controller.filePrefix + time.Now().Format(controller.timeFormat) + ".csv"
+	//Push the files to FTP, each file is streamed while the rows are read
+	runDate := time.Now()
+	output := controller.newPartitionWriter(newRowWriter, runDate, window)
+	run := runValues{runId: newRunId(), runDate: runDate, windowStart: window.Start, windowEnd: window.End}
+	//The columns are mapped, then the sensitive ones are transformed before the partitioning
+	if err = createFile(mapping.wrap(controller.columnTransforms.wrap(output), run), iter); err != nil {
+		output.abort(err)
+		log.Errorf("Impossible to deliver the files with error %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	if err = controller.sendFile(fileName, fileInMemory); err != nil {
-		log.Errorf("Impossible to send the file with error %v\n Try to save file in fallback bucket", err)
-		//save in fallback
-		if err = controller.storageService.FallbackStoreFile(fileName, fileInMemory); err != nil {
-			log.Errorf("Impossible to file in fallback bucket with error %v.here the full file content \n%q", err, string(fileInMemory))
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	//Signal the completion of the run
+	if err = output.deliverManifests(); err != nil {
+		log.Errorf("Impossible to deliver the manifest with error %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
+	//Report the files of each destination
+	reports := output.deliveryReports()
+	for i, report := range reports {
+		log.Infof("Files delivered to %s: %d, in fallback bucket: %d, failed: %d", controller.destinations[i], report.Delivered, report.Fallback, report.Failed)
+	}
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string][]destinationReport{"destinations": reports})
 }
 
-func (controller *bqToFtpController) sendFile(fileName string, fileInMemory []byte) error {
-	numberOfError := 0
-	for {
-		err := controller.ftpService.Send(fileName, bytes.NewReader(fileInMemory))
-		if err != nil {
-			numberOfError++
-			if numberOfError >= 3 {
-				return errors.New("multiple ftp send attempt in error. ftp not reachable")
-			}
-			log.Warningf("Error while sending the file with error %v. Perform a retry", err)
-		} else {
-			//Correct send by ftp
-			return nil
-		}
-	}
+/*
+Transformation of the file content before the delivery, like the compression or the encryption
+*/
+type outputStage interface {
+	//Name of the file after the stage
+	fileName(name string) string
+	//Writer which transforms the content in the output. Close completes the content without closing the output
+	newWriter(out io.Writer, name string) (io.WriteCloser, error)
 }
 
-var lineSeparatorByte = []byte("\n")
+/*
+Return the stages applied to the file content, in the processing order
+*/
+func (controller *bqToFtpController) outputStages() []outputStage {
+	var stages []outputStage
+	if controller.outputEncoding != nil {
+		stages = append(stages, controller.outputEncoding)
+	}
+	stages = append(stages, controller.compressionFormat)
+	if controller.pgpEncryption != nil {
+		stages = append(stages, controller.pgpEncryption)
+	}
+	return stages
+}
 
-func createFileInMemory(header bool, separator []byte, rowIterator services.IRowIterator) (fileInMemory []byte, err error) {
-	buffer := bytes.Buffer{}
+/*
+Name of the delivered file, after all the stages
+*/
+func stagedFileName(name string, stages []outputStage) string {
+	for _, stage := range stages {
+		name = stage.fileName(name)
+	}
+	return name
+}
 
-	//Write the Header if set to true
+/*
+Create the writers of the stages on the output. The returned writer is the input of the first stage. name is the file
+name before the stages
+*/
+func newStagedWriters(out io.Writer, name string, stages []outputStage) (io.Writer, []io.WriteCloser, error) {
+	//The writers are chained from the output, the last stage writes in the output
+	writers := make([]io.WriteCloser, len(stages))
+	for i := len(stages) - 1; i >= 0; i-- {
+		writer, err := stages[i].newWriter(out, stagedFileName(name, stages[:i]))
+		if err != nil {
+			return nil, nil, err
+		}
+		writers[i] = writer
+		out = writer
+	}
+	return out, writers, nil
+}
 
-	if header {
-		for i, schemaField := range rowIterator.GetSchema() {
-			buffer.Write([]byte(schemaField.Name))
-			//don't write the last separator
-			if i != (len(rowIterator.GetSchema()) - 1) {
-				buffer.Write(separator)
-			}
+/*
+Complete the content of the stages, without closing the output
+*/
+func closeStagedWriters(writers []io.WriteCloser) error {
+	//The first stage is flushed in the next one before its close
+	for _, writer := range writers {
+		if err := writer.Close(); err != nil {
+			return err
 		}
-		buffer.Write(lineSeparatorByte)
+	}
+	return nil
+}
+
+/*
+Write the rows of the iterator with the row writer. The rows are written while they are read, without keeping them in
+memory
+*/
+func createFile(writer rowWriter, rowIterator services.IRowIterator) (err error) {
+	//The schema is only known after the first read
+	var values []bigquery.Value
+	err = rowIterator.Next(&values)
+	if err != nil && err != iterator.Done {
+		return
+	}
+	done := err == iterator.Done
+	if err = writer.writeHeader(rowIterator.GetSchema()); err != nil {
+		return
 	}
 
 	//Loop on row.
-	for {
-		var values []bigquery.Value
-		err := rowIterator.Next(&values)
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			//should never occur !
+	for !done {
+		if err = writer.writeRow(values); err != nil {
+			return
 		}
-		for i, value := range values {
-			buffer.Write([]byte(fmt.Sprint(value)))
-			//don't write the last separator
-			if i != (len(values) - 1) {
-				buffer.Write(separator)
-			}
+		err = rowIterator.Next(&values)
+		if err != nil && err != iterator.Done {
+			return
 		}
-		buffer.Write(lineSeparatorByte)
+		done = err == iterator.Done
 	}
-	fileInMemory = buffer.Bytes()
-	return
+	return writer.close()
 }
@@ -1,11 +1,10 @@
 package controllers
 
 import (
-	"bqToFtp/helpers"
-	"bqToFtp/mocks"
 	"bqToFtp/services"
+	"bytes"
 	"errors"
-	"github.com/stretchr/testify/mock"
+	"io"
 	"reflect"
 	"testing"
 
@@ -13,10 +12,10 @@ import (
 	"google.golang.org/api/iterator"
 )
 
-func Test_createFileInMemory(t *testing.T) {
+func Test_createFile(t *testing.T) {
 	type args struct {
 		header      bool
-		separator   []byte
+		format      *csvFormat
 		rowIterator services.IRowIterator
 	}
 	tests := []struct {
@@ -29,7 +28,7 @@ func Test_createFileInMemory(t *testing.T) {
 			name: "Content parsed with header",
 			args: args{
 				header:      true,
-				separator:   []byte(","),
+				format:      newDefaultCsvFormat(),
 				rowIterator: createBqRow(),
 			},
 			wantFileInMemory: []byte(
@@ -42,8 +41,14 @@ func Test_createFileInMemory(t *testing.T) {
 		{
 			name: "Content parsed without header and with semicolon",
 			args: args{
-				header:      false,
-				separator:   []byte(";"),
+				header: false,
+				format: &csvFormat{
+					separator:      []byte(";"),
+					quote:          '"',
+					quotePolicy:    quotePolicyMinimal,
+					escapeStyle:    escapeStyleDouble,
+					lineTerminator: []byte("\n"),
+				},
 				rowIterator: createBqRow(),
 			},
 			wantFileInMemory: []byte(
@@ -52,16 +57,203 @@ func Test_createFileInMemory(t *testing.T) {
 					"2;name2;2\n"),
 			wantErr: false,
 		},
+		{
+			name: "Content with special chars quoted and CRLF",
+			args: args{
+				header: true,
+				format: &csvFormat{
+					separator:      []byte(","),
+					quote:          '"',
+					quotePolicy:    quotePolicyMinimal,
+					escapeStyle:    escapeStyleDouble,
+					lineTerminator: []byte("\r\n"),
+				},
+				rowIterator: &DummyRowIterator{
+					Row: [][]bigquery.Value{
+						{"0", "name, with comma", "0"},
+						{"1", "name \"quoted\"", "1"},
+						{"2", "name\nmultiline", "2"},
+					},
+				},
+			},
+			wantFileInMemory: []byte(
+				"id,Name,Value\r\n" +
+					"0,\"name, with comma\",0\r\n" +
+					"1,\"name \"\"quoted\"\"\",1\r\n" +
+					"2,\"name\nmultiline\",2\r\n"),
+			wantErr: false,
+		},
+		{
+			name: "Content with non numeric policy",
+			args: args{
+				header: true,
+				format: &csvFormat{
+					separator:      []byte(","),
+					quote:          '"',
+					quotePolicy:    quotePolicyNonNumeric,
+					escapeStyle:    escapeStyleDouble,
+					lineTerminator: []byte("\n"),
+				},
+				rowIterator: &DummyRowIterator{
+					Row: [][]bigquery.Value{
+						{int64(0), "name0", 1.5},
+					},
+					Schema: bigquery.Schema{
+						{Name: "id", Type: bigquery.IntegerFieldType},
+						{Name: "Name", Type: bigquery.StringFieldType},
+						{Name: "Value", Type: bigquery.FloatFieldType},
+					},
+				},
+			},
+			wantFileInMemory: []byte(
+				"\"id\",\"Name\",\"Value\"\n" +
+					"0,\"name0\",1.5\n"),
+			wantErr: false,
+		},
+		{
+			name: "Content without row",
+			args: args{
+				header:      true,
+				format:      newDefaultCsvFormat(),
+				rowIterator: &DummyRowIterator{},
+			},
+			wantFileInMemory: []byte("id,Name,Value\n"),
+			wantErr:          false,
+		},
+		{
+			name: "Error while reading the rows",
+			args: args{
+				header:      true,
+				format:      newDefaultCsvFormat(),
+				rowIterator: &ErrorRowIterator{},
+			},
+			wantFileInMemory: nil,
+			wantErr:          true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotFileInMemory, err := createFileInMemory(tt.args.header, tt.args.separator, tt.args.rowIterator)
+			buffer := bytes.Buffer{}
+			err := createFile(newCsvWriter(&buffer, tt.args.header, tt.args.format, newDefaultValueFormat(), nil), tt.args.rowIterator)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("createFileInMemory() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("createFile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if gotFileInMemory := buffer.Bytes(); !reflect.DeepEqual(gotFileInMemory, tt.wantFileInMemory) {
+				t.Errorf("createFile() = %v, want %v", string(gotFileInMemory), string(tt.wantFileInMemory))
+			}
+		})
+	}
+}
+
+func Test_csvWriter_writeRecord(t *testing.T) {
+	type args struct {
+		fields  []string
+		numeric []bool
+	}
+	tests := []struct {
+		name   string
+		format *csvFormat
+		args   args
+		want   string
+	}{
+		{
+			name:   "Minimal without special char",
+			format: newDefaultCsvFormat(),
+			args: args{
+				fields: []string{"a", "b", ""},
+			},
+			want: "a,b,\n",
+		},
+		{
+			name:   "Minimal with separator, quote and line breaks",
+			format: newDefaultCsvFormat(),
+			args: args{
+				fields: []string{"a,b", "say \"hi\"", "line\r\nbreak"},
+			},
+			want: "\"a,b\",\"say \"\"hi\"\"\",\"line\r\nbreak\"\n",
+		},
+		{
+			name: "All with custom quote",
+			format: &csvFormat{
+				separator:      []byte(";"),
+				quote:          '\'',
+				quotePolicy:    quotePolicyAll,
+				escapeStyle:    escapeStyleDouble,
+				lineTerminator: []byte("\n"),
+			},
+			args: args{
+				fields: []string{"a", "it's", "1"},
+			},
+			want: "'a';'it''s';'1'\n",
+		},
+		{
+			name: "Non numeric",
+			format: &csvFormat{
+				separator:      []byte(","),
+				quote:          '"',
+				quotePolicy:    quotePolicyNonNumeric,
+				escapeStyle:    escapeStyleDouble,
+				lineTerminator: []byte("\n"),
+			},
+			args: args{
+				fields:  []string{"1", "a", "2.5"},
+				numeric: []bool{true, false, true},
+			},
+			want: "1,\"a\",2.5\n",
+		},
+		{
+			name: "Quoted with backslash escape",
+			format: &csvFormat{
+				separator:      []byte(","),
+				quote:          '"',
+				quotePolicy:    quotePolicyMinimal,
+				escapeStyle:    escapeStyleBackslash,
+				lineTerminator: []byte("\n"),
+			},
+			args: args{
+				fields: []string{"say \"hi\"", "c:\\dir"},
+			},
+			want: "\"say \\\"hi\\\"\",c:\\\\dir\n",
+		},
+		{
+			name: "None with backslash escape",
+			format: &csvFormat{
+				separator:      []byte("||"),
+				quote:          '"',
+				quotePolicy:    quotePolicyNone,
+				escapeStyle:    escapeStyleBackslash,
+				lineTerminator: []byte("\r\n"),
+			},
+			args: args{
+				fields: []string{"a||b", "line\nbreak", "q\""},
+			},
+			want: "a\\||b||line\\nbreak||q\\\"\r\n",
+		},
+		{
+			name: "None with double escape",
+			format: &csvFormat{
+				separator:      []byte(","),
+				quote:          '"',
+				quotePolicy:    quotePolicyNone,
+				escapeStyle:    escapeStyleDouble,
+				lineTerminator: []byte("\n"),
+			},
+			args: args{
+				fields: []string{"a,b", "q\""},
+			},
+			want: "a,b,q\"\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := bytes.Buffer{}
+			if err := newCsvWriter(&buffer, false, tt.format, newDefaultValueFormat(), nil).writeRecord(tt.args.fields, tt.args.numeric); err != nil {
+				t.Errorf("csvWriter.writeRecord() error = %v", err)
 				return
 			}
-			if !reflect.DeepEqual(gotFileInMemory, tt.wantFileInMemory) {
-				t.Errorf("createFileInMemory() = %v, want %v", string(gotFileInMemory), string(tt.wantFileInMemory))
+			if got := buffer.String(); got != tt.want {
+				t.Errorf("csvWriter.writeRecord() = %q, want %q", got, tt.want)
 			}
 		})
 	}
@@ -90,8 +282,23 @@ func createBqRow() services.IRowIterator {
 	return dummy
 }
 
+/*
+Write the rows of the iterator in the output, through the stages. name is the file name before the stages
+*/
+func createStagedFile(out io.Writer, name string, stages []outputStage, newRowWriter rowWriterFactory, rowIterator services.IRowIterator) error {
+	out, writers, err := newStagedWriters(out, name, stages)
+	if err != nil {
+		return err
+	}
+	if err = createFile(newRowWriter(out), rowIterator); err != nil {
+		return err
+	}
+	return closeStagedWriters(writers)
+}
+
 type DummyRowIterator struct {
-	Row [][]bigquery.Value
+	Row    [][]bigquery.Value
+	Schema bigquery.Schema
 }
 
 func (dummy *DummyRowIterator) Next(dst interface{}) error {
@@ -110,6 +317,9 @@ func (dummy *DummyRowIterator) PageInfo() *iterator.PageInfo {
 }
 
 func (dummy *DummyRowIterator) GetSchema() bigquery.Schema {
+	if dummy.Schema != nil {
+		return dummy.Schema
+	}
 	return bigquery.Schema{
 		&bigquery.FieldSchema{
 			Name: "id",
@@ -126,71 +336,10 @@ func (dummy *DummyRowIterator) GetSchema() bigquery.Schema {
 	}
 }
 
-func Test_bqToFtpController_sendFile(t *testing.T) {
-	mockFtp := &mocks.IFTPService{}
-	mockFtp.On("Send", "correct", mock.Anything).Return(nil)
-	mockFtp.On("Send", "error", mock.Anything).Return(errors.New("error"))
+type ErrorRowIterator struct {
+	DummyRowIterator
+}
 
-	type fields struct {
-		IBqToFtpController IBqToFtpController
-		configService      helpers.IConfigService
-		bigQueryService    services.IBigQueryService
-		ftpService         services.IFTPService
-		storageService     services.IStorageService
-		withHeader         bool
-		separator          []byte
-		filePrefix         string
-		timeFormat         string
-	}
-	type args struct {
-		fileName     string
-		fileInMemory []byte
-	}
-	tests := []struct {
-		name    string
-		fields  fields
-		args    args
-		wantErr bool
-	}{
-		{
-			name: "Correct Send",
-			fields: fields{
-				ftpService: mockFtp, //mock
-			},
-			args: args{
-				fileName:     "correct",
-				fileInMemory: []byte("correct"),
-			},
-			wantErr: false,
-		},
-		{
-			name: "Error Send",
-			fields: fields{
-				ftpService: mockFtp, //mock
-			},
-			args: args{
-				fileName:     "error",
-				fileInMemory: []byte("error"),
-			},
-			wantErr: true,
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			controller := &bqToFtpController{
-				IBqToFtpController: tt.fields.IBqToFtpController,
-				configService:      tt.fields.configService,
-				bigQueryService:    tt.fields.bigQueryService,
-				ftpService:         tt.fields.ftpService,
-				storageService:     tt.fields.storageService,
-				withHeader:         tt.fields.withHeader,
-				separator:          tt.fields.separator,
-				filePrefix:         tt.fields.filePrefix,
-				timeFormat:         tt.fields.timeFormat,
-			}
-			if err := controller.sendFile(tt.args.fileName, tt.args.fileInMemory); (err != nil) != tt.wantErr {
-				t.Errorf("bqToFtpController.sendFile() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
-	}
+func (dummy *ErrorRowIterator) Next(dst interface{}) error {
+	return errors.New("read error")
 }
@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"cloud.google.com/go/bigquery"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	computedRunId               = "RUN_ID"
+	computedExtractionTimestamp = "EXTRACTION_TIMESTAMP"
+	computedWindowStart         = "WINDOW_START"
+	computedWindowEnd           = "WINDOW_END"
+)
+
+/*
+Columns of the files, in the output order, loaded from a JSON file like
+{"columns": [{"column": "cust_id", "name": "CustomerId"}, {"name": "source", "value": "BQ"}, {"name": "run", "computed": "RUN_ID"}]}
+The columns of the query result which aren't listed are dropped
+*/
+type columnMapping struct {
+	Columns []*mappedColumn `json:"columns"`
+}
+
+/*
+Column of the files, defined by one of column, value or computed:
+  - column: name of the column in the query result
+  - name: name of the column in the files. The query result column name by default, required for the other columns
+  - value: constant value, a string, a number or a boolean
+  - computed: value of the run, RUN_ID (unique identifier of the run), EXTRACTION_TIMESTAMP (start of the run),
+    WINDOW_START or WINDOW_END (query window)
+*/
+type mappedColumn struct {
+	Column   string      `json:"column"`
+	Name     string      `json:"name"`
+	Value    interface{} `json:"value"`
+	Computed string      `json:"computed"`
+}
+
+/*
+Parse and check the column mapping. The constant number values are converted in INTEGER or FLOAT
+*/
+func parseColumnMapping(content string) (*columnMapping, error) {
+	mapping := &columnMapping{}
+	if err := json.Unmarshal([]byte(content), mapping); err != nil {
+		return nil, fmt.Errorf("invalid column mapping: %v", err)
+	}
+	if len(mapping.Columns) == 0 {
+		return nil, fmt.Errorf("invalid column mapping: no column defined")
+	}
+	names := make(map[string]bool)
+	for i, column := range mapping.Columns {
+		definitions := 0
+		if column.Column != "" {
+			definitions++
+		}
+		if column.Value != nil {
+			definitions++
+		}
+		if column.Computed != "" {
+			definitions++
+		}
+		if definitions != 1 {
+			return nil, fmt.Errorf("invalid column mapping: the column %d must have one of column, value or computed", i+1)
+		}
+		if column.Name == "" {
+			column.Name = column.Column
+		}
+		if column.Name == "" {
+			return nil, fmt.Errorf("invalid column mapping: the column %d has no name", i+1)
+		}
+		if names[column.Name] {
+			return nil, fmt.Errorf("invalid column mapping: the name %q is used by several columns", column.Name)
+		}
+		names[column.Name] = true
+
+		switch value := column.Value.(type) {
+		case nil, string, bool:
+		case float64:
+			if value == math.Trunc(value) && math.Abs(value) < 1<<53 {
+				column.Value = int64(value)
+			}
+		default:
+			return nil, fmt.Errorf("invalid column mapping: the value of the column %q must be a string, a number or a boolean", column.Name)
+		}
+
+		switch column.Computed = strings.ToUpper(column.Computed); column.Computed {
+		case "", computedRunId, computedExtractionTimestamp, computedWindowStart, computedWindowEnd:
+		default:
+			return nil, fmt.Errorf("invalid column mapping: unknown computed value %q of the column %q", column.Computed, column.Name)
+		}
+	}
+	return mapping, nil
+}
+
+/*
+Load the column mapping of the invocation, reloaded in case of force reload. nil if no mapping is defined
+*/
+func (controller *bqToFtpController) loadColumnMapping() (*columnMapping, error) {
+	content, err := controller.storageService.GetColumnMapping()
+	if err != nil || content == "" {
+		return nil, err
+	}
+	return parseColumnMapping(content)
+}
+
+/*
+Values of the run, for the computed columns
+*/
+type runValues struct {
+	runId       string
+	runDate     time.Time
+	windowStart time.Time
+	windowEnd   time.Time
+}
+
+/*
+Generate a random UUID which identifies the run
+*/
+func newRunId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	//Version 4 and RFC 4122 variant
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+/*
+Row writer which writes the mapped columns in the row writer
+*/
+type columnMappingWriter struct {
+	rowWriter
+	mapping *columnMapping
+	run     runValues
+	indexes []int
+	values  []bigquery.Value
+}
+
+/*
+Wrap the row writer with the column mapping. No wrap if the mapping is nil
+*/
+func (this *columnMapping) wrap(writer rowWriter, run runValues) rowWriter {
+	if this == nil {
+		return writer
+	}
+	return &columnMappingWriter{
+		rowWriter: writer,
+		mapping:   this,
+		run:       run,
+	}
+}
+
+func (this *columnMappingWriter) writeHeader(schema bigquery.Schema) error {
+	mappedSchema := make(bigquery.Schema, len(this.mapping.Columns))
+	this.indexes = make([]int, len(this.mapping.Columns))
+	this.values = make([]bigquery.Value, len(this.mapping.Columns))
+	for i, column := range this.mapping.Columns {
+		this.indexes[i] = -1
+		field := &bigquery.FieldSchema{Name: column.Name}
+		switch {
+		case column.Column != "":
+			for j, sourceField := range schema {
+				if sourceField.Name == column.Column {
+					this.indexes[i] = j
+					renamed := *sourceField
+					renamed.Name = column.Name
+					field = &renamed
+				}
+			}
+			if this.indexes[i] < 0 {
+				return fmt.Errorf("the column %q of the column mapping isn't in the query result", column.Column)
+			}
+		case column.Computed == computedRunId:
+			field.Type = bigquery.StringFieldType
+			this.values[i] = this.run.runId
+		case column.Computed != "":
+			field.Type = bigquery.TimestampFieldType
+			this.values[i] = map[string]time.Time{
+				computedExtractionTimestamp: this.run.runDate,
+				computedWindowStart:         this.run.windowStart,
+				computedWindowEnd:           this.run.windowEnd,
+			}[column.Computed]
+		default:
+			field.Type = constantFieldType(column.Value)
+			this.values[i] = column.Value
+		}
+		mappedSchema[i] = field
+	}
+	return this.rowWriter.writeHeader(mappedSchema)
+}
+
+/*
+Type of the column of a constant value
+*/
+func constantFieldType(value interface{}) bigquery.FieldType {
+	switch value.(type) {
+	case int64:
+		return bigquery.IntegerFieldType
+	case float64:
+		return bigquery.FloatFieldType
+	case bool:
+		return bigquery.BooleanFieldType
+	}
+	return bigquery.StringFieldType
+}
+
+func (this *columnMappingWriter) writeRow(values []bigquery.Value) error {
+	//The constant and computed values are set once in the header
+	for i, index := range this.indexes {
+		if index >= 0 {
+			this.values[i] = values[index]
+		}
+	}
+	return this.rowWriter.writeRow(this.values)
+}
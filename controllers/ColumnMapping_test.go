@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"testing"
+	"time"
+)
+
+func Test_parseColumnMapping(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name:    "Valid mapping",
+			content: `{"columns": [{"column": "id"}, {"column": "Name", "name": "name"}, {"name": "source", "value": "BQ"}, {"name": "run", "computed": "run_id"}]}`,
+		},
+		{
+			name:    "No column",
+			content: `{"columns": []}`,
+			wantErr: true,
+		},
+		{
+			name:    "Column and value",
+			content: `{"columns": [{"column": "id", "value": 1}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Constant without name",
+			content: `{"columns": [{"value": 1}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Duplicated name",
+			content: `{"columns": [{"column": "id"}, {"column": "Name", "name": "id"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Unknown computed value",
+			content: `{"columns": [{"name": "date", "computed": "TODAY"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Complex constant",
+			content: `{"columns": [{"name": "tags", "value": ["a"]}]}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseColumnMapping(tt.content); (err != nil) != tt.wantErr {
+				t.Errorf("parseColumnMapping() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_columnMappingWriter(t *testing.T) {
+	run := runValues{
+		runId:       "d1b5c1a4-6f1e-4a39-9c3e-1f0b7b1e2a10",
+		runDate:     time.Date(2019, 6, 2, 1, 30, 0, 0, time.UTC),
+		windowStart: time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "Rename, reorder and drop",
+			content: `{"columns": [{"column": "Value", "name": "amount"}, {"column": "id"}]}`,
+			want:    "amount,id\n1.5,0\n2.5,1\n",
+		},
+		{
+			name:    "Constant and computed columns",
+			content: `{"columns": [{"column": "id"}, {"name": "source", "value": "BQ"}, {"name": "version", "value": 2}, {"name": "run", "computed": "RUN_ID"}, {"name": "extracted", "computed": "EXTRACTION_TIMESTAMP"}, {"name": "from", "computed": "WINDOW_START"}]}`,
+			want: "id,source,version,run,extracted,from\n" +
+				"0,BQ,2,d1b5c1a4-6f1e-4a39-9c3e-1f0b7b1e2a10,2019-06-02 01:30:00 UTC,2019-06-01 00:00:00 UTC\n" +
+				"1,BQ,2,d1b5c1a4-6f1e-4a39-9c3e-1f0b7b1e2a10,2019-06-02 01:30:00 UTC,2019-06-01 00:00:00 UTC\n",
+		},
+		{
+			name:    "Unknown column",
+			content: `{"columns": [{"column": "country"}]}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mapping, err := parseColumnMapping(tt.content)
+			if err != nil {
+				t.Errorf("parseColumnMapping() error = %v", err)
+				return
+			}
+			buffer := bytes.Buffer{}
+			writer := mapping.wrap(newCsvWriter(&buffer, true, newDefaultCsvFormat(), newDefaultValueFormat(), nil), run)
+			rowIterator := &DummyRowIterator{
+				Row: [][]bigquery.Value{{int64(0), "name0", 1.5}, {int64(1), "name1", 2.5}},
+				Schema: bigquery.Schema{
+					{Name: "id", Type: bigquery.IntegerFieldType},
+					{Name: "Name", Type: bigquery.StringFieldType},
+					{Name: "Value", Type: bigquery.FloatFieldType},
+				},
+			}
+			if err = createFile(writer, rowIterator); (err != nil) != tt.wantErr {
+				t.Errorf("createFile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := buffer.String(); !tt.wantErr && got != tt.want {
+				t.Errorf("columnMappingWriter wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newRunId(t *testing.T) {
+	first, second := newRunId(), newRunId()
+	if len(first) != 36 || first[14] != '4' || first == second {
+		t.Errorf("newRunId() = %v and %v, want distinct version 4 UUIDs", first, second)
+	}
+}
@@ -0,0 +1,309 @@
+package controllers
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	transformRedact   = "REDACT"
+	transformMask     = "MASK"
+	transformHash     = "HASH"
+	transformTruncate = "TRUNCATE"
+
+	hashSha256 = "SHA256"
+	hashHmac   = "HMAC"
+
+	truncateYear  = "YEAR"
+	truncateMonth = "MONTH"
+	truncateDay   = "DAY"
+	truncateHour  = "HOUR"
+
+	defaultMaskKeep = 4
+	defaultMaskChar = "*"
+)
+
+/*
+Transform of a sensitive column. The transformed columns become STRING, except with TRUNCATE which keeps the column
+type. The transforms are defined in a JSON list like
+[{"column": "email", "transform": "HASH"}, {"column": "card", "transform": "MASK", "keep": 4}]
+  - column: name of the column in the files
+  - transform: REDACT, MASK, HASH or TRUNCATE. The NULL values stay NULL
+  - replacement: REDACT only. Value written instead of the original one, NULL if missing
+  - keep: MASK only. Number of last characters kept, 4 by default
+  - maskChar: MASK only. Single character which replaces the other characters, * by default
+  - algorithm: HASH only. SHA256 (default) of the key followed by the value, or HMAC-SHA256 with the key. Hexadecimal
+    result
+  - length: TRUNCATE only. Number of first characters kept of the STRING values
+  - unit: TRUNCATE only. YEAR, MONTH, DAY or HOUR kept of the TIMESTAMP, DATETIME and DATE values
+*/
+type columnTransform struct {
+	Column      string  `json:"column"`
+	Transform   string  `json:"transform"`
+	Replacement *string `json:"replacement"`
+	Keep        *int    `json:"keep"`
+	MaskChar    string  `json:"maskChar"`
+	Algorithm   string  `json:"algorithm"`
+	Length      int     `json:"length"`
+	Unit        string  `json:"unit"`
+}
+
+/*
+Transforms of the sensitive columns, applied before the files leave GCP
+*/
+type columnTransforms struct {
+	transforms  []*columnTransform
+	hashKey     []byte
+	valueFormat *valueFormat
+}
+
+/*
+Load the transforms from the environment variables. Return nil if no transform is defined.
+Fatal if a transform is wrong, the sensitive columns can't be delivered without their transform
+*/
+func newColumnTransforms(configService helpers.IConfigService, valueFormat *valueFormat) *columnTransforms {
+	content := configService.GetEnvVar(models.COLUMN_TRANSFORMS)
+	if content == "" {
+		return nil
+	}
+	transforms, err := parseColumnTransforms(content, []byte(configService.GetEnvVar(models.PII_HASH_KEY)))
+	if err != nil {
+		log.Fatalf("Impossible to load the COLUMN_TRANSFORMS with error %v", err)
+	}
+	transforms.valueFormat = valueFormat
+	return transforms
+}
+
+/*
+Parse and check the transforms. Default values are set on the missing optional ones
+*/
+func parseColumnTransforms(content string, hashKey []byte) (*columnTransforms, error) {
+	transforms := &columnTransforms{hashKey: hashKey}
+	if err := json.Unmarshal([]byte(content), &transforms.transforms); err != nil {
+		return nil, fmt.Errorf("invalid column transforms: %v", err)
+	}
+	columns := make(map[string]bool)
+	for _, transform := range transforms.transforms {
+		if transform.Column == "" {
+			return nil, fmt.Errorf("invalid column transforms: a transform has no column")
+		}
+		if columns[transform.Column] {
+			return nil, fmt.Errorf("invalid column transforms: the column %q has several transforms", transform.Column)
+		}
+		columns[transform.Column] = true
+
+		switch transform.Transform = strings.ToUpper(transform.Transform); transform.Transform {
+		case transformRedact:
+		case transformMask:
+			if transform.Keep == nil {
+				keep := defaultMaskKeep
+				transform.Keep = &keep
+			}
+			if *transform.Keep < 0 {
+				return nil, fmt.Errorf("invalid column transforms: the keep of the column %q must be positive", transform.Column)
+			}
+			if transform.MaskChar == "" {
+				transform.MaskChar = defaultMaskChar
+			}
+			if utf8.RuneCountInString(transform.MaskChar) != 1 {
+				return nil, fmt.Errorf("invalid column transforms: the mask char %q of the column %q must be a single character", transform.MaskChar, transform.Column)
+			}
+		case transformHash:
+			switch transform.Algorithm = strings.ToUpper(transform.Algorithm); transform.Algorithm {
+			case "":
+				transform.Algorithm = hashSha256
+			case hashSha256, hashHmac:
+			default:
+				return nil, fmt.Errorf("invalid column transforms: unknown algorithm %q of the column %q", transform.Algorithm, transform.Column)
+			}
+			//Without key, the hash of the known values can be computed by anyone
+			if len(hashKey) == 0 {
+				return nil, fmt.Errorf("invalid column transforms: the column %q is hashed without PII_HASH_KEY", transform.Column)
+			}
+		case transformTruncate:
+			switch transform.Unit = strings.ToUpper(transform.Unit); transform.Unit {
+			case "", truncateYear, truncateMonth, truncateDay, truncateHour:
+			default:
+				return nil, fmt.Errorf("invalid column transforms: unknown unit %q of the column %q", transform.Unit, transform.Column)
+			}
+			if transform.Length <= 0 && transform.Unit == "" {
+				return nil, fmt.Errorf("invalid column transforms: the column %q must have a length or a unit", transform.Column)
+			}
+		default:
+			return nil, fmt.Errorf("invalid column transforms: unknown transform %q of the column %q", transform.Transform, transform.Column)
+		}
+	}
+	return transforms, nil
+}
+
+/*
+Wrap the row writer with the transforms. No wrap if the transforms are nil
+*/
+func (this *columnTransforms) wrap(writer rowWriter) rowWriter {
+	if this == nil {
+		return writer
+	}
+	return &columnTransformWriter{
+		rowWriter:  writer,
+		transforms: this,
+	}
+}
+
+/*
+Row writer which transforms the values of the sensitive columns
+*/
+type columnTransformWriter struct {
+	rowWriter
+	transforms *columnTransforms
+	schema     bigquery.Schema
+	columns    []*columnTransform
+	values     []bigquery.Value
+}
+
+func (this *columnTransformWriter) writeHeader(schema bigquery.Schema) error {
+	this.schema = schema
+	this.columns = make([]*columnTransform, len(schema))
+	this.values = make([]bigquery.Value, len(schema))
+	transformedSchema := make(bigquery.Schema, len(schema))
+	copy(transformedSchema, schema)
+	for _, transform := range this.transforms.transforms {
+		index := -1
+		for i, field := range schema {
+			if field.Name == transform.Column {
+				index = i
+			}
+		}
+		if index < 0 {
+			return fmt.Errorf("the transformed column %q isn't in the query result", transform.Column)
+		}
+		field := schema[index]
+		if field.Repeated || field.Type == bigquery.RecordFieldType {
+			return fmt.Errorf("the REPEATED or RECORD column %q can't be transformed", transform.Column)
+		}
+		if transform.Transform == transformTruncate {
+			if err := checkTruncateType(transform, field.Type); err != nil {
+				return err
+			}
+		} else {
+			//The transformed values are text
+			transformed := *field
+			transformed.Type = bigquery.StringFieldType
+			transformedSchema[index] = &transformed
+		}
+		this.columns[index] = transform
+	}
+	return this.rowWriter.writeHeader(transformedSchema)
+}
+
+func (this *columnTransformWriter) writeRow(values []bigquery.Value) (err error) {
+	for i, value := range values {
+		this.values[i] = value
+		if transform := this.columns[i]; transform != nil && value != nil {
+			if this.values[i], err = this.transforms.apply(transform, this.schema[i], value); err != nil {
+				return
+			}
+		}
+	}
+	return this.rowWriter.writeRow(this.values)
+}
+
+func checkTruncateType(transform *columnTransform, fieldType bigquery.FieldType) error {
+	switch fieldType {
+	case bigquery.StringFieldType:
+		if transform.Length > 0 {
+			return nil
+		}
+	case bigquery.TimestampFieldType, bigquery.DateTimeFieldType, bigquery.DateFieldType:
+		if transform.Unit != "" {
+			return nil
+		}
+	}
+	return fmt.Errorf("the %s column %q can't be truncated with the length %d and the unit %q", fieldType, transform.Column, transform.Length, transform.Unit)
+}
+
+/*
+Transform the not null value of the column
+*/
+func (this *columnTransforms) apply(transform *columnTransform, field *bigquery.FieldSchema, value bigquery.Value) (bigquery.Value, error) {
+	switch transform.Transform {
+	case transformRedact:
+		if transform.Replacement == nil {
+			return nil, nil
+		}
+		return *transform.Replacement, nil
+	case transformTruncate:
+		return this.truncate(transform, value), nil
+	}
+
+	text, err := this.valueFormat.formatValue(field, value)
+	if err != nil {
+		return nil, err
+	}
+	if transform.Transform == transformMask {
+		characters := []rune(text)
+		for i := 0; i < len(characters)-*transform.Keep; i++ {
+			characters[i], _ = utf8.DecodeRuneInString(transform.MaskChar)
+		}
+		return string(characters), nil
+	}
+	if transform.Algorithm == hashHmac {
+		mac := hmac.New(sha256.New, this.hashKey)
+		mac.Write([]byte(text))
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	}
+	hash := sha256.New()
+	hash.Write(this.hashKey)
+	hash.Write([]byte(text))
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/*
+Truncate the value and keep its type. The timestamps are truncated in the time zone of the values
+*/
+func (this *columnTransforms) truncate(transform *columnTransform, value bigquery.Value) bigquery.Value {
+	switch value := value.(type) {
+	case string:
+		if characters := []rune(value); len(characters) > transform.Length {
+			return string(characters[:transform.Length])
+		}
+		return value
+	case time.Time:
+		local := value.In(this.valueFormat.location)
+		date, clock := truncateDateTime(transform.Unit, civil.DateOf(local), civil.TimeOf(local))
+		return time.Date(date.Year, date.Month, date.Day, clock.Hour, 0, 0, 0, local.Location())
+	case civil.DateTime:
+		date, clock := truncateDateTime(transform.Unit, value.Date, value.Time)
+		return civil.DateTime{Date: date, Time: clock}
+	case civil.Date:
+		date, _ := truncateDateTime(transform.Unit, value, civil.Time{})
+		return date
+	}
+	return value
+}
+
+/*
+Keep the date and the time up to the unit
+*/
+func truncateDateTime(unit string, date civil.Date, clock civil.Time) (civil.Date, civil.Time) {
+	hour := clock.Hour
+	switch unit {
+	case truncateYear:
+		date.Month, date.Day, hour = time.January, 1, 0
+	case truncateMonth:
+		date.Day, hour = 1, 0
+	case truncateDay:
+		hour = 0
+	}
+	return date, civil.Time{Hour: hour}
+}
@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"testing"
+	"time"
+)
+
+func Test_parseColumnTransforms(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		hashKey string
+		wantErr bool
+	}{
+		{
+			name:    "Valid transforms",
+			content: `[{"column": "email", "transform": "hash"}, {"column": "card", "transform": "MASK", "keep": 2, "maskChar": "#"}, {"column": "phone", "transform": "REDACT", "replacement": "XXX"}, {"column": "birth", "transform": "TRUNCATE", "unit": "year"}]`,
+			hashKey: "secret",
+		},
+		{
+			name:    "Unknown transform",
+			content: `[{"column": "email", "transform": "ENCRYPT"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "Hash without key",
+			content: `[{"column": "email", "transform": "HASH"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "Unknown hash algorithm",
+			content: `[{"column": "email", "transform": "HASH", "algorithm": "MD5"}]`,
+			hashKey: "secret",
+			wantErr: true,
+		},
+		{
+			name:    "Several mask characters",
+			content: `[{"column": "card", "transform": "MASK", "maskChar": "**"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "Duplicated column",
+			content: `[{"column": "card", "transform": "MASK"}, {"column": "card", "transform": "REDACT"}]`,
+			wantErr: true,
+		},
+		{
+			name:    "Truncate without length or unit",
+			content: `[{"column": "birth", "transform": "TRUNCATE"}]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseColumnTransforms(tt.content, []byte(tt.hashKey)); (err != nil) != tt.wantErr {
+				t.Errorf("parseColumnTransforms() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_columnTransformWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "Redact to null and to a replacement",
+			content: `[{"column": "Name", "transform": "REDACT"}, {"column": "card", "transform": "REDACT", "replacement": "XXX"}]`,
+			want:    "id,Name,card,created\n0,,XXX,2019-06-15 10:20:30 UTC\n1,,,2019-07-01 00:00:00 UTC\n",
+		},
+		{
+			name:    "Mask all but the last characters",
+			content: `[{"column": "card", "transform": "MASK"}, {"column": "id", "transform": "MASK", "keep": 0, "maskChar": "#"}]`,
+			want:    "id,Name,card,created\n#,name0,************3456,2019-06-15 10:20:30 UTC\n#,name1,,2019-07-01 00:00:00 UTC\n",
+		},
+		{
+			name:    "Hash with the key",
+			content: `[{"column": "Name", "transform": "HASH"}]`,
+			want: "id,Name,card,created\n" +
+				"0,b375d4e665e81b854ea2e7a4dc05d489fa8fb5c3a99641a35a659850c6d4e355,1234567890123456,2019-06-15 10:20:30 UTC\n" +
+				"1,2cca2c07046eeeeef0b01c62ffc5d4e3bb7e536d2ec00350ee639a573a4b50cf,,2019-07-01 00:00:00 UTC\n",
+		},
+		{
+			name:    "HMAC with the key",
+			content: `[{"column": "Name", "transform": "HASH", "algorithm": "HMAC"}]`,
+			want: "id,Name,card,created\n" +
+				"0,3dd4e03fdd1cb9cb7c6ce036038ea59c1e971c584e358d8c908d812cbf3fcb8e,1234567890123456,2019-06-15 10:20:30 UTC\n" +
+				"1,3559da98977a57b030902861e5d60d2f4aae5b426ba6a02ffd3b2aaa229b3d2c,,2019-07-01 00:00:00 UTC\n",
+		},
+		{
+			name:    "Truncate a string and a timestamp",
+			content: `[{"column": "card", "transform": "TRUNCATE", "length": 6}, {"column": "created", "transform": "TRUNCATE", "unit": "MONTH"}]`,
+			want:    "id,Name,card,created\n0,name0,123456,2019-06-01 00:00:00 UTC\n1,name1,,2019-07-01 00:00:00 UTC\n",
+		},
+		{
+			name:    "Truncate an integer",
+			content: `[{"column": "id", "transform": "TRUNCATE", "length": 1}]`,
+			wantErr: true,
+		},
+		{
+			name:    "Unknown column",
+			content: `[{"column": "email", "transform": "REDACT"}]`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transforms, err := parseColumnTransforms(tt.content, []byte("secret"))
+			if err != nil {
+				t.Errorf("parseColumnTransforms() error = %v", err)
+				return
+			}
+			transforms.valueFormat = newDefaultValueFormat()
+			buffer := bytes.Buffer{}
+			writer := transforms.wrap(newCsvWriter(&buffer, true, newDefaultCsvFormat(), newDefaultValueFormat(), nil))
+			rowIterator := &DummyRowIterator{
+				Row: [][]bigquery.Value{
+					{int64(0), "name0", "1234567890123456", time.Date(2019, 6, 15, 10, 20, 30, 0, time.UTC)},
+					{int64(1), "name1", nil, time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)},
+				},
+				Schema: bigquery.Schema{
+					{Name: "id", Type: bigquery.IntegerFieldType},
+					{Name: "Name", Type: bigquery.StringFieldType},
+					{Name: "card", Type: bigquery.StringFieldType},
+					{Name: "created", Type: bigquery.TimestampFieldType},
+				},
+			}
+			if err = createFile(writer, rowIterator); (err != nil) != tt.wantErr {
+				t.Errorf("createFile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := buffer.String(); !tt.wantErr && got != tt.want {
+				t.Errorf("columnTransformWriter wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
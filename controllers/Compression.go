@@ -0,0 +1,135 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"compress/flate"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	compressionNone = "NONE"
+	compressionGzip = "GZIP"
+	compressionZstd = "ZSTD"
+	compressionZip  = "ZIP"
+)
+
+/*
+Describe how the delivered file is compressed:
+  - algorithm: NONE (default), GZIP, ZSTD or ZIP (an archive which contains the file)
+  - level: compression level, from 1 (fastest) to 9 (best) for GZIP and ZIP, from 1 to 22 for ZSTD. Algorithm default
+    if not set
+*/
+type compressionFormat struct {
+	algorithm string
+	level     int
+}
+
+/*
+Load the compression format from the environment variables. Wrong values are logged and replaced by the default one
+*/
+func newCompressionFormat(configService helpers.IConfigService) *compressionFormat {
+	format := &compressionFormat{
+		algorithm: compressionNone,
+	}
+
+	switch algorithm := strings.ToUpper(configService.GetEnvVar(models.COMPRESSION)); algorithm {
+	case "":
+	case compressionNone, compressionGzip, compressionZstd, compressionZip:
+		format.algorithm = algorithm
+	default:
+		log.Errorf("Unknown COMPRESSION parameter %q. Compression is set to %s", algorithm, format.algorithm)
+	}
+
+	format.level = format.defaultLevel()
+	if level := configService.GetEnvVar(models.COMPRESSION_LEVEL); level != "" && format.algorithm != compressionNone {
+		maxLevel := flate.BestCompression
+		if format.algorithm == compressionZstd {
+			maxLevel = 22
+		}
+		value, err := strconv.Atoi(level)
+		if err != nil || value < 1 || value > maxLevel {
+			log.Errorf("The COMPRESSION_LEVEL parameter %q must be a number between 1 and %d for %s. Default level is used", level, maxLevel, format.algorithm)
+		} else {
+			format.level = value
+		}
+	}
+	return format
+}
+
+func (this *compressionFormat) defaultLevel() int {
+	if this.algorithm == compressionZstd {
+		return 3
+	}
+	return flate.DefaultCompression
+}
+
+/*
+Name of the delivered file. The compression extension is added to the file name, or replaces its extension for ZIP
+*/
+func (this *compressionFormat) fileName(name string) string {
+	switch this.algorithm {
+	case compressionGzip:
+		return name + ".gz"
+	case compressionZstd:
+		return name + ".zst"
+	case compressionZip:
+		if index := strings.LastIndex(name, "."); index > 0 {
+			name = name[:index]
+		}
+		return name + ".zip"
+	}
+	return name
+}
+
+/*
+Create the writer which compresses the content in the output. name is the name of the file in the ZIP archive.
+The compressed content is complete after the close, which doesn't close the output
+*/
+func (this *compressionFormat) newWriter(out io.Writer, name string) (io.WriteCloser, error) {
+	switch this.algorithm {
+	case compressionGzip:
+		return gzip.NewWriterLevel(out, this.level)
+	case compressionZstd:
+		return zstd.NewWriter(out, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(this.level)))
+	case compressionZip:
+		archive := zip.NewWriter(out)
+		archive.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, this.level)
+		})
+		entry, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: time.Now(),
+		})
+		return &zipEntryWriter{Writer: entry, archive: archive}, err
+	}
+	return &nopWriteCloser{Writer: out}, nil
+}
+
+/*
+Writer of the single file of a ZIP archive. Close ends the archive
+*/
+type zipEntryWriter struct {
+	io.Writer
+	archive *zip.Writer
+}
+
+func (this *zipEntryWriter) Close() error {
+	return this.archive.Close()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (this *nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func Test_compressionFormat_fileName(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		fileName  string
+		want      string
+	}{
+		{name: "No compression", algorithm: compressionNone, fileName: "export.csv", want: "export.csv"},
+		{name: "Gzip", algorithm: compressionGzip, fileName: "export.csv", want: "export.csv.gz"},
+		{name: "Zstd", algorithm: compressionZstd, fileName: "export.jsonl", want: "export.jsonl.zst"},
+		{name: "Zip", algorithm: compressionZip, fileName: "export.20190601.csv", want: "export.20190601.zip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format := &compressionFormat{algorithm: tt.algorithm}
+			if got := format.fileName(tt.fileName); got != tt.want {
+				t.Errorf("compressionFormat.fileName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_compressionFormat_newWriter(t *testing.T) {
+	want := "id,Name,Value\n1,Joe,x\n"
+	tests := []struct {
+		name       string
+		format     *compressionFormat
+		decompress func(content []byte) (io.Reader, error)
+	}{
+		{
+			name:   "No compression",
+			format: &compressionFormat{algorithm: compressionNone},
+			decompress: func(content []byte) (io.Reader, error) {
+				return bytes.NewReader(content), nil
+			},
+		},
+		{
+			name:   "Gzip",
+			format: &compressionFormat{algorithm: compressionGzip, level: 9},
+			decompress: func(content []byte) (io.Reader, error) {
+				return gzip.NewReader(bytes.NewReader(content))
+			},
+		},
+		{
+			name:   "Zstd",
+			format: &compressionFormat{algorithm: compressionZstd, level: 1},
+			decompress: func(content []byte) (io.Reader, error) {
+				return zstd.NewReader(bytes.NewReader(content))
+			},
+		},
+		{
+			name:   "Zip",
+			format: &compressionFormat{algorithm: compressionZip, level: 1},
+			decompress: func(content []byte) (io.Reader, error) {
+				archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+				if err != nil {
+					return nil, err
+				}
+				if len(archive.File) != 1 || archive.File[0].Name != "export.csv" {
+					t.Errorf("compressionFormat.newWriter zip archive = %v, want only export.csv", archive.File)
+				}
+				return archive.File[0].Open()
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := bytes.Buffer{}
+			newRowWriter := func(out io.Writer) rowWriter {
+				return newCsvWriter(out, true, newDefaultCsvFormat(), newDefaultValueFormat(), nil)
+			}
+			rowIterator := &DummyRowIterator{Row: [][]bigquery.Value{{"1", "Joe", "x"}}}
+			if err := createStagedFile(&buffer, "export.csv", []outputStage{tt.format}, newRowWriter, rowIterator); err != nil {
+				t.Errorf("compressionFormat.newWriter() error = %v", err)
+				return
+			}
+			reader, err := tt.decompress(buffer.Bytes())
+			if err != nil {
+				t.Errorf("compressionFormat.newWriter() wrote an unreadable content with error %v", err)
+				return
+			}
+			if got, _ := ioutil.ReadAll(reader); string(got) != want {
+				t.Errorf("compressionFormat.newWriter() = %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package controllers
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"strings"
+)
+
+const (
+	quotePolicyMinimal    = "MINIMAL"
+	quotePolicyAll        = "ALL"
+	quotePolicyNonNumeric = "NON_NUMERIC"
+	quotePolicyNone       = "NONE"
+
+	escapeStyleDouble    = "DOUBLE"
+	escapeStyleBackslash = "BACKSLASH"
+
+	lineTerminatorLF   = "LF"
+	lineTerminatorCRLF = "CRLF"
+)
+
+/*
+Describe how the values are written in the CSV file, according to RFC 4180 by default:
+  - separator: value separator, comma by default
+  - quote: character used to enclose the values, double quote by default
+  - quotePolicy: MINIMAL (only values which contain separator, quote or line break), ALL, NON_NUMERIC or NONE
+  - escapeStyle: DOUBLE (the quote is doubled) or BACKSLASH (the quote is prefixed by a backslash)
+  - lineTerminator: end of each record, LF or CRLF
+*/
+type csvFormat struct {
+	separator      []byte
+	quote          byte
+	quotePolicy    string
+	escapeStyle    string
+	lineTerminator []byte
+}
+
+func newDefaultCsvFormat() *csvFormat {
+	return &csvFormat{
+		separator:      []byte(","),
+		quote:          '"',
+		quotePolicy:    quotePolicyMinimal,
+		escapeStyle:    escapeStyleDouble,
+		lineTerminator: []byte("\n"),
+	}
+}
+
+/*
+Load the CSV format from the environment variables. Wrong values are logged and replaced by the default RFC 4180 one
+*/
+func newCsvFormat(configService helpers.IConfigService) *csvFormat {
+	format := newDefaultCsvFormat()
+
+	if separator := configService.GetEnvVar(models.SEPARATOR); separator != "" {
+		format.separator = []byte(separator)
+	}
+
+	if quote := configService.GetEnvVar(models.QUOTE_CHAR); len(quote) == 1 {
+		format.quote = quote[0]
+	} else if quote != "" {
+		log.Errorf("The QUOTE_CHAR parameter %q must be a single character. Quote is set to %q", quote, format.quote)
+	}
+
+	switch quotePolicy := strings.ToUpper(configService.GetEnvVar(models.QUOTE_POLICY)); quotePolicy {
+	case "":
+	case quotePolicyMinimal, quotePolicyAll, quotePolicyNonNumeric, quotePolicyNone:
+		format.quotePolicy = quotePolicy
+	default:
+		log.Errorf("Unknown QUOTE_POLICY parameter %q. Quote policy is set to %s", quotePolicy, format.quotePolicy)
+	}
+
+	switch escapeStyle := strings.ToUpper(configService.GetEnvVar(models.ESCAPE_STYLE)); escapeStyle {
+	case "":
+	case escapeStyleDouble, escapeStyleBackslash:
+		format.escapeStyle = escapeStyle
+	default:
+		log.Errorf("Unknown ESCAPE_STYLE parameter %q. Escape style is set to %s", escapeStyle, format.escapeStyle)
+	}
+
+	switch lineTerminator := strings.ToUpper(configService.GetEnvVar(models.LINE_TERMINATOR)); lineTerminator {
+	case "", lineTerminatorLF:
+	case lineTerminatorCRLF:
+		format.lineTerminator = []byte("\r\n")
+	default:
+		log.Errorf("Unknown LINE_TERMINATOR parameter %q. Line terminator is set to LF", lineTerminator)
+	}
+	return format
+}
+
+type csvWriter struct {
+	rowWriter
+	writer      io.Writer
+	withHeader  bool
+	format      *csvFormat
+	valueFormat *valueFormat
+	encoding    *outputEncoding
+	schema      bigquery.Schema
+	numeric     []bool
+}
+
+func newCsvWriter(writer io.Writer, withHeader bool, format *csvFormat, valueFormat *valueFormat, encoding *outputEncoding) *csvWriter {
+	return &csvWriter{
+		writer:      writer,
+		withHeader:  withHeader,
+		format:      format,
+		valueFormat: valueFormat,
+		encoding:    encoding,
+	}
+}
+
+/*
+Write the column names if the header is activated
+*/
+func (this *csvWriter) writeHeader(schema bigquery.Schema) error {
+	this.schema = schema
+	this.numeric = numericFields(schema)
+	if !this.withHeader {
+		return nil
+	}
+	names := make([]string, len(schema))
+	for i, schemaField := range schema {
+		names[i] = schemaField.Name
+	}
+	return this.writeRecord(names, nil)
+}
+
+func (this *csvWriter) writeRow(values []bigquery.Value) (err error) {
+	if len(values) != len(this.schema) {
+		return fmt.Errorf("the record has %d values for %d fields in the schema", len(values), len(this.schema))
+	}
+	fields := make([]string, len(values))
+	for i, value := range values {
+		if fields[i], err = this.valueFormat.format(this.schema[i], value); err != nil {
+			return
+		}
+	}
+	return this.writeRecord(fields, this.numeric)
+}
+
+func (this *csvWriter) close() error {
+	return nil
+}
+
+/*
+Write one record. numeric flags, if provided, tell which fields come from a numeric column for the NON_NUMERIC policy.
+The fields are transliterated before the quoting
+*/
+func (this *csvWriter) writeRecord(fields []string, numeric []bool) (err error) {
+	buffer := bytes.Buffer{}
+	for i, field := range fields {
+		field = this.encoding.transliterateText(field)
+		//don't write the separator before the first field
+		if i > 0 {
+			buffer.Write(this.format.separator)
+		}
+		isNumeric := i < len(numeric) && numeric[i]
+		if this.format.needQuote(field, isNumeric) {
+			buffer.WriteByte(this.format.quote)
+			buffer.Write(this.format.escape(field, true))
+			buffer.WriteByte(this.format.quote)
+		} else {
+			buffer.Write(this.format.escape(field, false))
+		}
+	}
+	buffer.Write(this.format.lineTerminator)
+	_, err = this.writer.Write(buffer.Bytes())
+	return
+}
+
+func (this *csvFormat) needQuote(field string, numeric bool) bool {
+	switch this.quotePolicy {
+	case quotePolicyAll:
+		return true
+	case quotePolicyNone:
+		return false
+	case quotePolicyNonNumeric:
+		if !numeric {
+			return true
+		}
+	}
+	return this.containSpecialChar(field)
+}
+
+func (this *csvFormat) containSpecialChar(field string) bool {
+	return bytes.Contains([]byte(field), this.separator) ||
+		bytes.IndexByte([]byte(field), this.quote) >= 0 ||
+		bytes.ContainsAny([]byte(field), "\r\n")
+}
+
+/*
+Escape the quote char in a quoted field. In an unquoted field (NONE policy), only the BACKSLASH style escape the
+separator, the quote, the line breaks and the backslash itself. With DOUBLE style, the unquoted field is written as is.
+*/
+func (this *csvFormat) escape(field string, quoted bool) []byte {
+	value := []byte(field)
+	if this.escapeStyle == escapeStyleBackslash {
+		escaped := bytes.Buffer{}
+		for i := 0; i < len(value); i++ {
+			switch {
+			case value[i] == '\\' || value[i] == this.quote:
+				escaped.WriteByte('\\')
+				escaped.WriteByte(value[i])
+			case !quoted && value[i] == '\n':
+				escaped.WriteString("\\n")
+			case !quoted && value[i] == '\r':
+				escaped.WriteString("\\r")
+			case !quoted && len(this.separator) > 0 && bytes.HasPrefix(value[i:], this.separator):
+				escaped.WriteByte('\\')
+				escaped.Write(this.separator)
+				i += len(this.separator) - 1
+			default:
+				escaped.WriteByte(value[i])
+			}
+		}
+		return escaped.Bytes()
+	}
+	if quoted {
+		return bytes.ReplaceAll(value, []byte{this.quote}, []byte{this.quote, this.quote})
+	}
+	return value
+}
+
+/*
+Return, for each field of the schema, true if the column type is numeric
+*/
+func numericFields(schema bigquery.Schema) []bool {
+	numeric := make([]bool, len(schema))
+	for i, schemaField := range schema {
+		if schemaField.Repeated {
+			continue
+		}
+		switch schemaField.Type {
+		case bigquery.IntegerFieldType, bigquery.FloatFieldType, bigquery.NumericFieldType:
+			numeric[i] = true
+		}
+	}
+	return numeric
+}
@@ -0,0 +1,289 @@
+package controllers
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"bqToFtp/services"
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const maxSendAttempts = 3
+
+const (
+	deliveryPolicyFallback = "FALLBACK"
+	deliveryPolicyFail     = "FAIL"
+	deliveryPolicyPartial  = "PARTIAL"
+)
+
+/*
+Names of the destinations, used as prefix of their environment variables
+*/
+var destinationNamePattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+/*
+Destination of the files, with its own protocol, credentials, path and retry policy:
+  - name: name of the destination in DESTINATIONS. Empty for the single destination of the FTP_* variables
+  - service: service which sends the files with the protocol of the destination
+  - attempts: number of attempts for each file, the streamed upload included
+  - retryDelay: wait between two attempts
+  - directoryTemplate: template part of the FTP_PATH of the destination, rendered with the run values. nil if the path
+    is static
+*/
+type destination struct {
+	name              string
+	service           services.IFTPService
+	attempts          int
+	retryDelay        time.Duration
+	directoryTemplate *template.Template
+}
+
+/*
+Create the destinations of the comma separated DESTINATIONS list. Each destination is configured by the environment
+variables prefixed by its name, like PARTNER_FTP_SERVER for the PARTNER destination. Without DESTINATIONS, the single
+destination is configured by the FTP_* variables.
+The services are created concurrently. Fatal if a name is wrong
+*/
+func NewDestinations(configService helpers.IConfigService) []*destination {
+	var names []string
+	for _, name := range strings.Split(configService.GetEnvVar(models.DESTINATIONS), ",") {
+		if name = strings.ToUpper(strings.TrimSpace(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return []*destination{newDestination("", configService)}
+	}
+
+	known := make(map[string]bool)
+	for _, name := range names {
+		if !destinationNamePattern.MatchString(name) || known[name] {
+			log.Fatalf("Invalid DESTINATIONS %q. The names must be distinct, with letters, digits and underscores", configService.GetEnvVar(models.DESTINATIONS))
+		}
+		known[name] = true
+	}
+
+	destinations := make([]*destination, len(names))
+	wg := sync.WaitGroup{}
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			destinations[i] = newDestination(name, &helpers.PrefixedConfigService{
+				IConfigService: configService,
+				Prefix:         name + "_",
+				Shared:         []helpers.EnvVarEnum{models.GCP_PROJECT},
+			})
+		}(i, name)
+	}
+	wg.Wait()
+	return destinations
+}
+
+/*
+Load the destination from its environment variables. Wrong retry values are logged and replaced by the default one.
+Fatal if the FTP_PATH template is wrong, the files would be delivered in another directory
+*/
+func newDestination(name string, configService helpers.IConfigService) *destination {
+	destination := &destination{
+		name:     name,
+		service:  services.NewDestinationService(configService),
+		attempts: maxSendAttempts,
+	}
+
+	if attempts := configService.GetEnvVar(models.SEND_ATTEMPTS); attempts != "" {
+		value, err := strconv.Atoi(attempts)
+		if err != nil || value < 1 {
+			log.Errorf("Impossible to convert to strictly positive Integer the SEND_ATTEMPTS parameter %q of %s. Attempts are set to %d", attempts, destination, destination.attempts)
+		} else {
+			destination.attempts = value
+		}
+	}
+
+	if retryDelay := configService.GetEnvVar(models.SEND_RETRY_DELAY); retryDelay != "" {
+		value, err := time.ParseDuration(retryDelay)
+		if err != nil || value < 0 {
+			log.Errorf("Impossible to convert to positive duration the SEND_RETRY_DELAY parameter %q of %s. The retries aren't delayed", retryDelay, destination)
+		} else {
+			destination.retryDelay = value
+		}
+	}
+
+	if _, text := helpers.SplitPathTemplate(configService.GetEnvVar(models.FTP_PATH)); text != "" {
+		directoryTemplate, err := template.New(string(models.FTP_PATH)).Option("missingkey=error").Parse(text)
+		if err == nil {
+			//Check the template with the values of a run
+			err = directoryTemplate.Execute(&bytes.Buffer{}, fileNameData{RunTime: time.Now()})
+		}
+		if err != nil {
+			log.Fatalf("Impossible to use the FTP_PATH template %q of %s with error %v", text, destination, err)
+		}
+		destination.directoryTemplate = directoryTemplate
+	}
+	return destination
+}
+
+func (this *destination) String() string {
+	if this.name == "" {
+		return "the destination"
+	}
+	return "the destination " + this.name
+}
+
+/*
+Send the file to the destination with the number of attempts provided. The source is rewound before each attempt. The
+metadata are sent with the file if the destination supports them. The error of the last attempt is returned
+*/
+func (this *destination) sendFile(fileName string, src io.ReadSeeker, attempts int, metadata map[string]string) error {
+	numberOfError := 0
+	for {
+		_, err := src.Seek(0, io.SeekStart)
+		if err == nil {
+			if service, ok := this.service.(services.IMetadataService); ok && metadata != nil {
+				err = service.SendWithMetadata(fileName, src, metadata)
+			} else {
+				err = this.service.Send(fileName, src)
+			}
+		}
+		if err != nil {
+			numberOfError++
+			if numberOfError >= attempts {
+				return fmt.Errorf("%d send attempts in error, last error: %v", numberOfError, err)
+			}
+			log.Warningf("Error while sending the file to %s with error %v. Perform a retry", this, err)
+			time.Sleep(this.retryDelay)
+		} else {
+			//Correct send by ftp
+			return nil
+		}
+	}
+}
+
+/*
+Name of the file in the fallback bucket. The files of the named destinations are stored in a directory of their name
+*/
+func (this *destination) fallbackName(name string) string {
+	if this.name == "" {
+		return name
+	}
+	return this.name + "/" + name
+}
+
+/*
+Load the policy applied when a file isn't delivered to some destinations, after the retries:
+  - FALLBACK (default): the file is stored in the fallback bucket for these destinations, the run continues
+  - FAIL: the file is stored in the fallback bucket for these destinations, and the run fails
+  - PARTIAL: the failure is only reported if another destination received the file, else the file is stored in the
+    fallback bucket
+*/
+func newDeliveryPolicy(configService helpers.IConfigService) string {
+	switch policy := strings.ToUpper(configService.GetEnvVar(models.DELIVERY_POLICY)); policy {
+	case "":
+	case deliveryPolicyFallback, deliveryPolicyFail, deliveryPolicyPartial:
+		return policy
+	default:
+		log.Errorf("Unknown DELIVERY_POLICY parameter %q. Delivery policy is set to %s", policy, deliveryPolicyFallback)
+	}
+	return deliveryPolicyFallback
+}
+
+/*
+Render the directory of the run for each destination, relative to the static directories of its FTP_PATH
+*/
+func (controller *bqToFtpController) runDirectories(runDate time.Time, window models.QueryWindow) ([]string, error) {
+	directories := make([]string, len(controller.destinations))
+	for i, destination := range controller.destinations {
+		directory, err := controller.fileNameFormat.directory(destination.directoryTemplate, runDate, window)
+		if err != nil {
+			return nil, fmt.Errorf("impossible to render the FTP_PATH template of %s: %v", destination, err)
+		}
+		directories[i] = directory
+	}
+	return directories, nil
+}
+
+/*
+Delivery of a file to a destination
+*/
+type deliveryState int
+
+const (
+	statePending deliveryState = iota
+	stateDelivered
+	stateFallback
+	stateFailed
+)
+
+/*
+Run the delivery to each destination concurrently. The first error is returned
+*/
+func forEachDestination(count int, deliver func(i int) error) error {
+	errs := make([]error, count)
+	wg := sync.WaitGroup{}
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = deliver(i)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Metadata of the file, sent with it to the destinations which support them: the row count and the query window
+*/
+func fileMetadata(rowCount int, window models.QueryWindow) map[string]string {
+	return map[string]string{
+		"rowCount":    strconv.Itoa(rowCount),
+		"windowStart": window.Start.Format(time.RFC3339),
+		"windowEnd":   window.End.Format(time.RFC3339),
+	}
+}
+
+/*
+Result of the run for a destination, in number of data files
+*/
+type destinationReport struct {
+	Name      string `json:"name,omitempty"`
+	Delivered int    `json:"delivered"`
+	Fallback  int    `json:"fallback"`
+	Failed    int    `json:"failed"`
+}
+
+/*
+Count the delivery of the files of the run for each destination
+*/
+func (controller *bqToFtpController) deliveryReports(parts []*filePart) []destinationReport {
+	reports := make([]destinationReport, len(controller.destinations))
+	for i, destination := range controller.destinations {
+		reports[i].Name = destination.name
+	}
+	for _, part := range parts {
+		for i, upload := range part.file.uploads {
+			switch upload.state {
+			case stateDelivered:
+				reports[i].Delivered++
+			case stateFallback:
+				reports[i].Fallback++
+			case stateFailed:
+				reports[i].Failed++
+			}
+		}
+	}
+	return reports
+}
@@ -0,0 +1,275 @@
+package controllers
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/mocks"
+	"bqToFtp/models"
+	"bqToFtp/services"
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_destination_sendFile(t *testing.T) {
+	mockFtp := &mocks.IFTPService{}
+	mockFtp.On("Send", "correct", mock.Anything).Return(nil)
+	mockFtp.On("Send", "error", mock.Anything).Return(errors.New("connection refused"))
+
+	type fields struct {
+		service services.IFTPService
+	}
+	type args struct {
+		fileName string
+		src      io.ReadSeeker
+		attempts int
+	}
+	tests := []struct {
+		name    string
+		fields  fields
+		args    args
+		wantErr bool
+	}{
+		{
+			name: "Correct Send",
+			fields: fields{
+				service: mockFtp, //mock
+			},
+			args: args{
+				fileName: "correct",
+				src:      bytes.NewReader([]byte("correct")),
+				attempts: 3,
+			},
+			wantErr: false,
+		},
+		{
+			name: "Error Send",
+			fields: fields{
+				service: mockFtp, //mock
+			},
+			args: args{
+				fileName: "error",
+				src:      bytes.NewReader([]byte("error")),
+				attempts: 3,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			destination := &destination{
+				service: tt.fields.service,
+			}
+			err := destination.sendFile(tt.args.fileName, tt.args.src, tt.args.attempts, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("destination.sendFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "connection refused") {
+				t.Errorf("destination.sendFile() error = %v, want the error of the last attempt", err)
+			}
+		})
+	}
+}
+
+/*
+Config service backed by a map, for building the destinations in the tests
+*/
+type mapConfigService map[helpers.EnvVarEnum]string
+
+func (this mapConfigService) GetEnvVar(enum helpers.EnvVarEnum) string {
+	return this[enum]
+}
+
+func Test_NewDestinations(t *testing.T) {
+	destinations := NewDestinations(mapConfigService{
+		models.GCP_PROJECT:                   "project",
+		models.DESTINATIONS:                  "partner, archive",
+		"PARTNER_" + models.FTP_SERVER:       "ftp.partner.com",
+		"PARTNER_" + models.FTP_PATH:         "/in/{{.Year}}",
+		"ARCHIVE_" + models.FTP_SERVER:       "ftp.archive.com",
+		"ARCHIVE_" + models.SEND_ATTEMPTS:    "5",
+		"ARCHIVE_" + models.SEND_RETRY_DELAY: "10s",
+		models.SEND_ATTEMPTS:                 "1",
+	})
+	if len(destinations) != 2 {
+		t.Fatalf("NewDestinations() = %d destinations, want 2", len(destinations))
+	}
+	partner, archive := destinations[0], destinations[1]
+	if partner.name != "PARTNER" || partner.attempts != maxSendAttempts || partner.retryDelay != 0 || partner.directoryTemplate == nil {
+		t.Errorf("NewDestinations() partner = %+v", partner)
+	}
+	if archive.name != "ARCHIVE" || archive.attempts != 5 || archive.retryDelay != 10*time.Second || archive.directoryTemplate != nil {
+		t.Errorf("NewDestinations() archive = %+v", archive)
+	}
+}
+
+func Test_bqToFtpController_closeStreamedFile_destinations(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      string
+		partnerErr  error
+		wantStored  []string
+		wantReports []destinationReport
+		wantErr     bool
+	}{
+		{
+			name:        "Delivered to all the destinations",
+			policy:      deliveryPolicyFallback,
+			wantReports: []destinationReport{{Name: "PARTNER", Delivered: 1}, {Name: "ARCHIVE", Delivered: 1}},
+		},
+		{
+			name:        "Failed destination in fallback",
+			policy:      deliveryPolicyFallback,
+			partnerErr:  errors.New("error"),
+			wantStored:  []string{"PARTNER/2019/export.csv"},
+			wantReports: []destinationReport{{Name: "PARTNER", Fallback: 1}, {Name: "ARCHIVE", Delivered: 1}},
+		},
+		{
+			name:        "Failed destination fails the run",
+			policy:      deliveryPolicyFail,
+			partnerErr:  errors.New("error"),
+			wantStored:  []string{"PARTNER/2019/export.csv"},
+			wantReports: []destinationReport{{Name: "PARTNER", Fallback: 1}, {Name: "ARCHIVE", Delivered: 1}},
+			wantErr:     true,
+		},
+		{
+			name:        "Partial delivery",
+			policy:      deliveryPolicyPartial,
+			partnerErr:  errors.New("error"),
+			wantReports: []destinationReport{{Name: "PARTNER", Failed: 1}, {Name: "ARCHIVE", Delivered: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var archived string
+			partnerFtp := &mocks.IFTPService{}
+			partnerFtp.On("Send", "2019/export.csv", mock.Anything).Return(tt.partnerErr)
+			archiveFtp := &mocks.IFTPService{}
+			archiveFtp.On("Send", "export.csv", mock.Anything).Run(readAll(&archived)).Return(nil)
+			var stored []string
+			mockStorage := &mocks.IStorageService{}
+			mockStorage.On("FallbackStoreFile", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				stored = append(stored, args.String(0))
+			}).Return(nil)
+
+			controller := &bqToFtpController{
+				destinations: []*destination{
+					{name: "PARTNER", service: streamedFtpService{partnerFtp}, attempts: 2},
+					{name: "ARCHIVE", service: streamedFtpService{archiveFtp}, attempts: 2},
+				},
+				deliveryPolicy: tt.policy,
+				storageService: mockStorage,
+			}
+			file, err := controller.newStreamedFile("export.csv", []string{"2019/", ""})
+			if err != nil {
+				t.Errorf("bqToFtpController.newStreamedFile() error = %v", err)
+				return
+			}
+			file.Write([]byte("content"))
+			if err := controller.closeStreamedFile(file, nil); (err != nil) != tt.wantErr {
+				t.Errorf("bqToFtpController.closeStreamedFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if archived != "content" {
+				t.Errorf("bqToFtpController.closeStreamedFile() archived = %q, want %q", archived, "content")
+			}
+			if !reflect.DeepEqual(stored, tt.wantStored) {
+				t.Errorf("bqToFtpController.closeStreamedFile() stored = %v, want %v", stored, tt.wantStored)
+			}
+			if got := controller.deliveryReports([]*filePart{{file: file}}); !reflect.DeepEqual(got, tt.wantReports) {
+				t.Errorf("bqToFtpController.deliveryReports() = %+v, want %+v", got, tt.wantReports)
+			}
+		})
+	}
+}
+
+type metadataService struct {
+	*mocks.IFTPService
+	*mocks.IMetadataService
+}
+
+func Test_bqToFtpController_closeStreamedFile_metadata(t *testing.T) {
+	metadata := fileMetadata(42, models.QueryWindow{
+		Start: time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC),
+		End:   time.Date(2019, 6, 2, 0, 0, 0, 0, time.UTC),
+	})
+	wantMetadata := map[string]string{
+		"rowCount":    "42",
+		"windowStart": "2019-06-01T00:00:00Z",
+		"windowEnd":   "2019-06-02T00:00:00Z",
+	}
+	if !reflect.DeepEqual(metadata, wantMetadata) {
+		t.Errorf("fileMetadata() = %v, want %v", metadata, wantMetadata)
+	}
+
+	tests := []struct {
+		name        string
+		metadataErr error
+		wantCalls   int
+		wantStored  []string
+		wantReports []destinationReport
+	}{
+		{
+			name:        "File sent with its metadata",
+			wantCalls:   1,
+			wantReports: []destinationReport{{Name: "GCS", Delivered: 1}, {Name: "PARTNER", Delivered: 1}},
+		},
+		{
+			name:        "Upload in error",
+			metadataErr: errors.New("error"),
+			wantCalls:   2,
+			wantStored:  []string{"GCS/2019/export.csv"},
+			wantReports: []destinationReport{{Name: "GCS", Fallback: 1}, {Name: "PARTNER", Delivered: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent, streamed string
+			mockMetadata := &mocks.IMetadataService{}
+			mockMetadata.On("SendWithMetadata", "2019/export.csv", mock.Anything, metadata).Run(func(args mock.Arguments) {
+				content, _ := ioutil.ReadAll(args.Get(1).(io.Reader))
+				sent = string(content)
+			}).Return(tt.metadataErr)
+			gcs := &destination{name: "GCS", service: metadataService{&mocks.IFTPService{}, mockMetadata}, attempts: 2}
+			//The FTP destinations have no metadata, the file is streamed
+			partnerFtp := &mocks.IFTPService{}
+			partnerFtp.On("Send", "export.csv", mock.Anything).Run(readAll(&streamed)).Return(nil)
+			ftp := &destination{name: "PARTNER", service: streamedFtpService{partnerFtp}, attempts: 2}
+			var stored []string
+			mockStorage := &mocks.IStorageService{}
+			mockStorage.On("FallbackStoreFile", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				stored = append(stored, args.String(0))
+			}).Return(nil)
+
+			controller := &bqToFtpController{
+				destinations:   []*destination{gcs, ftp},
+				deliveryPolicy: deliveryPolicyFallback,
+				storageService: mockStorage,
+			}
+			file, err := controller.newStreamedFile("export.csv", []string{"2019/", ""})
+			if err != nil {
+				t.Errorf("bqToFtpController.newStreamedFile() error = %v", err)
+				return
+			}
+			file.Write([]byte("content"))
+			file.metadata = metadata
+			if err := controller.closeStreamedFile(file, nil); err != nil {
+				t.Errorf("bqToFtpController.closeStreamedFile() error = %v", err)
+			}
+			if sent != "content" || streamed != "content" {
+				t.Errorf("bqToFtpController.closeStreamedFile() sent = %q and streamed = %q, want the content", sent, streamed)
+			}
+			if !reflect.DeepEqual(stored, tt.wantStored) {
+				t.Errorf("bqToFtpController.closeStreamedFile() stored = %v, want %v", stored, tt.wantStored)
+			}
+			if got := controller.deliveryReports([]*filePart{{file: file}}); !reflect.DeepEqual(got, tt.wantReports) {
+				t.Errorf("bqToFtpController.deliveryReports() = %+v, want %+v", got, tt.wantReports)
+			}
+			mockMetadata.AssertNumberOfCalls(t, "SendWithMetadata", tt.wantCalls)
+		})
+	}
+}
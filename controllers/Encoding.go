@@ -0,0 +1,249 @@
+package controllers
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/unicode/norm"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	encodingUtf8        = "UTF-8"
+	encodingIso88591    = "ISO-8859-1"
+	encodingWindows1252 = "WINDOWS-1252"
+
+	unmappableFail          = "FAIL"
+	unmappableReplace       = "REPLACE"
+	unmappableTransliterate = "TRANSLITERATE"
+
+	replacementChar = '?'
+)
+
+var charmaps = map[string]*charmap.Charmap{
+	encodingIso88591:    charmap.ISO8859_1,
+	encodingWindows1252: charmap.Windows1252,
+}
+
+var utf8Bom = []byte("\xEF\xBB\xBF")
+
+/*
+Transliteration of the characters which don't decompose in a base letter and accents
+*/
+var transliterations = map[rune]string{
+	'‘': "'", '’': "'", '‚': "'", '‛': "'", '“': `"`, '”': `"`, '„': `"`, '‟': `"`,
+	'‐': "-", '‑': "-", '‒': "-", '–': "-", '—': "-", '―': "-", '…': "...", '•': "*",
+	'€': "EUR", '™': "TM", '©': "(C)", '®': "(R)", '\u2009': " ", '\u202f': " ",
+	'Œ': "OE", 'œ': "oe", 'Æ': "AE", 'æ': "ae", 'ß': "ss", 'Ø': "O", 'ø': "o", 'Ł': "L", 'ł': "l", 'Đ': "D", 'đ': "d",
+}
+
+/*
+Character encoding of the text formats, applied to the content before the compression:
+  - name: UTF-8 (default, the content isn't transcoded), ISO-8859-1 or WINDOWS-1252
+  - bom: true to write the UTF-8 byte order mark at the beginning of the file
+  - unmappable: what to do with the characters which don't exist in the encoding. FAIL (default) stops the file,
+    REPLACE writes a question mark and TRANSLITERATE writes the closest characters, like e for é, or a question mark
+*/
+type outputEncoding struct {
+	name       string
+	charmap    *charmap.Charmap
+	bom        bool
+	unmappable string
+}
+
+/*
+Load the encoding from the environment variables. Wrong values are logged and replaced by the default one.
+Return nil if the content is written in UTF-8 without BOM
+*/
+func newOutputEncoding(configService helpers.IConfigService, outputFormat string) *outputEncoding {
+	encoding := &outputEncoding{
+		name:       encodingUtf8,
+		unmappable: unmappableFail,
+	}
+
+	switch name := strings.ToUpper(configService.GetEnvVar(models.ENCODING)); name {
+	case "", encodingUtf8:
+	case encodingIso88591, encodingWindows1252:
+		encoding.name = name
+		encoding.charmap = charmaps[name]
+	default:
+		log.Errorf("Unknown ENCODING parameter %q. Encoding is set to %s", name, encoding.name)
+	}
+
+	if bom := configService.GetEnvVar(models.ENCODING_BOM); bom != "" {
+		var err error
+		if encoding.bom, err = strconv.ParseBool(bom); err != nil {
+			log.Errorf("Impossible to convert to Boolean the ENCODING_BOM parameter %q. BOM is set to FALSE", bom)
+		}
+		if encoding.bom && encoding.charmap != nil {
+			log.Errorf("The ENCODING_BOM parameter is only supported by the UTF-8 encoding. BOM is set to FALSE")
+			encoding.bom = false
+		}
+	}
+
+	switch unmappable := strings.ToUpper(configService.GetEnvVar(models.UNMAPPABLE_CHARS)); unmappable {
+	case "":
+	case unmappableFail, unmappableReplace, unmappableTransliterate:
+		encoding.unmappable = unmappable
+	default:
+		log.Errorf("Unknown UNMAPPABLE_CHARS parameter %q. Unmappable characters are set to %s", unmappable, encoding.unmappable)
+	}
+
+	if encoding.charmap == nil && !encoding.bom {
+		return nil
+	}
+	if outputFormat == outputFormatParquet || outputFormat == outputFormatAvro || outputFormat == outputFormatXlsx {
+		log.Errorf("The ENCODING and ENCODING_BOM parameters are only supported by the text formats. They are ignored in %s", outputFormat)
+		return nil
+	}
+	if encoding.unmappable == unmappableTransliterate && (outputFormat == outputFormatJson || outputFormat == outputFormatJsonLines) {
+		//A transliteration, like " for “, can break the JSON strings
+		log.Errorf("The TRANSLITERATE unmappable characters aren't supported in %s. Unmappable characters are set to %s", outputFormat, unmappableReplace)
+		encoding.unmappable = unmappableReplace
+	}
+	return encoding
+}
+
+/*
+The encoding doesn't change the file name
+*/
+func (this *outputEncoding) fileName(name string) string {
+	return name
+}
+
+/*
+Create the writer which transcodes the UTF-8 content in the output. The BOM is written first
+*/
+func (this *outputEncoding) newWriter(out io.Writer, name string) (io.WriteCloser, error) {
+	if this.bom {
+		if _, err := out.Write(utf8Bom); err != nil {
+			return nil, err
+		}
+	}
+	if this.charmap == nil {
+		return &nopWriteCloser{Writer: out}, nil
+	}
+	return &transcodingWriter{out: out, encoding: this}, nil
+}
+
+/*
+Append the encoded rune to the buffer, according with the strategy for the unmappable characters
+*/
+func (this *outputEncoding) appendRune(buffer []byte, r rune) ([]byte, error) {
+	if b, ok := this.charmap.EncodeRune(r); ok {
+		return append(buffer, b), nil
+	}
+	switch this.unmappable {
+	case unmappableReplace:
+		return append(buffer, replacementChar), nil
+	case unmappableTransliterate:
+		for _, transliterated := range this.transliterate(r) {
+			b, _ := this.charmap.EncodeRune(transliterated)
+			buffer = append(buffer, b)
+		}
+		return buffer, nil
+	}
+	return nil, fmt.Errorf("the character %q can't be encoded in %s", r, this.name)
+}
+
+/*
+Replace the characters which don't exist in the encoding by their transliteration, with the TRANSLITERATE strategy.
+The row writers apply it on each value before the quoting and the padding, because a transliteration can be a quote or
+several characters
+*/
+func (this *outputEncoding) transliterateText(text string) string {
+	if this == nil || this.charmap == nil || this.unmappable != unmappableTransliterate {
+		return text
+	}
+	var transliterated strings.Builder
+	for _, r := range text {
+		if _, ok := this.charmap.EncodeRune(r); ok {
+			transliterated.WriteRune(r)
+		} else {
+			transliterated.WriteString(this.transliterate(r))
+		}
+	}
+	return transliterated.String()
+}
+
+/*
+Closest characters in the encoding: the known transliteration, or the base letter without its accents. A question mark
+if none exists
+*/
+func (this *outputEncoding) transliterate(r rune) string {
+	text, ok := transliterations[r]
+	if !ok {
+		text = norm.NFD.String(string(r))
+	}
+	var transliterated []rune
+	for _, decomposed := range text {
+		if unicode.Is(unicode.Mn, decomposed) {
+			continue
+		}
+		if _, ok := this.charmap.EncodeRune(decomposed); !ok {
+			return string(replacementChar)
+		}
+		transliterated = append(transliterated, decomposed)
+	}
+	if len(transliterated) == 0 {
+		return string(replacementChar)
+	}
+	return string(transliterated)
+}
+
+/*
+Writer which transcodes the UTF-8 content in a single byte encoding. A character split between two writes is kept
+until its end
+*/
+type transcodingWriter struct {
+	out      io.Writer
+	encoding *outputEncoding
+	pending  []byte
+	buffer   []byte
+}
+
+func (this *transcodingWriter) Write(p []byte) (n int, err error) {
+	content := p
+	if len(this.pending) > 0 {
+		content = append(this.pending, p...)
+	}
+	this.buffer = this.buffer[:0]
+	i := 0
+	for i < len(content) {
+		if content[i] < utf8.RuneSelf {
+			this.buffer = append(this.buffer, content[i])
+			i++
+			continue
+		}
+		if !utf8.FullRune(content[i:]) {
+			break
+		}
+		r, size := utf8.DecodeRune(content[i:])
+		if this.buffer, err = this.encoding.appendRune(this.buffer, r); err != nil {
+			return 0, err
+		}
+		i += size
+	}
+	this.pending = append(this.pending[:0], content[i:]...)
+	if _, err = this.out.Write(this.buffer); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+/*
+Check that the content doesn't end in the middle of a character. The output isn't closed
+*/
+func (this *transcodingWriter) Close() error {
+	if len(this.pending) > 0 {
+		return errors.New("the content ends with an incomplete UTF-8 character")
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"golang.org/x/text/encoding/charmap"
+	"io"
+	"testing"
+)
+
+func Test_outputEncoding_newWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding *outputEncoding
+		writes   []string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "UTF-8 with BOM",
+			encoding: &outputEncoding{name: encodingUtf8, bom: true},
+			writes:   []string{"café"},
+			want:     "\xEF\xBB\xBFcafé",
+		},
+		{
+			name:     "ISO-8859-1 with a character split between two writes",
+			encoding: &outputEncoding{name: encodingIso88591, charmap: charmap.ISO8859_1, unmappable: unmappableFail},
+			writes:   []string{"caf\xC3", "\xA9;Zoë\n"},
+			want:     "caf\xE9;Zo\xEB\n",
+		},
+		{
+			name:     "Windows-1252 euro sign",
+			encoding: &outputEncoding{name: encodingWindows1252, charmap: charmap.Windows1252, unmappable: unmappableFail},
+			writes:   []string{"10€"},
+			want:     "10\x80",
+		},
+		{
+			name:     "Unmappable character fails",
+			encoding: &outputEncoding{name: encodingIso88591, charmap: charmap.ISO8859_1, unmappable: unmappableFail},
+			writes:   []string{"10€"},
+			wantErr:  true,
+		},
+		{
+			name:     "Unmappable character replaced",
+			encoding: &outputEncoding{name: encodingIso88591, charmap: charmap.ISO8859_1, unmappable: unmappableReplace},
+			writes:   []string{"10€ Łódź"},
+			want:     "10? ?\xF3d?",
+		},
+		{
+			name:     "Unmappable character transliterated",
+			encoding: &outputEncoding{name: encodingIso88591, charmap: charmap.ISO8859_1, unmappable: unmappableTransliterate},
+			writes:   []string{"10€ Łódź “œuvre” 東"},
+			want:     "10EUR L\xF3dz \"oeuvre\" ?",
+		},
+		{
+			name:     "Incomplete character at the end",
+			encoding: &outputEncoding{name: encodingIso88591, charmap: charmap.ISO8859_1, unmappable: unmappableFail},
+			writes:   []string{"caf\xC3"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := bytes.Buffer{}
+			writer, err := tt.encoding.newWriter(&buffer, "export.csv")
+			for _, write := range tt.writes {
+				if err == nil {
+					_, err = writer.Write([]byte(write))
+				}
+			}
+			if err == nil {
+				err = writer.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("outputEncoding.newWriter() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := buffer.String(); !tt.wantErr && got != tt.want {
+				t.Errorf("outputEncoding.newWriter() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_outputEncoding_transliterateText(t *testing.T) {
+	transliterate := &outputEncoding{name: encodingIso88591, charmap: charmap.ISO8859_1, unmappable: unmappableTransliterate}
+	schema := bigquery.Schema{
+		{Name: "text", Type: bigquery.StringFieldType},
+		{Name: "other", Type: bigquery.StringFieldType},
+	}
+	layout := &fixedWidthLayout{Columns: []*fixedWidthColumn{
+		{Column: "text", Start: 1, Width: 8, Alignment: alignmentLeft, Padding: ".", Truncation: truncationError},
+		{Column: "other", Start: 9, Width: 5, Alignment: alignmentLeft, Padding: " ", Truncation: truncationError},
+	}}
+
+	tests := []struct {
+		name         string
+		encoding     *outputEncoding
+		newRowWriter rowWriterFactory
+		values       []bigquery.Value
+		want         string
+	}{
+		{
+			name:     "CSV field with curly quotes",
+			encoding: transliterate,
+			newRowWriter: func(out io.Writer) rowWriter {
+				return newCsvWriter(out, false, newDefaultCsvFormat(), newDefaultValueFormat(), transliterate)
+			},
+			values: []bigquery.Value{"say “hi”, ok", "plain"},
+			want:   "\"say \"\"hi\"\", ok\",plain\n",
+		},
+		{
+			name:     "Fixed-width column with a multi-character transliteration",
+			encoding: transliterate,
+			newRowWriter: func(out io.Writer) rowWriter {
+				return newFixedWidthWriter(out, layout, newDefaultValueFormat(), transliterate, []byte("\n"))
+			},
+			values: []bigquery.Value{"œuvre", "café"},
+			want:   "oeuvre..caf\xE9 \n",
+		},
+		{
+			name:     "Without transliteration",
+			encoding: &outputEncoding{name: encodingIso88591, charmap: charmap.ISO8859_1, unmappable: unmappableReplace},
+			newRowWriter: func(out io.Writer) rowWriter {
+				return newCsvWriter(out, false, newDefaultCsvFormat(), newDefaultValueFormat(), nil)
+			},
+			values: []bigquery.Value{"“hi”", "plain"},
+			want:   "?hi?,plain\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := bytes.Buffer{}
+			stage, err := tt.encoding.newWriter(&buffer, "export.csv")
+			if err != nil {
+				t.Fatalf("outputEncoding.newWriter() error = %v", err)
+			}
+			writer := tt.newRowWriter(stage)
+			if err = writer.writeHeader(schema); err == nil {
+				err = writer.writeRow(tt.values)
+			}
+			if err == nil {
+				err = stage.Close()
+			}
+			if err != nil {
+				t.Errorf("rowWriter.writeRow() error = %v", err)
+				return
+			}
+			if got := buffer.String(); got != tt.want {
+				t.Errorf("rowWriter.writeRow() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"bqToFtp/services"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+/*
+Encrypt the delivered file for the recipients with OpenPGP, and sign it if a signer is defined
+*/
+type pgpEncryption struct {
+	recipients openpgp.EntityList
+	signer     *openpgp.Entity
+}
+
+/*
+Load the recipient public keys and the signing private key. Return nil if no recipient is defined.
+Fatal if a key is wrong, the file can't be delivered without the required encryption
+*/
+func newPgpEncryption(configService helpers.IConfigService, storageService services.IStorageService) *pgpEncryption {
+	publicKeys := configService.GetEnvVar(models.PGP_PUBLIC_KEYS)
+	if publicKeys == "" {
+		return nil
+	}
+	encryption := &pgpEncryption{}
+
+	var err error
+	if encryption.recipients, err = loadPgpPublicKeys(publicKeys, storageService); err != nil {
+		log.Fatalf("Impossible to load the PGP_PUBLIC_KEYS with error %v", err)
+	}
+
+	if signingKey := configService.GetEnvVar(models.PGP_SIGNING_KEY); signingKey != "" {
+		encryption.signer, err = parsePgpPrivateKey(signingKey, configService.GetEnvVar(models.PGP_SIGNING_KEY_PASSPHRASE))
+		if err != nil {
+			log.Fatalf("Impossible to load the PGP_SIGNING_KEY with error %v", err)
+		}
+	}
+
+	//Check that the keys can encrypt and sign
+	if err = encryption.check(); err != nil {
+		log.Fatalf("Impossible to encrypt with the PGP keys with error %v", err)
+	}
+	return encryption
+}
+
+/*
+Load the public keys. The keys are an armored key ring, or a comma separated list of paths to key files on Cloud Storage
+*/
+func loadPgpPublicKeys(publicKeys string, storageService services.IStorageService) (openpgp.EntityList, error) {
+	if !strings.HasPrefix(publicKeys, "gs://") {
+		return readPgpKeyRing([]byte(publicKeys))
+	}
+	var recipients openpgp.EntityList
+	for _, path := range strings.Split(publicKeys, ",") {
+		content, err := storageService.ReadFile(strings.TrimSpace(path))
+		if err != nil {
+			return nil, fmt.Errorf("impossible to read the key file %q: %v", path, err)
+		}
+		keyRing, err := readPgpKeyRing(content)
+		if err != nil {
+			return nil, fmt.Errorf("impossible to parse the key file %q: %v", path, err)
+		}
+		recipients = append(recipients, keyRing...)
+	}
+	return recipients, nil
+}
+
+/*
+Read a binary key ring or armored key rings, several armored blocks can follow each other
+*/
+func readPgpKeyRing(content []byte) (openpgp.EntityList, error) {
+	blockStart := []byte("-----BEGIN PGP")
+	if !bytes.Contains(content, blockStart) {
+		return openpgp.ReadKeyRing(bytes.NewReader(content))
+	}
+	//The armor decoder reads ahead of its block, each block is decoded separately
+	var keyRing openpgp.EntityList
+	for start := bytes.Index(content, blockStart); start >= 0; {
+		end := bytes.Index(content[start+len(blockStart):], blockStart)
+		armored := content[start:]
+		if end >= 0 {
+			armored = content[start : start+len(blockStart)+end]
+		}
+		block, err := armor.Decode(bytes.NewReader(armored))
+		if err != nil {
+			return nil, err
+		}
+		entities, err := openpgp.ReadKeyRing(block.Body)
+		if err != nil {
+			return nil, err
+		}
+		keyRing = append(keyRing, entities...)
+		if end < 0 {
+			break
+		}
+		start += len(blockStart) + end
+	}
+	if len(keyRing) == 0 {
+		return nil, errors.New("no key found")
+	}
+	return keyRing, nil
+}
+
+/*
+Read the armored private key, decrypted with the passphrase if it's protected
+*/
+func parsePgpPrivateKey(privateKey string, passphrase string) (*openpgp.Entity, error) {
+	keyRing, err := readPgpKeyRing([]byte(privateKey))
+	if err != nil {
+		return nil, err
+	}
+	signer := keyRing[0]
+	if signer.PrivateKey == nil {
+		return nil, errors.New("the key isn't a private key")
+	}
+	if signer.PrivateKey.Encrypted {
+		if err = signer.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+			return nil, err
+		}
+	}
+	for _, subkey := range signer.Subkeys {
+		if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+			if err = subkey.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return signer, nil
+}
+
+func (this *pgpEncryption) check() error {
+	writer, err := openpgp.Encrypt(ioutil.Discard, this.recipients, this.signer, nil, nil)
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+/*
+Name of the encrypted file, with the .pgp suffix
+*/
+func (this *pgpEncryption) fileName(name string) string {
+	return name + ".pgp"
+}
+
+/*
+Create the writer which encrypts the content in the output. The encrypted content is complete after the close, which
+doesn't close the output
+*/
+func (this *pgpEncryption) newWriter(out io.Writer, name string) (io.WriteCloser, error) {
+	return openpgp.Encrypt(out, this.recipients, this.signer, &openpgp.FileHints{IsBinary: true, FileName: name}, nil)
+}
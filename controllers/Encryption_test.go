@@ -0,0 +1,140 @@
+package controllers
+
+import (
+	"bqToFtp/mocks"
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"compress/gzip"
+	"errors"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+/*
+Generate a key pair and return the entity with its armored public key
+*/
+func generatePgpKey(t *testing.T, name string) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity(name, "", name+"@example.com", nil)
+	if err != nil {
+		t.Fatalf("Impossible to generate the PGP key with error %v", err)
+	}
+	buffer := bytes.Buffer{}
+	armored, _ := armor.Encode(&buffer, openpgp.PublicKeyType, nil)
+	entity.Serialize(armored)
+	armored.Close()
+	return entity, buffer.String()
+}
+
+func Test_loadPgpPublicKeys(t *testing.T) {
+	_, firstKey := generatePgpKey(t, "first")
+	_, secondKey := generatePgpKey(t, "second")
+	tests := []struct {
+		name       string
+		publicKeys string
+		files      map[string]string
+		wantCount  int
+		wantErr    bool
+	}{
+		{
+			name:       "Armored key ring",
+			publicKeys: firstKey + secondKey,
+			wantCount:  2,
+		},
+		{
+			name:       "Key files on Cloud Storage",
+			publicKeys: "gs://bucket/first.asc, gs://bucket/second.asc",
+			files:      map[string]string{"gs://bucket/first.asc": firstKey, "gs://bucket/second.asc": secondKey},
+			wantCount:  2,
+		},
+		{
+			name:       "Missing key file",
+			publicKeys: "gs://bucket/missing.asc",
+			wantErr:    true,
+		},
+		{
+			name:       "Wrong key",
+			publicKeys: "not a key",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storageService := &mocks.IStorageService{}
+			storageService.On("ReadFile", "gs://bucket/missing.asc").Return(nil, errors.New("not found"))
+			for path, content := range tt.files {
+				storageService.On("ReadFile", path).Return([]byte(content), nil)
+			}
+			got, err := loadPgpPublicKeys(tt.publicKeys, storageService)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadPgpPublicKeys() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(got) != tt.wantCount {
+				t.Errorf("loadPgpPublicKeys() = %d keys, want %d", len(got), tt.wantCount)
+			}
+		})
+	}
+}
+
+func Test_pgpEncryption_newWriter(t *testing.T) {
+	recipient, _ := generatePgpKey(t, "recipient")
+	signer, _ := generatePgpKey(t, "signer")
+	encryption := &pgpEncryption{recipients: openpgp.EntityList{recipient}, signer: signer}
+	if err := encryption.check(); err != nil {
+		t.Errorf("pgpEncryption.check() error = %v", err)
+		return
+	}
+
+	stages := []outputStage{&compressionFormat{algorithm: compressionGzip, level: 1}, encryption}
+	if got := stagedFileName("export.csv", stages); got != "export.csv.gz.pgp" {
+		t.Errorf("stagedFileName() = %v, want export.csv.gz.pgp", got)
+	}
+
+	buffer := bytes.Buffer{}
+	newRowWriter := func(out io.Writer) rowWriter {
+		return newCsvWriter(out, false, newDefaultCsvFormat(), newDefaultValueFormat(), nil)
+	}
+	rowIterator := &DummyRowIterator{Row: [][]bigquery.Value{{"1", "Joe", "x"}}}
+	if err := createStagedFile(&buffer, "export.csv", stages, newRowWriter, rowIterator); err != nil {
+		t.Errorf("createStagedFile() error = %v", err)
+		return
+	}
+
+	message, err := openpgp.ReadMessage(&buffer, openpgp.EntityList{recipient, signer}, nil, nil)
+	if err != nil {
+		t.Errorf("pgpEncryption wrote an undecryptable content with error %v", err)
+		return
+	}
+	if message.LiteralData.FileName != "export.csv.gz" {
+		t.Errorf("pgpEncryption file name = %v, want export.csv.gz", message.LiteralData.FileName)
+	}
+	reader, err := gzip.NewReader(message.UnverifiedBody)
+	if err != nil {
+		t.Errorf("pgpEncryption encrypted an unreadable content with error %v", err)
+		return
+	}
+	if got, _ := ioutil.ReadAll(reader); string(got) != "1,Joe,x\n" {
+		t.Errorf("pgpEncryption content = %q, want %q", got, "1,Joe,x\n")
+	}
+	if !message.IsSigned || message.SignatureError != nil || message.SignedBy == nil {
+		t.Errorf("pgpEncryption signature isn't valid with error %v", message.SignatureError)
+	}
+}
+
+func Test_parsePgpPrivateKey(t *testing.T) {
+	signer, publicKey := generatePgpKey(t, "signer")
+	buffer := bytes.Buffer{}
+	armored, _ := armor.Encode(&buffer, openpgp.PrivateKeyType, nil)
+	signer.SerializePrivate(armored, nil)
+	armored.Close()
+
+	if _, err := parsePgpPrivateKey(buffer.String(), ""); err != nil {
+		t.Errorf("parsePgpPrivateKey() error = %v", err)
+	}
+	if _, err := parsePgpPrivateKey(publicKey, ""); err == nil {
+		t.Errorf("parsePgpPrivateKey() accepts a public key")
+	}
+}
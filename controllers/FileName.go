@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"bytes"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/*
+File name template used without FILE_NAME_TEMPLATE, the FILE_PREFIX followed by the run time
+*/
+const defaultFileNameTemplate = `{{.Prefix}}{{.RunTime.Format "20060102150405"}}.{{.Extension}}`
+
+/*
+Values of the file name template. The times are in the time zone of the file names, the Year, Month, Day and Hour of the
+run time are zero padded
+*/
+type fileNameData struct {
+	RunTime     time.Time
+	WindowStart time.Time
+	WindowEnd   time.Time
+	Year        string
+	Month       string
+	Day         string
+	Hour        string
+	Sequence    int
+	Partition   string
+	JobName     string
+	Prefix      string
+	Extension   string
+}
+
+/*
+Build the file names, before the compression and encryption suffixes, from a Go template:
+  - template: file name template, the default one reproduces the FILE_PREFIX and run time names
+  - location: time zone of the times in the file names, the local one by default
+  - jobName: name of the job, available in the template
+  - prefix: FILE_PREFIX, available in the template
+*/
+type fileNameFormat struct {
+	template *template.Template
+	location *time.Location
+	jobName  string
+	prefix   string
+}
+
+/*
+Load the file name format from the environment variables. Wrong values are logged and replaced by the default one
+*/
+func newFileNameFormat(configService helpers.IConfigService) *fileNameFormat {
+	format := &fileNameFormat{
+		template: template.Must(template.New(string(models.FILE_NAME_TEMPLATE)).Parse(defaultFileNameTemplate)),
+		location: time.Local,
+		jobName:  configService.GetEnvVar(models.JOB_NAME),
+		prefix:   configService.GetEnvVar(models.FILE_PREFIX),
+	}
+
+	if timezone := configService.GetEnvVar(models.FILE_NAME_TIMEZONE); timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			log.Errorf("Unknown FILE_NAME_TIMEZONE parameter %q. Timezone is set to %s", timezone, format.location)
+		} else {
+			format.location = location
+		}
+	}
+
+	if text := configService.GetEnvVar(models.FILE_NAME_TEMPLATE); text != "" {
+		nameTemplate, err := template.New(string(models.FILE_NAME_TEMPLATE)).Option("missingkey=error").Parse(text)
+		if err == nil {
+			//Check the template with the values of a run
+			_, err = (&fileNameFormat{template: nameTemplate, location: format.location}).fileName(fileNameData{
+				RunTime:   time.Now(),
+				Sequence:  1,
+				Partition: "partition",
+				Extension: "csv",
+			})
+		}
+		if err != nil {
+			log.Errorf("Impossible to use the FILE_NAME_TEMPLATE parameter %q with error %v. The default template is used", text, err)
+		} else {
+			format.template = nameTemplate
+		}
+	}
+	return format
+}
+
+/*
+Render the file name with the values of the file
+*/
+func (this *fileNameFormat) fileName(data fileNameData) (string, error) {
+	buffer := bytes.Buffer{}
+	err := this.template.Execute(&buffer, this.complete(data))
+	if err != nil {
+		return "", err
+	}
+	if buffer.Len() == 0 {
+		return "", errors.New("the file name is empty")
+	}
+	return buffer.String(), nil
+}
+
+/*
+Render the directory of the run with the template part of a FTP_PATH, with a trailing slash. Empty if the FTP_PATH has
+no template
+*/
+func (this *fileNameFormat) directory(directoryTemplate *template.Template, runDate time.Time, window models.QueryWindow) (string, error) {
+	if directoryTemplate == nil {
+		return "", nil
+	}
+	buffer := bytes.Buffer{}
+	err := directoryTemplate.Execute(&buffer, this.complete(fileNameData{
+		RunTime:     runDate,
+		WindowStart: window.Start,
+		WindowEnd:   window.End,
+	}))
+	if err != nil {
+		return "", err
+	}
+	directory := strings.Trim(buffer.String(), "/")
+	if directory == "" {
+		return "", nil
+	}
+	return directory + "/", nil
+}
+
+/*
+Set the job name and the prefix, and convert the times in the time zone of the file names
+*/
+func (this *fileNameFormat) complete(data fileNameData) fileNameData {
+	data.RunTime = data.RunTime.In(this.location)
+	data.WindowStart = data.WindowStart.In(this.location)
+	data.WindowEnd = data.WindowEnd.In(this.location)
+	data.Year = data.RunTime.Format("2006")
+	data.Month = data.RunTime.Format("01")
+	data.Day = data.RunTime.Format("02")
+	data.Hour = data.RunTime.Format("15")
+	data.JobName = this.jobName
+	data.Prefix = this.prefix
+	return data
+}
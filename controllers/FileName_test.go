@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"bqToFtp/models"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func Test_fileNameFormat_fileName(t *testing.T) {
+	paris, _ := time.LoadLocation("Europe/Paris")
+	runTime := time.Date(2019, 6, 2, 1, 30, 0, 0, time.UTC)
+	window := models.QueryWindow{
+		Start: time.Date(2019, 6, 1, 22, 0, 0, 0, time.UTC),
+		End:   time.Date(2019, 6, 1, 23, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		name     string
+		template string
+		location *time.Location
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "Default template",
+			template: defaultFileNameTemplate,
+			location: time.UTC,
+			want:     "export-20190602013000.csv",
+		},
+		{
+			name:     "Partner template in a time zone",
+			template: `{{.JobName}}_{{.Partition}}_{{.WindowStart.Format "20060102T1504"}}-{{.WindowEnd.Format "1504"}}_{{printf "%03d" .Sequence}}.{{.Extension}}`,
+			location: paris,
+			want:     "sales_FR_20190602T0000-0100_002.csv",
+		},
+		{
+			name:     "Empty name",
+			template: `{{if false}}name{{end}}`,
+			location: time.UTC,
+			wantErr:  true,
+		},
+		{
+			name:     "Unknown value",
+			template: `{{.Unknown}}`,
+			location: time.UTC,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format := &fileNameFormat{
+				template: template.Must(template.New("test").Parse(tt.template)),
+				location: tt.location,
+				jobName:  "sales",
+				prefix:   "export-",
+			}
+			got, err := format.fileName(fileNameData{
+				RunTime:     runTime,
+				WindowStart: window.Start,
+				WindowEnd:   window.End,
+				Sequence:    2,
+				Partition:   "FR",
+				Extension:   "csv",
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("fileNameFormat.fileName() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("fileNameFormat.fileName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_fileNameFormat_directory(t *testing.T) {
+	paris, _ := time.LoadLocation("Europe/Paris")
+	runTime := time.Date(2019, 6, 30, 22, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name: "Static path",
+			want: "",
+		},
+		{
+			name:     "Date directories in the time zone",
+			template: `{{.Year}}/{{.Month}}/{{.Day}}`,
+			want:     "2019/07/01/",
+		},
+		{
+			name:     "Job and hour directories",
+			template: `{{.JobName}}/{{.RunTime.Format "2006-01-02"}}/{{.Hour}}/`,
+			want:     "sales/2019-07-01/00/",
+		},
+		{
+			name:     "Unknown value",
+			template: `{{.Unknown}}`,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format := &fileNameFormat{
+				location: paris,
+				jobName:  "sales",
+			}
+			var directoryTemplate *template.Template
+			if tt.template != "" {
+				directoryTemplate = template.Must(template.New("test").Option("missingkey=error").Parse(tt.template))
+			}
+			got, err := format.directory(directoryTemplate, runTime, models.QueryWindow{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("fileNameFormat.directory() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("fileNameFormat.directory() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package controllers
+
+import (
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	alignmentLeft  = "LEFT"
+	alignmentRight = "RIGHT"
+
+	truncationError = "ERROR"
+	truncationLeft  = "LEFT"
+	truncationRight = "RIGHT"
+)
+
+/*
+Line breaks of the values, replaced by spaces for keeping one record per line
+*/
+var fixedWidthLineBreaks = strings.NewReplacer("\r", " ", "\n", " ")
+
+/*
+Layout of the fixed-width records, loaded from a JSON file like
+{"columns": [{"column": "id", "start": 1, "width": 10, "alignment": "RIGHT", "padding": "0", "truncation": "ERROR"}]}
+*/
+type fixedWidthLayout struct {
+	Columns []*fixedWidthColumn `json:"columns"`
+}
+
+/*
+Position of a column in the record:
+  - column: name of the column in the query result
+  - start: position of the first character, starting at 1
+  - width: number of characters
+  - alignment: LEFT (default) or RIGHT
+  - padding: single character which fill the remaining width, space by default
+  - truncation: ERROR (default) to fail when the value is longer than the width, RIGHT to cut the end of the value or
+    LEFT to cut its beginning
+*/
+type fixedWidthColumn struct {
+	Column     string `json:"column"`
+	Start      int    `json:"start"`
+	Width      int    `json:"width"`
+	Alignment  string `json:"alignment"`
+	Padding    string `json:"padding"`
+	Truncation string `json:"truncation"`
+}
+
+/*
+Parse and check the layout. Default values are set on the missing optional ones
+*/
+func parseFixedWidthLayout(content string) (*fixedWidthLayout, error) {
+	layout := &fixedWidthLayout{}
+	if err := json.Unmarshal([]byte(content), layout); err != nil {
+		return nil, fmt.Errorf("invalid fixed-width layout: %v", err)
+	}
+	if len(layout.Columns) == 0 {
+		return nil, fmt.Errorf("invalid fixed-width layout: no column defined")
+	}
+	for _, column := range layout.Columns {
+		if column.Column == "" {
+			return nil, fmt.Errorf("invalid fixed-width layout: a column has no name")
+		}
+		if column.Start < 1 || column.Width < 1 {
+			return nil, fmt.Errorf("invalid fixed-width layout: the column %q must have a start and a width greater than 0", column.Column)
+		}
+		switch column.Alignment = strings.ToUpper(column.Alignment); column.Alignment {
+		case "":
+			column.Alignment = alignmentLeft
+		case alignmentLeft, alignmentRight:
+		default:
+			return nil, fmt.Errorf("invalid fixed-width layout: unknown alignment %q of the column %q", column.Alignment, column.Column)
+		}
+		switch utf8.RuneCountInString(column.Padding) {
+		case 0:
+			column.Padding = " "
+		case 1:
+		default:
+			return nil, fmt.Errorf("invalid fixed-width layout: the padding %q of the column %q must be a single character", column.Padding, column.Column)
+		}
+		switch column.Truncation = strings.ToUpper(column.Truncation); column.Truncation {
+		case "":
+			column.Truncation = truncationError
+		case truncationError, truncationLeft, truncationRight:
+		default:
+			return nil, fmt.Errorf("invalid fixed-width layout: unknown truncation %q of the column %q", column.Truncation, column.Column)
+		}
+	}
+
+	//The columns are written in the position order, without overlap
+	sort.SliceStable(layout.Columns, func(i, j int) bool {
+		return layout.Columns[i].Start < layout.Columns[j].Start
+	})
+	for i := 1; i < len(layout.Columns); i++ {
+		previous := layout.Columns[i-1]
+		if previous.Start+previous.Width > layout.Columns[i].Start {
+			return nil, fmt.Errorf("invalid fixed-width layout: the columns %q and %q overlap", previous.Column, layout.Columns[i].Column)
+		}
+	}
+	return layout, nil
+}
+
+/*
+Write each row as a record of fixed-width columns, at the positions of the layout. The gaps between the columns are
+filled with spaces. The values are formatted as text by the value format, and transliterated if required by the encoding.
+Their line breaks are replaced by spaces
+*/
+type fixedWidthWriter struct {
+	rowWriter
+	writer         io.Writer
+	layout         *fixedWidthLayout
+	valueFormat    *valueFormat
+	encoding       *outputEncoding
+	lineTerminator []byte
+	schema         bigquery.Schema
+	fieldIndexes   []int
+	rowCount       int
+}
+
+func newFixedWidthWriter(writer io.Writer, layout *fixedWidthLayout, valueFormat *valueFormat, encoding *outputEncoding, lineTerminator []byte) *fixedWidthWriter {
+	return &fixedWidthWriter{
+		writer:         writer,
+		layout:         layout,
+		valueFormat:    valueFormat,
+		encoding:       encoding,
+		lineTerminator: lineTerminator,
+	}
+}
+
+/*
+Find the layout columns in the schema. No header is written
+*/
+func (this *fixedWidthWriter) writeHeader(schema bigquery.Schema) error {
+	this.schema = schema
+	this.fieldIndexes = make([]int, len(this.layout.Columns))
+	for i, column := range this.layout.Columns {
+		this.fieldIndexes[i] = -1
+		for j, schemaField := range schema {
+			if schemaField.Name == column.Column {
+				this.fieldIndexes[i] = j
+				break
+			}
+		}
+		if this.fieldIndexes[i] < 0 {
+			return fmt.Errorf("the fixed-width layout column %q isn't in the query result", column.Column)
+		}
+	}
+	return nil
+}
+
+func (this *fixedWidthWriter) writeRow(values []bigquery.Value) error {
+	if len(values) != len(this.schema) {
+		return fmt.Errorf("the record has %d values for %d fields in the schema", len(values), len(this.schema))
+	}
+	this.rowCount++
+	buffer := bytes.Buffer{}
+	position := 1
+	for i, column := range this.layout.Columns {
+		buffer.WriteString(strings.Repeat(" ", column.Start-position))
+		schemaField := this.schema[this.fieldIndexes[i]]
+		text, err := this.valueFormat.format(schemaField, values[this.fieldIndexes[i]])
+		if err != nil {
+			return err
+		}
+		//The transliteration can change the length of the value, before the padding
+		text = fixedWidthLineBreaks.Replace(this.encoding.transliterateText(text))
+		if text, err = column.fit(text); err != nil {
+			return fmt.Errorf("row %d: %v", this.rowCount, err)
+		}
+		buffer.WriteString(text)
+		position = column.Start + column.Width
+	}
+	buffer.Write(this.lineTerminator)
+	_, err := this.writer.Write(buffer.Bytes())
+	return err
+}
+
+func (this *fixedWidthWriter) close() error {
+	return nil
+}
+
+/*
+Pad or truncate the text to the column width
+*/
+func (this *fixedWidthColumn) fit(text string) (string, error) {
+	length := utf8.RuneCountInString(text)
+	if length > this.Width {
+		runes := []rune(text)
+		switch this.Truncation {
+		case truncationRight:
+			return string(runes[:this.Width]), nil
+		case truncationLeft:
+			return string(runes[length-this.Width:]), nil
+		}
+		return "", fmt.Errorf("the value %q of the column %q overflows its width of %d characters", text, this.Column, this.Width)
+	}
+	padding := strings.Repeat(this.Padding, this.Width-length)
+	if this.Alignment == alignmentRight {
+		return padding + text, nil
+	}
+	return text + padding, nil
+}
@@ -0,0 +1,167 @@
+package controllers
+
+import (
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"math/big"
+	"testing"
+)
+
+func Test_parseFixedWidthLayout(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		wantColumns []fixedWidthColumn
+		wantErr     bool
+	}{
+		{
+			name:    "Default values and sorted columns",
+			content: `{"columns":[{"column":"b","start":5,"width":2,"alignment":"right","padding":"0","truncation":"left"},{"column":"a","start":1,"width":4}]}`,
+			wantColumns: []fixedWidthColumn{
+				{Column: "a", Start: 1, Width: 4, Alignment: alignmentLeft, Padding: " ", Truncation: truncationError},
+				{Column: "b", Start: 5, Width: 2, Alignment: alignmentRight, Padding: "0", Truncation: truncationLeft},
+			},
+		},
+		{
+			name:    "Invalid JSON",
+			content: `{"columns":`,
+			wantErr: true,
+		},
+		{
+			name:    "No column",
+			content: `{"columns":[]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Missing width",
+			content: `{"columns":[{"column":"a","start":1}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Unknown alignment",
+			content: `{"columns":[{"column":"a","start":1,"width":1,"alignment":"CENTER"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Multi character padding",
+			content: `{"columns":[{"column":"a","start":1,"width":1,"padding":"ab"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Unknown truncation",
+			content: `{"columns":[{"column":"a","start":1,"width":1,"truncation":"MIDDLE"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Overlapping columns",
+			content: `{"columns":[{"column":"a","start":1,"width":4},{"column":"b","start":4,"width":2}]}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFixedWidthLayout(tt.content)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseFixedWidthLayout() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if len(got.Columns) != len(tt.wantColumns) {
+				t.Errorf("parseFixedWidthLayout() = %d columns, want %d", len(got.Columns), len(tt.wantColumns))
+				return
+			}
+			for i, column := range got.Columns {
+				if *column != tt.wantColumns[i] {
+					t.Errorf("parseFixedWidthLayout() column %d = %v, want %v", i, *column, tt.wantColumns[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_fixedWidthWriter(t *testing.T) {
+	tests := []struct {
+		name        string
+		layout      string
+		rowIterator *DummyRowIterator
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:   "Aligned and padded columns with gaps",
+			layout: `{"columns":[{"column":"Name","start":1,"width":6},{"column":"id","start":7,"width":4,"alignment":"RIGHT","padding":"0"},{"column":"Value","start":13,"width":3}]}`,
+			rowIterator: &DummyRowIterator{
+				Row: [][]bigquery.Value{
+					{"1", "Joe", "x"},
+					{"22", "Zoé", nil},
+				},
+			},
+			want: "Joe   0001  x  \r\n" +
+				"Zoé   0022     \r\n",
+		},
+		{
+			name:   "Truncated values",
+			layout: `{"columns":[{"column":"text","start":1,"width":3,"truncation":"RIGHT"},{"column":"amount","start":4,"width":3,"truncation":"LEFT"}]}`,
+			rowIterator: &DummyRowIterator{
+				Row: [][]bigquery.Value{
+					{"abcdef", big.NewRat(12345, 10)},
+				},
+				Schema: bigquery.Schema{
+					{Name: "text", Type: bigquery.StringFieldType},
+					{Name: "amount", Type: bigquery.NumericFieldType},
+				},
+			},
+			want: "abc4.5\r\n",
+		},
+		{
+			name:   "Line breaks in the values",
+			layout: `{"columns":[{"column":"Name","start":1,"width":12},{"column":"id","start":13,"width":2}]}`,
+			rowIterator: &DummyRowIterator{
+				Row: [][]bigquery.Value{
+					{"1", "Joe\r\nSmith", "x"},
+					{"2", "Jane\nDoe", "y"},
+				},
+			},
+			want: "Joe  Smith  1 \r\n" +
+				"Jane Doe    2 \r\n",
+		},
+		{
+			name:   "Overflow without truncation",
+			layout: `{"columns":[{"column":"Name","start":1,"width":2}]}`,
+			rowIterator: &DummyRowIterator{
+				Row: [][]bigquery.Value{
+					{"1", "Joe", "x"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name:   "Column missing in the query result",
+			layout: `{"columns":[{"column":"unknown","start":1,"width":2}]}`,
+			rowIterator: &DummyRowIterator{
+				Row: [][]bigquery.Value{},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout, err := parseFixedWidthLayout(tt.layout)
+			if err != nil {
+				t.Errorf("parseFixedWidthLayout() error = %v", err)
+				return
+			}
+			buffer := bytes.Buffer{}
+			err = createFile(newFixedWidthWriter(&buffer, layout, newDefaultValueFormat(), nil, []byte("\r\n")), tt.rowIterator)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("fixedWidthWriter error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := buffer.String(); !tt.wantErr && got != tt.want {
+				t.Errorf("fixedWidthWriter = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+)
+
+/*
+Write the rows as JSON objects keyed by the schema field names, in the column order. RECORD fields are written as
+objects and REPEATED fields as arrays.
+With array to false, one object per line is written (JSON Lines). Else, the objects are written in a single JSON array
+*/
+type jsonWriter struct {
+	rowWriter
+	writer   io.Writer
+	array    bool
+	schema   bigquery.Schema
+	rowCount int
+}
+
+func newJsonWriter(writer io.Writer, array bool) *jsonWriter {
+	return &jsonWriter{
+		writer: writer,
+		array:  array,
+	}
+}
+
+func (this *jsonWriter) writeHeader(schema bigquery.Schema) (err error) {
+	this.schema = schema
+	if this.array {
+		_, err = this.writer.Write([]byte("["))
+	}
+	return
+}
+
+func (this *jsonWriter) writeRow(values []bigquery.Value) (err error) {
+	buffer := bytes.Buffer{}
+	if this.array {
+		if this.rowCount > 0 {
+			buffer.WriteByte(',')
+		}
+		buffer.WriteByte('\n')
+	}
+	if err = appendJsonRecord(&buffer, this.schema, values); err != nil {
+		return
+	}
+	if !this.array {
+		buffer.WriteByte('\n')
+	}
+	this.rowCount++
+	_, err = this.writer.Write(buffer.Bytes())
+	return
+}
+
+func (this *jsonWriter) close() (err error) {
+	if !this.array {
+		return
+	}
+	if this.rowCount > 0 {
+		_, err = this.writer.Write([]byte("\n]\n"))
+	} else {
+		_, err = this.writer.Write([]byte("]\n"))
+	}
+	return
+}
+
+/*
+Append the values as a JSON object, with the keys in the schema order
+*/
+func appendJsonRecord(buffer *bytes.Buffer, schema bigquery.Schema, values []bigquery.Value) error {
+	if len(values) != len(schema) {
+		return fmt.Errorf("the record has %d values for %d fields in the schema", len(values), len(schema))
+	}
+	buffer.WriteByte('{')
+	for i, schemaField := range schema {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		key, _ := json.Marshal(schemaField.Name)
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		if err := appendJsonField(buffer, schemaField, values[i]); err != nil {
+			return err
+		}
+	}
+	buffer.WriteByte('}')
+	return nil
+}
+
+func appendJsonField(buffer *bytes.Buffer, schemaField *bigquery.FieldSchema, value bigquery.Value) error {
+	if value == nil {
+		buffer.WriteString("null")
+		return nil
+	}
+	if !schemaField.Repeated {
+		return appendJsonValue(buffer, schemaField, value)
+	}
+	repeated, ok := value.([]bigquery.Value)
+	if !ok {
+		return fmt.Errorf("the REPEATED field %q has a %T value", schemaField.Name, value)
+	}
+	buffer.WriteByte('[')
+	for i, element := range repeated {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		if err := appendJsonValue(buffer, schemaField, element); err != nil {
+			return err
+		}
+	}
+	buffer.WriteByte(']')
+	return nil
+}
+
+/*
+Append a single value. NUMERIC are written as exact JSON numbers, TIMESTAMP in RFC 3339 and DATE, TIME, DATETIME in
+the BigQuery canonical format. Non finite FLOAT, not allowed in JSON, are written as strings
+*/
+func appendJsonValue(buffer *bytes.Buffer, schemaField *bigquery.FieldSchema, value bigquery.Value) error {
+	switch typedValue := value.(type) {
+	case nil:
+		buffer.WriteString("null")
+		return nil
+	case []bigquery.Value:
+		if schemaField.Type != bigquery.RecordFieldType {
+			return fmt.Errorf("the field %q of type %s has a %T value", schemaField.Name, schemaField.Type, value)
+		}
+		return appendJsonRecord(buffer, schemaField.Schema, typedValue)
+	case *big.Rat:
+		buffer.WriteString(formatRat(typedValue, bigquery.NumericScaleDigits))
+		return nil
+	case float64:
+		if math.IsNaN(typedValue) || math.IsInf(typedValue, 0) {
+			value = formatNonFiniteFloat(typedValue)
+		}
+	case time.Time:
+		value = typedValue.UTC().Format(time.RFC3339Nano)
+	case civil.Date:
+		value = typedValue.String()
+	case civil.Time:
+		value = bigquery.CivilTimeString(typedValue)
+	case civil.DateTime:
+		value = bigquery.CivilDateTimeString(typedValue)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	buffer.Write(encoded)
+	return nil
+}
+
+/*
+Format the rational with the scale digits, without the useless trailing zeros
+*/
+func formatRat(rat *big.Rat, scale int) string {
+	formatted := rat.FloatString(scale)
+	if strings.Contains(formatted, ".") {
+		formatted = strings.TrimRight(strings.TrimRight(formatted, "0"), ".")
+	}
+	return formatted
+}
+
+func formatNonFiniteFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "Infinity"
+	case math.IsInf(value, -1):
+		return "-Infinity"
+	}
+	return "NaN"
+}
@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"math"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func createNestedBqRow() *DummyRowIterator {
+	return &DummyRowIterator{
+		Row: [][]bigquery.Value{
+			{
+				int64(1),
+				big.NewRat(3, 2),
+				time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC),
+				civil.Date{Year: 2019, Month: 6, Day: 1},
+				[]bigquery.Value{"a", "b"},
+				[]bigquery.Value{"street", []bigquery.Value{int64(75001), int64(75002)}},
+			},
+			{
+				int64(2),
+				nil,
+				nil,
+				nil,
+				[]bigquery.Value{},
+				nil,
+			},
+		},
+		Schema: bigquery.Schema{
+			{Name: "id", Type: bigquery.IntegerFieldType},
+			{Name: "amount", Type: bigquery.NumericFieldType},
+			{Name: "created", Type: bigquery.TimestampFieldType},
+			{Name: "day", Type: bigquery.DateFieldType},
+			{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+			{Name: "address", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+				{Name: "street", Type: bigquery.StringFieldType},
+				{Name: "zip", Type: bigquery.IntegerFieldType, Repeated: true},
+			}},
+		},
+	}
+}
+
+func Test_jsonWriter(t *testing.T) {
+	tests := []struct {
+		name        string
+		array       bool
+		rowIterator *DummyRowIterator
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:        "JSON Lines with nested fields",
+			array:       false,
+			rowIterator: createNestedBqRow(),
+			want: `{"id":1,"amount":1.5,"created":"2019-06-01T10:00:00Z","day":"2019-06-01","tags":["a","b"],"address":{"street":"street","zip":[75001,75002]}}` + "\n" +
+				`{"id":2,"amount":null,"created":null,"day":null,"tags":[],"address":null}` + "\n",
+		},
+		{
+			name:        "JSON array with nested fields",
+			array:       true,
+			rowIterator: createNestedBqRow(),
+			want: "[\n" +
+				`{"id":1,"amount":1.5,"created":"2019-06-01T10:00:00Z","day":"2019-06-01","tags":["a","b"],"address":{"street":"street","zip":[75001,75002]}}` + ",\n" +
+				`{"id":2,"amount":null,"created":null,"day":null,"tags":[],"address":null}` + "\n]\n",
+		},
+		{
+			name:  "JSON array without row",
+			array: true,
+			rowIterator: &DummyRowIterator{
+				Row: [][]bigquery.Value{},
+			},
+			want: "[]\n",
+		},
+		{
+			name:  "Non finite float and escaped string",
+			array: false,
+			rowIterator: &DummyRowIterator{
+				Row: [][]bigquery.Value{
+					{math.Inf(1), "say \"hi\"\n"},
+				},
+				Schema: bigquery.Schema{
+					{Name: "value", Type: bigquery.FloatFieldType},
+					{Name: "text", Type: bigquery.StringFieldType},
+				},
+			},
+			want: `{"value":"Infinity","text":"say \"hi\"\n"}` + "\n",
+		},
+		{
+			name:  "Record with wrong value",
+			array: false,
+			rowIterator: &DummyRowIterator{
+				Row: [][]bigquery.Value{
+					{[]bigquery.Value{"a"}},
+				},
+				Schema: bigquery.Schema{
+					{Name: "value", Type: bigquery.StringFieldType},
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := bytes.Buffer{}
+			err := createFile(newJsonWriter(&buffer, tt.array), tt.rowIterator)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("jsonWriter error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got := buffer.String(); !tt.wantErr && got != tt.want {
+				t.Errorf("jsonWriter = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
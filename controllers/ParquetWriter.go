@@ -0,0 +1,274 @@
+package controllers
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	pqsource "github.com/xitongsys/parquet-go-source/writer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/types"
+	pqwriter "github.com/xitongsys/parquet-go/writer"
+	"io"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var parquetCompressions = map[string]parquet.CompressionCodec{
+	"UNCOMPRESSED": parquet.CompressionCodec_UNCOMPRESSED,
+	"SNAPPY":       parquet.CompressionCodec_SNAPPY,
+	"GZIP":         parquet.CompressionCodec_GZIP,
+	"ZSTD":         parquet.CompressionCodec_ZSTD,
+}
+
+/*
+Describe how the Parquet file is written:
+  - compression: codec of the pages, SNAPPY by default
+  - rowGroupSize: size in bytes of the row groups, kept in memory before being written. 128MB by default
+*/
+type parquetFormat struct {
+	compression  parquet.CompressionCodec
+	rowGroupSize int64
+}
+
+/*
+Load the Parquet format from the environment variables. Wrong values are logged and replaced by the default one
+*/
+func newParquetFormat(configService helpers.IConfigService) *parquetFormat {
+	format := &parquetFormat{
+		compression:  parquet.CompressionCodec_SNAPPY,
+		rowGroupSize: 128 * 1024 * 1024,
+	}
+
+	if compression := strings.ToUpper(configService.GetEnvVar(models.PARQUET_COMPRESSION)); compression != "" {
+		if codec, ok := parquetCompressions[compression]; ok {
+			format.compression = codec
+		} else {
+			log.Errorf("Unknown PARQUET_COMPRESSION parameter %q. Compression is set to %s", compression, format.compression)
+		}
+	}
+
+	if rowGroupSize := configService.GetEnvVar(models.PARQUET_ROW_GROUP_SIZE); rowGroupSize != "" {
+		size, err := strconv.ParseInt(rowGroupSize, 10, 64)
+		if err != nil || size <= 0 {
+			log.Errorf("Impossible to convert to a positive number of MB the PARQUET_ROW_GROUP_SIZE parameter %q. Row group size is set to 128", rowGroupSize)
+		} else {
+			format.rowGroupSize = size * 1024 * 1024
+		}
+	}
+	return format
+}
+
+/*
+Write the rows in a Parquet file. The Parquet schema is generated from the BigQuery one, as a Go struct built at runtime
+with the parquet tags. NULLABLE fields are OPTIONAL, REPEATED fields are repeated columns and RECORD fields are groups.
+*/
+type parquetWriter struct {
+	rowWriter
+	writer        io.Writer
+	format        *parquetFormat
+	schema        bigquery.Schema
+	rowType       reflect.Type
+	parquetWriter *pqwriter.ParquetWriter
+}
+
+/*
+Minimal number of row groups of a file limited by the SPLIT_MAX_BYTES. The size of the delivered file only grows when a
+row group is written
+*/
+const splitRowGroups = 10
+
+/*
+Format of the files limited in size by the split policy. The row groups are reduced to a part of the maximal size, for
+measuring the delivered file while it's written
+*/
+func (this *parquetFormat) withSplitPolicy(policy *splitPolicy) *parquetFormat {
+	if policy == nil || policy.maxBytes == 0 || this.rowGroupSize <= policy.maxBytes/splitRowGroups {
+		return this
+	}
+	format := *this
+	format.rowGroupSize = policy.maxBytes/splitRowGroups + 1
+	return &format
+}
+
+func newParquetWriter(writer io.Writer, format *parquetFormat) *parquetWriter {
+	return &parquetWriter{
+		writer: writer,
+		format: format,
+	}
+}
+
+func (this *parquetWriter) writeHeader(schema bigquery.Schema) (err error) {
+	this.schema = schema
+	if this.rowType, err = parquetStructOf(schema); err != nil {
+		return
+	}
+	this.parquetWriter, err = pqwriter.NewParquetWriter(pqsource.NewWriterFile(this.writer), reflect.New(this.rowType).Interface(), 1)
+	if err != nil {
+		return
+	}
+	this.parquetWriter.CompressionType = this.format.compression
+	this.parquetWriter.RowGroupSize = this.format.rowGroupSize
+	return
+}
+
+func (this *parquetWriter) writeRow(values []bigquery.Value) error {
+	row, err := parquetRecord(this.rowType, this.schema, values)
+	if err != nil {
+		return err
+	}
+	return this.parquetWriter.Write(row.Interface())
+}
+
+/*
+Flush the last row group and write the footer
+*/
+func (this *parquetWriter) close() error {
+	return this.parquetWriter.WriteStop()
+}
+
+/*
+Build the struct type of a record. Go field names are generated, the column name is in the parquet tag
+*/
+func parquetStructOf(schema bigquery.Schema) (reflect.Type, error) {
+	fields := make([]reflect.StructField, len(schema))
+	for i, schemaField := range schema {
+		fieldType, tag, err := parquetTypeOf(schemaField)
+		if err != nil {
+			return nil, err
+		}
+		repetition := "OPTIONAL"
+		switch {
+		case schemaField.Repeated:
+			fieldType = reflect.SliceOf(fieldType)
+			repetition = "REPEATED"
+		case schemaField.Required:
+			repetition = "REQUIRED"
+		default:
+			fieldType = reflect.PtrTo(fieldType)
+		}
+		fields[i] = reflect.StructField{
+			Name: fmt.Sprintf("Field%d", i),
+			Type: fieldType,
+			Tag:  reflect.StructTag(fmt.Sprintf(`parquet:"name=%s%s, repetitiontype=%s"`, schemaField.Name, tag, repetition)),
+		}
+	}
+	return reflect.StructOf(fields), nil
+}
+
+/*
+Return the Go type of a single value of the field and the type part of the parquet tag.
+DATETIME, without time zone, is written as a string in the BigQuery canonical format
+*/
+func parquetTypeOf(schemaField *bigquery.FieldSchema) (reflect.Type, string, error) {
+	switch schemaField.Type {
+	case bigquery.StringFieldType, bigquery.GeographyFieldType, bigquery.DateTimeFieldType:
+		return reflect.TypeOf(""), ", type=UTF8", nil
+	case bigquery.BytesFieldType:
+		return reflect.TypeOf(""), ", type=BYTE_ARRAY", nil
+	case bigquery.IntegerFieldType:
+		return reflect.TypeOf(int64(0)), ", type=INT64", nil
+	case bigquery.FloatFieldType:
+		return reflect.TypeOf(float64(0)), ", type=DOUBLE", nil
+	case bigquery.NumericFieldType:
+		return reflect.TypeOf(""), fmt.Sprintf(", type=DECIMAL, basetype=BYTE_ARRAY, scale=%d, precision=%d", bigquery.NumericScaleDigits, bigquery.NumericPrecisionDigits), nil
+	case bigquery.BooleanFieldType:
+		return reflect.TypeOf(false), ", type=BOOLEAN", nil
+	case bigquery.TimestampFieldType:
+		return reflect.TypeOf(int64(0)), ", type=TIMESTAMP_MICROS", nil
+	case bigquery.DateFieldType:
+		return reflect.TypeOf(int32(0)), ", type=DATE", nil
+	case bigquery.TimeFieldType:
+		return reflect.TypeOf(int64(0)), ", type=TIME_MICROS", nil
+	case bigquery.RecordFieldType:
+		structType, err := parquetStructOf(schemaField.Schema)
+		return structType, "", err
+	}
+	return nil, "", fmt.Errorf("the type %s of the field %q isn't supported in Parquet", schemaField.Type, schemaField.Name)
+}
+
+/*
+Fill the struct of a record with the values
+*/
+func parquetRecord(structType reflect.Type, schema bigquery.Schema, values []bigquery.Value) (record reflect.Value, err error) {
+	if len(values) != len(schema) {
+		return record, fmt.Errorf("the record has %d values for %d fields in the schema", len(values), len(schema))
+	}
+	record = reflect.New(structType).Elem()
+	for i, schemaField := range schema {
+		if values[i] == nil {
+			continue
+		}
+		field := record.Field(i)
+		switch {
+		case schemaField.Repeated:
+			repeated, ok := values[i].([]bigquery.Value)
+			if !ok {
+				return record, fmt.Errorf("the REPEATED field %q has a %T value", schemaField.Name, values[i])
+			}
+			slice := reflect.MakeSlice(field.Type(), 0, len(repeated))
+			for _, element := range repeated {
+				value, err := parquetValue(field.Type().Elem(), schemaField, element)
+				if err != nil {
+					return record, err
+				}
+				slice = reflect.Append(slice, value)
+			}
+			field.Set(slice)
+		case schemaField.Required:
+			value, err := parquetValue(field.Type(), schemaField, values[i])
+			if err != nil {
+				return record, err
+			}
+			field.Set(value)
+		default:
+			value, err := parquetValue(field.Type().Elem(), schemaField, values[i])
+			if err != nil {
+				return record, err
+			}
+			pointer := reflect.New(field.Type().Elem())
+			pointer.Elem().Set(value)
+			field.Set(pointer)
+		}
+	}
+	return
+}
+
+/*
+Convert a single value in the Go type of the parquet struct
+*/
+func parquetValue(valueType reflect.Type, schemaField *bigquery.FieldSchema, value bigquery.Value) (reflect.Value, error) {
+	var converted interface{}
+	switch typedValue := value.(type) {
+	case []bigquery.Value:
+		if schemaField.Type == bigquery.RecordFieldType {
+			return parquetRecord(valueType, schemaField.Schema, typedValue)
+		}
+	case []byte:
+		converted = string(typedValue)
+	case *big.Rat:
+		//Unscaled value in big-endian two's complement
+		unscaled := new(big.Rat).Mul(typedValue, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(bigquery.NumericScaleDigits), nil)))
+		converted = types.StrIntToBinary(new(big.Int).Quo(unscaled.Num(), unscaled.Denom()).String(), "BigEndian", 0, true)
+	case time.Time:
+		converted = typedValue.UnixNano() / int64(time.Microsecond)
+	case civil.Date:
+		converted = int32(typedValue.In(time.UTC).Unix() / int64(24*time.Hour/time.Second))
+	case civil.Time:
+		converted = (int64(typedValue.Hour)*int64(time.Hour) + int64(typedValue.Minute)*int64(time.Minute) +
+			int64(typedValue.Second)*int64(time.Second) + int64(typedValue.Nanosecond)) / int64(time.Microsecond)
+	case civil.DateTime:
+		converted = bigquery.CivilDateTimeString(typedValue)
+	default:
+		converted = typedValue
+	}
+	if converted == nil || reflect.TypeOf(converted) != valueType {
+		return reflect.Value{}, fmt.Errorf("the field %q of type %s has a %T value", schemaField.Name, schemaField.Type, value)
+	}
+	return reflect.ValueOf(converted), nil
+}
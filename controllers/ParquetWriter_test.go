@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_parquetWriter(t *testing.T) {
+	buf := bytes.Buffer{}
+	format := &parquetFormat{
+		compression:  parquet.CompressionCodec_GZIP,
+		rowGroupSize: 1024,
+	}
+	if err := createFile(newParquetWriter(&buf, format), createNestedBqRow()); err != nil {
+		t.Errorf("parquetWriter error = %v", err)
+		return
+	}
+
+	file, _ := buffer.NewBufferFile(buf.Bytes())
+	parquetReader, err := reader.NewParquetReader(file, nil, 1)
+	if err != nil {
+		t.Errorf("parquetWriter wrote an unreadable file with error %v", err)
+		return
+	}
+	if parquetReader.GetNumRows() != 2 {
+		t.Errorf("parquetWriter wrote %d rows, want 2", parquetReader.GetNumRows())
+	}
+
+	wantSchema := map[string]string{
+		"id":      "INT64",
+		"amount":  "BYTE_ARRAY DECIMAL",
+		"created": "INT64 TIMESTAMP_MICROS",
+		"day":     "INT32 DATE",
+		"tags":    "BYTE_ARRAY UTF8 REPEATED",
+		"street":  "BYTE_ARRAY UTF8",
+		"zip":     "INT64 REPEATED",
+	}
+	//The reader renames the columns with an upper case first letter
+	for _, element := range parquetReader.Footer.Schema {
+		name := strings.ToLower(element.Name)
+		want, ok := wantSchema[name]
+		if !ok {
+			continue
+		}
+		got := element.GetType().String()
+		if element.IsSetConvertedType() {
+			got += " " + element.GetConvertedType().String()
+		}
+		if element.GetRepetitionType() == parquet.FieldRepetitionType_REPEATED {
+			got += " REPEATED"
+		}
+		if got != want {
+			t.Errorf("parquetWriter column %q = %s, want %s", name, got, want)
+		}
+		delete(wantSchema, name)
+	}
+	if len(wantSchema) > 0 {
+		t.Errorf("parquetWriter missing columns %v", wantSchema)
+	}
+
+	rows, err := parquetReader.ReadByNumber(2)
+	if err != nil {
+		t.Errorf("parquetWriter wrote unreadable rows with error %v", err)
+		return
+	}
+	first := reflect.ValueOf(rows[0])
+	if got := first.FieldByName("Id").Elem().Int(); got != 1 {
+		t.Errorf("parquetWriter id = %v, want 1", got)
+	}
+	if got := first.FieldByName("Amount").Elem().String(); got != "\x59\x68\x2f\x00" {
+		t.Errorf("parquetWriter amount = %x, want 59682f00", got)
+	}
+	if got := first.FieldByName("Created").Elem().Int(); got != 1559383200000000 {
+		t.Errorf("parquetWriter created = %v, want 1559383200000000", got)
+	}
+	if got := first.FieldByName("Day").Elem().Int(); got != 18048 {
+		t.Errorf("parquetWriter day = %v, want 18048", got)
+	}
+	if got := first.FieldByName("Tags").Len(); got != 2 {
+		t.Errorf("parquetWriter tags length = %v, want 2", got)
+	}
+	if got := first.FieldByName("Address").Elem().FieldByName("Zip").Len(); got != 2 {
+		t.Errorf("parquetWriter zip length = %v, want 2", got)
+	}
+	second := reflect.ValueOf(rows[1])
+	if !second.FieldByName("Amount").IsNil() || !second.FieldByName("Address").IsNil() {
+		t.Errorf("parquetWriter null values aren't written as null")
+	}
+}
+
+func Test_parquetStructOf(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  bigquery.Schema
+		wantTag string
+		wantErr bool
+	}{
+		{
+			name:    "Nullable field",
+			schema:  bigquery.Schema{{Name: "id", Type: bigquery.IntegerFieldType}},
+			wantTag: `parquet:"name=id, type=INT64, repetitiontype=OPTIONAL"`,
+		},
+		{
+			name:    "Required field",
+			schema:  bigquery.Schema{{Name: "ok", Type: bigquery.BooleanFieldType, Required: true}},
+			wantTag: `parquet:"name=ok, type=BOOLEAN, repetitiontype=REQUIRED"`,
+		},
+		{
+			name:    "Repeated field",
+			schema:  bigquery.Schema{{Name: "values", Type: bigquery.FloatFieldType, Repeated: true}},
+			wantTag: `parquet:"name=values, type=DOUBLE, repetitiontype=REPEATED"`,
+		},
+		{
+			name:    "Unknown type",
+			schema:  bigquery.Schema{{Name: "unknown", Type: "UNKNOWN"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parquetStructOf(tt.schema)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parquetStructOf() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && string(got.Field(0).Tag) != tt.wantTag {
+				t.Errorf("parquetStructOf() tag = %v, want %v", got.Field(0).Tag, tt.wantTag)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package controllers
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"cloud.google.com/go/bigquery"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const nullPartition = "NULL"
+
+const defaultMaxOpenPartitions = 20
+
+/*
+Characters replaced in the partition values, which are used in the file names and the directories
+*/
+var partitionUnsafeChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+/*
+Route the rows in separate files by the value of a column:
+  - column: name of the partition column in the query result
+  - directory: true to deliver the files of each partition in a sub-directory named by the value
+  - dropColumn: true to remove the partition column from the files
+  - sorted: true if the rows are sorted by the partition column. The files of a partition are delivered when the next
+    partition starts
+  - maxOpen: number of partitions with open files at the same time, each one holds one spool file, and one upload per
+    destination. No limit if 0
+*/
+type partitionFormat struct {
+	column     string
+	directory  bool
+	dropColumn bool
+	sorted     bool
+	maxOpen    int
+}
+
+/*
+Load the partition format from the environment variables. Wrong values are logged and replaced by the default one.
+Return nil if the rows aren't partitioned
+*/
+func newPartitionFormat(configService helpers.IConfigService) *partitionFormat {
+	column := configService.GetEnvVar(models.PARTITION_COLUMN)
+	if column == "" {
+		return nil
+	}
+	format := &partitionFormat{
+		column:  column,
+		maxOpen: defaultMaxOpenPartitions,
+	}
+
+	if directory := configService.GetEnvVar(models.PARTITION_DIRECTORY); directory != "" {
+		var err error
+		if format.directory, err = strconv.ParseBool(directory); err != nil {
+			log.Errorf("Impossible to convert to Boolean the PARTITION_DIRECTORY parameter %q. Partition directory is set to FALSE", directory)
+		}
+	}
+
+	if dropColumn := configService.GetEnvVar(models.PARTITION_DROP_COLUMN); dropColumn != "" {
+		var err error
+		if format.dropColumn, err = strconv.ParseBool(dropColumn); err != nil {
+			log.Errorf("Impossible to convert to Boolean the PARTITION_DROP_COLUMN parameter %q. Partition column is kept", dropColumn)
+		}
+	}
+
+	if sorted := configService.GetEnvVar(models.PARTITION_SORTED); sorted != "" {
+		var err error
+		if format.sorted, err = strconv.ParseBool(sorted); err != nil {
+			log.Errorf("Impossible to convert to Boolean the PARTITION_SORTED parameter %q. Partition sorted is set to FALSE", sorted)
+		}
+	}
+
+	if maxOpen := configService.GetEnvVar(models.PARTITION_MAX_OPEN); maxOpen != "" {
+		value, err := strconv.Atoi(maxOpen)
+		if err != nil || value < 0 {
+			log.Errorf("Impossible to convert to positive Integer the PARTITION_MAX_OPEN parameter %q. Open partitions are limited to %d", maxOpen, format.maxOpen)
+		} else {
+			format.maxOpen = value
+		}
+	}
+	return format
+}
+
+/*
+Row writer which routes the rows to the files of their partition. Without sorted rows, the files of each partition are
+open until the end of the rows, up to the maximum of open partitions. Without partition, all the rows go to a single
+set of files, even if there is no row.
+Two values with the same name in the files, like a/b and a_b, are an error
+*/
+type partitionWriter struct {
+	controller   *bqToFtpController
+	newRowWriter rowWriterFactory
+	runDate      time.Time
+	window       models.QueryWindow
+	format       *partitionFormat
+	directories  []string
+	columnIndex  int
+	column       *bigquery.FieldSchema
+	schema       bigquery.Schema
+	values       []bigquery.Value
+	partitions   map[string]*splitWriter
+	sources      map[string]string
+	writers      []*splitWriter
+	open         []*splitWriter
+}
+
+func (controller *bqToFtpController) newPartitionWriter(newRowWriter rowWriterFactory, runDate time.Time, window models.QueryWindow) *partitionWriter {
+	return &partitionWriter{
+		controller:   controller,
+		newRowWriter: newRowWriter,
+		runDate:      runDate,
+		window:       window,
+		format:       controller.partitionFormat,
+		partitions:   make(map[string]*splitWriter),
+		sources:      make(map[string]string),
+	}
+}
+
+func (this *partitionWriter) writeHeader(schema bigquery.Schema) (err error) {
+	//The directory of the FTP_PATH template is the same for all the files of the run
+	if this.directories, err = this.controller.runDirectories(this.runDate, this.window); err != nil {
+		return
+	}
+	if this.format == nil {
+		this.schema = schema
+		return this.addPartition("", "")
+	}
+
+	this.columnIndex = -1
+	for i, field := range schema {
+		if field.Name == this.format.column {
+			this.columnIndex = i
+			this.column = field
+		}
+	}
+	if this.columnIndex < 0 {
+		return fmt.Errorf("the partition column %q isn't in the query result", this.format.column)
+	}
+	if this.format.dropColumn {
+		this.schema = append(append(bigquery.Schema{}, schema[:this.columnIndex]...), schema[this.columnIndex+1:]...)
+	} else {
+		this.schema = schema
+	}
+	return nil
+}
+
+func (this *partitionWriter) writeRow(values []bigquery.Value) error {
+	if this.format == nil {
+		return this.writers[0].writeRow(values)
+	}
+
+	partition, source, err := this.partitionValue(values[this.columnIndex])
+	if err != nil {
+		return err
+	}
+	if other, ok := this.sources[partition]; ok && other != source {
+		return fmt.Errorf("the partition values %q and %q have the same name %q in the files", other, source, partition)
+	}
+	writer, ok := this.partitions[partition]
+	if ok && this.format.sorted && (len(this.open) == 0 || writer != this.open[0]) {
+		return fmt.Errorf("the rows aren't sorted by the partition column %q, the partition %q is already delivered", this.format.column, partition)
+	}
+	if !ok {
+		if err = this.closeSortedPartition(); err != nil {
+			return err
+		}
+		if this.format.maxOpen > 0 && len(this.open) >= this.format.maxOpen {
+			return fmt.Errorf("the partition %q exceeds the %d open partitions of PARTITION_MAX_OPEN. Sort the rows by the partition column and set PARTITION_SORTED", partition, this.format.maxOpen)
+		}
+		this.sources[partition] = source
+		directory := ""
+		if this.format.directory {
+			directory = partition + "/"
+		}
+		if err = this.addPartition(partition, directory); err != nil {
+			return err
+		}
+		writer = this.partitions[partition]
+	}
+
+	if this.format.dropColumn {
+		this.values = append(append(this.values[:0], values[:this.columnIndex]...), values[this.columnIndex+1:]...)
+		return writer.writeRow(this.values)
+	}
+	return writer.writeRow(values)
+}
+
+func (this *partitionWriter) close() (err error) {
+	for _, writer := range this.open {
+		if err == nil {
+			err = writer.close()
+		} else {
+			writer.abort(err)
+		}
+	}
+	this.open = nil
+	return
+}
+
+/*
+Deliver the files of the previous partition when the rows are sorted
+*/
+func (this *partitionWriter) closeSortedPartition() error {
+	if !this.format.sorted || len(this.open) == 0 {
+		return nil
+	}
+	writer := this.open[0]
+	this.open = nil
+	return writer.close()
+}
+
+/*
+Stop the delivery of the current files after a production error. The files already delivered are kept
+*/
+func (this *partitionWriter) abort(productionErr error) {
+	for _, writer := range this.open {
+		writer.abort(productionErr)
+	}
+	this.open = nil
+}
+
+/*
+Deliver the manifest of each partition, after all the files
+*/
+func (this *partitionWriter) deliverManifests() error {
+	for _, writer := range this.writers {
+		runName, err := writer.runName()
+		if err != nil {
+			return err
+		}
+		if err = this.controller.deliverManifest(runName, writer.parts, this.controller.splitPolicy != nil, this.window); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Result of the run for each destination, over the files of all the partitions
+*/
+func (this *partitionWriter) deliveryReports() []destinationReport {
+	var parts []*filePart
+	for _, writer := range this.writers {
+		parts = append(parts, writer.parts...)
+	}
+	return this.controller.deliveryReports(parts)
+}
+
+func (this *partitionWriter) addPartition(partition string, directory string) error {
+	writer := this.controller.newSplitWriter(this.newRowWriter, this.runDate, this.window, this.directories, partition, directory)
+	this.partitions[partition] = writer
+	this.writers = append(this.writers, writer)
+	this.open = append(this.open, writer)
+	return writer.writeHeader(this.schema)
+}
+
+/*
+Format the partition value like in the text files. The characters other than letters, digits, dot, dash and underscore
+are replaced by an underscore in the partition name. NULL if the value is null or empty.
+The source is the formatted value, empty for the null value, for detecting the values with the same name
+*/
+func (this *partitionWriter) partitionValue(value bigquery.Value) (partition string, source string, err error) {
+	if value == nil {
+		return nullPartition, "", nil
+	}
+	if source, err = this.controller.valueFormat.formatValue(this.column, value); err != nil {
+		return
+	}
+	if source == "" || source == "." || source == ".." {
+		return nullPartition, source, nil
+	}
+	return partitionUnsafeChars.ReplaceAllString(source, "_"), source, nil
+}
@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"bqToFtp/mocks"
+	"bqToFtp/models"
+	"cloud.google.com/go/bigquery"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func Test_partitionWriter(t *testing.T) {
+	rows := [][]bigquery.Value{{"1", "FR", "x"}, {"2", "US", "y"}, {"3", "FR", "z"}, {"4", nil, "n"}, {"5", "a/b", "s"}}
+	tests := []struct {
+		name         string
+		format       *partitionFormat
+		rows         [][]bigquery.Value
+		nameTemplate string
+		pathTemplate string
+		want         map[string]string
+		wantErr      bool
+	}{
+		{
+			name:         "No partition",
+			nameTemplate: `export.{{.Extension}}`,
+			want: map[string]string{
+				"export.csv": "id,Name,Value\n1,FR,x\n2,US,y\n3,FR,z\n4,,n\n5,a/b,s\n",
+			},
+		},
+		{
+			name:         "Partition suffix and dropped column",
+			format:       &partitionFormat{column: "Name", dropColumn: true},
+			nameTemplate: `export.{{.Extension}}`,
+			want: map[string]string{
+				"export-FR.csv":   "id,Value\n1,x\n3,z\n",
+				"export-US.csv":   "id,Value\n2,y\n",
+				"export-NULL.csv": "id,Value\n4,n\n",
+				"export-a_b.csv":  "id,Value\n5,s\n",
+			},
+		},
+		{
+			name:         "Partition directory and value in the template",
+			format:       &partitionFormat{column: "Name", directory: true},
+			nameTemplate: `export_{{.Partition}}.{{.Extension}}`,
+			want: map[string]string{
+				"FR/export_FR.csv":     "id,Name,Value\n1,FR,x\n3,FR,z\n",
+				"US/export_US.csv":     "id,Name,Value\n2,US,y\n",
+				"NULL/export_NULL.csv": "id,Name,Value\n4,,n\n",
+				"a_b/export_a_b.csv":   "id,Name,Value\n5,a/b,s\n",
+			},
+		},
+		{
+			name:         "Run directory and partition directory",
+			format:       &partitionFormat{column: "Name", directory: true},
+			nameTemplate: `export.{{.Extension}}`,
+			pathTemplate: `{{.Year}}/{{.Month}}`,
+			want: map[string]string{
+				"2019/06/FR/export.csv":   "id,Name,Value\n1,FR,x\n3,FR,z\n",
+				"2019/06/US/export.csv":   "id,Name,Value\n2,US,y\n",
+				"2019/06/NULL/export.csv": "id,Name,Value\n4,,n\n",
+				"2019/06/a_b/export.csv":  "id,Name,Value\n5,a/b,s\n",
+			},
+		},
+		{
+			name:         "Sorted partitions",
+			format:       &partitionFormat{column: "Name", sorted: true, maxOpen: 1},
+			rows:         [][]bigquery.Value{{"1", "FR", "x"}, {"3", "FR", "z"}, {"2", "US", "y"}},
+			nameTemplate: `export.{{.Extension}}`,
+			want: map[string]string{
+				"export-FR.csv": "id,Name,Value\n1,FR,x\n3,FR,z\n",
+				"export-US.csv": "id,Name,Value\n2,US,y\n",
+			},
+		},
+		{
+			name:         "Unsorted rows",
+			format:       &partitionFormat{column: "Name", sorted: true},
+			nameTemplate: `export.{{.Extension}}`,
+			want: map[string]string{
+				"export-FR.csv": "id,Name,Value\n1,FR,x\n",
+			},
+			wantErr: true,
+		},
+		{
+			name:         "Too many open partitions",
+			format:       &partitionFormat{column: "Name", maxOpen: 2},
+			nameTemplate: `export.{{.Extension}}`,
+			want:         map[string]string{},
+			wantErr:      true,
+		},
+		{
+			name:         "Values with the same name",
+			format:       &partitionFormat{column: "Name"},
+			rows:         [][]bigquery.Value{{"1", "a/b", "x"}, {"2", "a_b", "y"}},
+			nameTemplate: `export.{{.Extension}}`,
+			want:         map[string]string{},
+			wantErr:      true,
+		},
+		{
+			name:         "NULL value and null",
+			format:       &partitionFormat{column: "Name"},
+			rows:         [][]bigquery.Value{{"1", nil, "x"}, {"2", "", "y"}, {"3", "NULL", "z"}},
+			nameTemplate: `export.{{.Extension}}`,
+			want:         map[string]string{},
+			wantErr:      true,
+		},
+		{
+			name:         "Unknown partition column",
+			format:       &partitionFormat{column: "country"},
+			nameTemplate: `export.{{.Extension}}`,
+			want:         map[string]string{},
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lock := sync.Mutex{}
+			got := make(map[string]string)
+			mockFtp := &mocks.IFTPService{}
+			mockFtp.On("Send", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				content, err := ioutil.ReadAll(args.Get(1).(io.Reader))
+				if err != nil {
+					//Aborted file
+					return
+				}
+				lock.Lock()
+				got[args.String(0)] = string(content)
+				lock.Unlock()
+			}).Return(nil)
+			controller := &bqToFtpController{
+				destinations:      singleDestination(mockFtp),
+				outputFormat:      outputFormatCsv,
+				valueFormat:       newDefaultValueFormat(),
+				compressionFormat: &compressionFormat{algorithm: compressionNone},
+				partitionFormat:   tt.format,
+				fileNameFormat: &fileNameFormat{
+					template: template.Must(template.New("test").Parse(tt.nameTemplate)),
+					location: time.UTC,
+				},
+			}
+			if tt.pathTemplate != "" {
+				controller.destinations[0].directoryTemplate = template.Must(template.New("path").Parse(tt.pathTemplate))
+			}
+			newRowWriter := func(out io.Writer) rowWriter {
+				return newCsvWriter(out, true, newDefaultCsvFormat(), newDefaultValueFormat(), nil)
+			}
+			output := controller.newPartitionWriter(newRowWriter, time.Date(2019, 6, 2, 1, 30, 0, 0, time.UTC), models.QueryWindow{})
+			iteratorRows := rows
+			if tt.rows != nil {
+				iteratorRows = tt.rows
+			}
+			err := createFile(output, &DummyRowIterator{Row: append([][]bigquery.Value{}, iteratorRows...)})
+			if err != nil {
+				output.abort(err)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("createFile() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("partitionWriter delivered %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package controllers
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"text/template"
+	"time"
+)
+
+/*
+Values of the header record template
+*/
+type headerRecordData struct {
+	FileName    string
+	RunDate     time.Time
+	WindowStart time.Time
+	WindowEnd   time.Time
+}
+
+/*
+Values of the trailer record template. The row count is only known at the end of the file
+*/
+type trailerRecordData struct {
+	headerRecordData
+	RowCount int
+}
+
+/*
+Header and trailer records written around the rows of the text formats, CSV and FIXED, in the Go template format.
+Each record is followed by the line terminator
+*/
+type recordTemplates struct {
+	header         *template.Template
+	trailer        *template.Template
+	lineTerminator []byte
+}
+
+/*
+Load the record templates from the environment variables. Wrong templates are logged and not written.
+Return nil if no template is defined
+*/
+func newRecordTemplates(configService helpers.IConfigService, outputFormat string, lineTerminator []byte) *recordTemplates {
+	templates := &recordTemplates{
+		lineTerminator: lineTerminator,
+	}
+	templates.header = parseRecordTemplate(models.HEADER_TEMPLATE, configService.GetEnvVar(models.HEADER_TEMPLATE), headerRecordData{})
+	templates.trailer = parseRecordTemplate(models.TRAILER_TEMPLATE, configService.GetEnvVar(models.TRAILER_TEMPLATE), trailerRecordData{})
+	if templates.header == nil && templates.trailer == nil {
+		return nil
+	}
+	if outputFormat != outputFormatCsv && outputFormat != outputFormatFixed {
+		log.Errorf("The HEADER_TEMPLATE and TRAILER_TEMPLATE parameters are only supported by the CSV and FIXED formats. They are ignored in %s", outputFormat)
+		return nil
+	}
+	return templates
+}
+
+/*
+Parse the template and check it with empty values. nil if the template is empty or wrong
+*/
+func parseRecordTemplate(name helpers.EnvVarEnum, text string, data interface{}) *template.Template {
+	if text == "" {
+		return nil
+	}
+	recordTemplate, err := template.New(string(name)).Option("missingkey=error").Parse(text)
+	if err == nil {
+		err = recordTemplate.Execute(ioutil.Discard, data)
+	}
+	if err != nil {
+		log.Errorf("Impossible to parse the %s parameter %q with error %v. The record isn't written", name, text, err)
+		return nil
+	}
+	return recordTemplate
+}
+
+/*
+Wrap the row writers of the factory for writing the header and trailer records with the data
+*/
+func (this *recordTemplates) wrap(newRowWriter rowWriterFactory, data headerRecordData) rowWriterFactory {
+	if this == nil {
+		return newRowWriter
+	}
+	return func(out io.Writer) rowWriter {
+		return &recordTemplateWriter{
+			rowWriter: newRowWriter(out),
+			out:       out,
+			templates: this,
+			data:      trailerRecordData{headerRecordData: data},
+		}
+	}
+}
+
+/*
+Row writer which writes the header record before the rows, and the trailer record after them
+*/
+type recordTemplateWriter struct {
+	rowWriter
+	out       io.Writer
+	templates *recordTemplates
+	data      trailerRecordData
+}
+
+func (this *recordTemplateWriter) writeHeader(schema bigquery.Schema) error {
+	if err := this.writeRecord(this.templates.header, this.data.headerRecordData); err != nil {
+		return err
+	}
+	return this.rowWriter.writeHeader(schema)
+}
+
+func (this *recordTemplateWriter) writeRow(values []bigquery.Value) error {
+	this.data.RowCount++
+	return this.rowWriter.writeRow(values)
+}
+
+func (this *recordTemplateWriter) close() error {
+	if err := this.writeRecord(this.templates.trailer, this.data); err != nil {
+		return err
+	}
+	return this.rowWriter.close()
+}
+
+func (this *recordTemplateWriter) writeRecord(recordTemplate *template.Template, data interface{}) error {
+	if recordTemplate == nil {
+		return nil
+	}
+	buffer := bytes.Buffer{}
+	if err := recordTemplate.Execute(&buffer, data); err != nil {
+		return err
+	}
+	buffer.Write(this.templates.lineTerminator)
+	_, err := this.out.Write(buffer.Bytes())
+	return err
+}
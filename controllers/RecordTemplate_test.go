@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"bqToFtp/models"
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"io"
+	"testing"
+	"time"
+)
+
+func Test_parseRecordTemplate(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		data interface{}
+		want bool
+	}{
+		{
+			name: "No template",
+			data: headerRecordData{},
+		},
+		{
+			name: "Header",
+			text: `HDR{{.RunDate.Format "20060102"}}{{.FileName}}`,
+			data: headerRecordData{},
+			want: true,
+		},
+		{
+			name: "Row count unknown in the header",
+			text: "HDR{{.RowCount}}",
+			data: headerRecordData{},
+		},
+		{
+			name: "Row count in the trailer",
+			text: "TRL{{.RowCount}}{{.WindowEnd}}",
+			data: trailerRecordData{},
+			want: true,
+		},
+		{
+			name: "Wrong template",
+			text: "TRL{{.RowCount",
+			data: trailerRecordData{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRecordTemplate(models.TRAILER_TEMPLATE, tt.text, tt.data); (got != nil) != tt.want {
+				t.Errorf("parseRecordTemplate() = %v, want a template %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_recordTemplates_wrap(t *testing.T) {
+	templates := &recordTemplates{
+		header:         parseRecordTemplate(models.HEADER_TEMPLATE, `HDR;{{.FileName}};{{.RunDate.Format "20060102"}};{{.WindowStart.Format "15:04"}};{{.WindowEnd.Format "15:04"}}`, headerRecordData{}),
+		trailer:        parseRecordTemplate(models.TRAILER_TEMPLATE, `TRL;{{printf "%06d" .RowCount}}`, trailerRecordData{}),
+		lineTerminator: []byte("\r\n"),
+	}
+	data := headerRecordData{
+		FileName:    "export.csv.gz",
+		RunDate:     time.Date(2019, 6, 2, 1, 0, 0, 0, time.UTC),
+		WindowStart: time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC),
+		WindowEnd:   time.Date(2019, 6, 1, 11, 0, 0, 0, time.UTC),
+	}
+	newRowWriter := templates.wrap(func(out io.Writer) rowWriter {
+		return newCsvWriter(out, true, newDefaultCsvFormat(), newDefaultValueFormat(), nil)
+	}, data)
+
+	tests := []struct {
+		name string
+		rows [][]bigquery.Value
+		want string
+	}{
+		{
+			name: "Rows",
+			rows: [][]bigquery.Value{{"1", "Joe", "x"}, {"2", "Jane", "y"}},
+			want: "HDR;export.csv.gz;20190602;10:00;11:00\r\nid,Name,Value\n1,Joe,x\n2,Jane,y\nTRL;000002\r\n",
+		},
+		{
+			name: "No row",
+			want: "HDR;export.csv.gz;20190602;10:00;11:00\r\nid,Name,Value\nTRL;000000\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := bytes.Buffer{}
+			rowIterator := &DummyRowIterator{Row: tt.rows}
+			if err := createFile(newRowWriter(&buffer), rowIterator); err != nil {
+				t.Errorf("createFile() error = %v", err)
+				return
+			}
+			if got := buffer.String(); got != tt.want {
+				t.Errorf("createFile() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"cloud.google.com/go/bigquery"
+	"io"
+)
+
+const (
+	outputFormatCsv       = "CSV"
+	outputFormatJsonLines = "JSONL"
+	outputFormatJson      = "JSON"
+	outputFormatParquet   = "PARQUET"
+	outputFormatAvro      = "AVRO"
+	outputFormatXlsx      = "XLSX"
+	outputFormatFixed     = "FIXED"
+)
+
+var fileExtensions = map[string]string{
+	outputFormatCsv:       "csv",
+	outputFormatJsonLines: "jsonl",
+	outputFormatJson:      "json",
+	outputFormatParquet:   "parquet",
+	outputFormatAvro:      "avro",
+	outputFormatXlsx:      "xlsx",
+	outputFormatFixed:     "txt",
+}
+
+/*
+Write the rows of the query result in an output format. The header is written when the schema is known, after the
+first read of the iterator, even if there is no row. Close ends the file content without closing the underlying writer
+*/
+type rowWriter interface {
+	writeHeader(schema bigquery.Schema) error
+	writeRow(values []bigquery.Value) error
+	close() error
+}
+
+/*
+Create a row writer on the output
+*/
+type rowWriterFactory func(out io.Writer) rowWriter
+
+/*
+Prepare the creation of the row writers of the output format. The configuration which can change between two
+invocations, like the fixed-width layout, is loaded here to fail before any upload
+*/
+func (controller *bqToFtpController) newRowWriterFactory() (rowWriterFactory, error) {
+	switch controller.outputFormat {
+	case outputFormatJsonLines:
+		return func(out io.Writer) rowWriter { return newJsonWriter(out, false) }, nil
+	case outputFormatJson:
+		return func(out io.Writer) rowWriter { return newJsonWriter(out, true) }, nil
+	case outputFormatParquet:
+		format := controller.parquetFormat.withSplitPolicy(controller.splitPolicy)
+		return func(out io.Writer) rowWriter { return newParquetWriter(out, format) }, nil
+	case outputFormatAvro:
+		return func(out io.Writer) rowWriter { return newAvroWriter(out, controller.avroFormat) }, nil
+	case outputFormatXlsx:
+		return func(out io.Writer) rowWriter { return newXlsxWriter(out, controller.xlsxFormat) }, nil
+	case outputFormatFixed:
+		content, err := controller.storageService.GetLayout()
+		if err != nil {
+			return nil, err
+		}
+		layout, err := parseFixedWidthLayout(content)
+		if err != nil {
+			return nil, err
+		}
+		return func(out io.Writer) rowWriter {
+			return newFixedWidthWriter(out, layout, controller.valueFormat, controller.outputEncoding, controller.csvFormat.lineTerminator)
+		}, nil
+	default:
+		return func(out io.Writer) rowWriter {
+			return newCsvWriter(out, controller.withHeader, controller.csvFormat, controller.valueFormat, controller.outputEncoding)
+		}, nil
+	}
+}
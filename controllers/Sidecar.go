@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	checksumNone   = "NONE"
+	checksumMd5    = "MD5"
+	checksumSha256 = "SHA256"
+
+	manifestSuffix = ".manifest.json"
+)
+
+/*
+Describe the sidecar files delivered after the data file, which signal its completion:
+  - checksum: NONE (default), MD5 or SHA256. The checksum file is named like the data file with the .md5 or .sha256
+    suffix, in the md5sum/sha256sum format
+  - manifest: true to deliver a JSON manifest of the run, with the .manifest.json suffix, after all the files
+  - markerSuffix: suffix of the empty marker file, like .ok or .done, delivered after the checksum file. No marker if
+    empty
+*/
+type sidecarFormat struct {
+	checksum     string
+	manifest     bool
+	markerSuffix string
+}
+
+/*
+Load the sidecar format from the environment variables. Wrong values are logged and replaced by the default one
+*/
+func newSidecarFormat(configService helpers.IConfigService) *sidecarFormat {
+	format := &sidecarFormat{
+		checksum: checksumNone,
+	}
+
+	switch checksum := strings.ToUpper(configService.GetEnvVar(models.CHECKSUM)); checksum {
+	case "":
+	case checksumNone, checksumMd5, checksumSha256:
+		format.checksum = checksum
+	default:
+		log.Errorf("Unknown CHECKSUM parameter %q. Checksum is set to %s", checksum, format.checksum)
+	}
+
+	if manifest := configService.GetEnvVar(models.MANIFEST); manifest != "" {
+		var err error
+		if format.manifest, err = strconv.ParseBool(manifest); err != nil {
+			log.Errorf("Impossible to convert to Boolean the MANIFEST parameter %q. Manifest is set to FALSE", manifest)
+		}
+	}
+
+	format.markerSuffix = configService.GetEnvVar(models.MARKER_SUFFIX)
+	return format
+}
+
+/*
+Algorithm of the checksum written in the sidecar files. SHA256 for the manifest without checksum file
+*/
+func (this *sidecarFormat) checksumAlgorithm() string {
+	if this.checksum == checksumNone && this.manifest {
+		return checksumSha256
+	}
+	return this.checksum
+}
+
+/*
+Create the hash of the checksum algorithm. nil if no sidecar requires a checksum
+*/
+func (this *sidecarFormat) newHash() hash.Hash {
+	if this == nil {
+		return nil
+	}
+	switch this.checksumAlgorithm() {
+	case checksumMd5:
+		return md5.New()
+	case checksumSha256:
+		return sha256.New()
+	}
+	return nil
+}
+
+/*
+Content of the manifest file. When the files are split, the file name and the checksum are empty, the size and the row
+count are the totals of the parts
+*/
+type fileManifest struct {
+	FileName          string         `json:"fileName,omitempty"`
+	Size              int64          `json:"size"`
+	RowCount          int            `json:"rowCount"`
+	ChecksumAlgorithm string         `json:"checksumAlgorithm"`
+	Checksum          string         `json:"checksum,omitempty"`
+	Parts             []manifestPart `json:"parts,omitempty"`
+	WindowStart       time.Time      `json:"windowStart"`
+	WindowEnd         time.Time      `json:"windowEnd"`
+	GeneratedAt       time.Time      `json:"generatedAt"`
+}
+
+/*
+File of the split files, in the manifest
+*/
+type manifestPart struct {
+	FileName string `json:"fileName"`
+	Size     int64  `json:"size"`
+	RowCount int    `json:"rowCount"`
+	Checksum string `json:"checksum"`
+}
+
+/*
+Deliver the sidecar files of the delivered data file, at the same place for each destination: on the destination or in
+the fallback bucket. The marker file is delivered last
+*/
+func (controller *bqToFtpController) deliverSidecars(file *streamedFile) error {
+	format := controller.sidecarFormat
+	if format == nil {
+		return nil
+	}
+
+	if format.checksum != checksumNone {
+		//The checksum file is next to the data file
+		content := fmt.Sprintf("%s  %s\n", hex.EncodeToString(file.checksum.Sum(nil)), path.Base(file.name))
+		if err := controller.deliverSidecar(file.name+"."+strings.ToLower(format.checksum), []byte(content), file.uploads); err != nil {
+			return err
+		}
+	}
+
+	if format.markerSuffix != "" {
+		return controller.deliverSidecar(file.name+format.markerSuffix, nil, file.uploads)
+	}
+	return nil
+}
+
+/*
+Deliver the manifest of the run after all its files. name is the name of the run, the manifest lists the parts when
+the files are split. For each destination, the manifest goes to the fallback bucket if a file is there, and isn't
+delivered if a file is missing
+*/
+func (controller *bqToFtpController) deliverManifest(name string, parts []*filePart, split bool, window models.QueryWindow) error {
+	format := controller.sidecarFormat
+	if format == nil || !format.manifest {
+		return nil
+	}
+	manifest := fileManifest{
+		ChecksumAlgorithm: format.checksumAlgorithm(),
+		WindowStart:       window.Start,
+		WindowEnd:         window.End,
+		GeneratedAt:       time.Now(),
+	}
+	var uploads []*destinationUpload
+	for _, part := range parts {
+		checksum := hex.EncodeToString(part.file.checksum.Sum(nil))
+		manifest.Size += part.file.size
+		manifest.RowCount += part.rowCount
+		if split {
+			manifest.Parts = append(manifest.Parts, manifestPart{
+				FileName: path.Base(part.file.name),
+				Size:     part.file.size,
+				RowCount: part.rowCount,
+				Checksum: checksum,
+			})
+		} else {
+			manifest.FileName = path.Base(part.file.name)
+			manifest.Checksum = checksum
+		}
+		uploads = mergeUploads(uploads, part.file.uploads)
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return controller.deliverSidecar(name+manifestSuffix, content, uploads)
+}
+
+/*
+Keep the worst state of the files for each destination: a missing file, then a file in the fallback bucket
+*/
+func mergeUploads(uploads []*destinationUpload, fileUploads []*destinationUpload) []*destinationUpload {
+	if uploads == nil {
+		return fileUploads
+	}
+	merged := make([]*destinationUpload, len(uploads))
+	for i, upload := range uploads {
+		merged[i] = upload
+		if fileUploads[i].state > upload.state {
+			merged[i] = fileUploads[i]
+		}
+	}
+	return merged
+}
+
+/*
+Deliver the sidecar file like the data file of each upload, concurrently. Nothing is delivered where the data file is
+missing
+*/
+func (controller *bqToFtpController) deliverSidecar(name string, content []byte, uploads []*destinationUpload) error {
+	return forEachDestination(len(uploads), func(i int) error {
+		upload := uploads[i]
+		switch upload.state {
+		case stateFallback:
+			return controller.storageService.FallbackStoreFile(upload.destination.fallbackName(upload.directory+name), bytes.NewReader(content))
+		case stateDelivered:
+			return upload.destination.sendFile(upload.directory+name, bytes.NewReader(content), upload.destination.attempts, nil)
+		}
+		log.Warningf("The sidecar file %q isn't delivered to %s, its data file is missing", name, upload.destination)
+		return nil
+	})
+}
@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"bqToFtp/mocks"
+	"bqToFtp/models"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/mock"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_bqToFtpController_deliverSidecars(t *testing.T) {
+	tests := []struct {
+		name         string
+		format       *sidecarFormat
+		fallback     bool
+		sendErr      error
+		wantChecksum string
+		wantMarker   bool
+		wantErr      bool
+	}{
+		{
+			name:         "MD5 checksum file",
+			format:       &sidecarFormat{checksum: checksumMd5},
+			wantChecksum: "9a0364b9e99bb480dd25e1f0284c8555  export.csv\n",
+		},
+		{
+			name:         "SHA256 checksum file and marker in fallback bucket",
+			format:       &sidecarFormat{checksum: checksumSha256, markerSuffix: ".ok"},
+			fallback:     true,
+			wantChecksum: "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73  export.csv\n",
+			wantMarker:   true,
+		},
+		{
+			name:       "Marker file without checksum",
+			format:     &sidecarFormat{checksum: checksumNone, markerSuffix: ".ok"},
+			wantMarker: true,
+		},
+		{
+			name:    "Send in error",
+			format:  &sidecarFormat{checksum: checksumMd5},
+			sendErr: errors.New("error"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delivered := make(map[string]*string)
+			deliver := func(name string) func(args mock.Arguments) {
+				return func(args mock.Arguments) {
+					content := ""
+					delivered[name] = &content
+					readAll(&content)(args)
+				}
+			}
+			mockFtp := &mocks.IFTPService{}
+			mockStorage := &mocks.IStorageService{}
+			for _, name := range []string{"export.csv.md5", "export.csv.sha256", "export.csv.ok"} {
+				if tt.fallback {
+					mockStorage.On("FallbackStoreFile", name, mock.Anything).Run(deliver(name)).Return(nil)
+				} else {
+					mockFtp.On("Send", name, mock.Anything).Run(deliver(name)).Return(tt.sendErr)
+				}
+			}
+			controller := &bqToFtpController{
+				destinations:   singleDestination(mockFtp),
+				storageService: mockStorage,
+				sidecarFormat:  tt.format,
+			}
+			file := &streamedFile{name: "export.csv", size: 7, checksum: tt.format.newHash(), uploads: []*destinationUpload{
+				{destination: controller.destinations[0], state: stateDelivered},
+			}}
+			if tt.fallback {
+				file.uploads[0].state = stateFallback
+			}
+			if file.checksum != nil {
+				file.checksum.Write([]byte("content"))
+			}
+
+			if err := controller.deliverSidecars(file); (err != nil) != tt.wantErr {
+				t.Errorf("bqToFtpController.deliverSidecars() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+
+			checksumName := "export.csv." + map[string]string{checksumMd5: "md5", checksumSha256: "sha256"}[tt.format.checksum]
+			if got := delivered[checksumName]; tt.wantChecksum != "" && (got == nil || *got != tt.wantChecksum) {
+				t.Errorf("bqToFtpController.deliverSidecars() checksum = %v, want %q", got, tt.wantChecksum)
+			}
+			if _, got := delivered["export.csv.ok"]; got != tt.wantMarker {
+				t.Errorf("bqToFtpController.deliverSidecars() marker delivered = %v, want %v", got, tt.wantMarker)
+			}
+		})
+	}
+}
+
+func Test_bqToFtpController_deliverManifest(t *testing.T) {
+	window := models.QueryWindow{
+		Start: time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC),
+		End:   time.Date(2019, 6, 1, 11, 0, 0, 0, time.UTC),
+	}
+	format := &sidecarFormat{checksum: checksumNone, manifest: true}
+	target := &destination{attempts: maxSendAttempts}
+	newPart := func(name string, content string, rowCount int, fallback bool) *filePart {
+		upload := &destinationUpload{destination: target, state: stateDelivered}
+		if fallback {
+			upload.state = stateFallback
+		}
+		file := &streamedFile{name: name, size: int64(len(content)), checksum: format.newHash(), uploads: []*destinationUpload{upload}}
+		file.checksum.Write([]byte(content))
+		return &filePart{file: file, rowCount: rowCount}
+	}
+	tests := []struct {
+		name         string
+		parts        []*filePart
+		split        bool
+		wantFallback bool
+		want         fileManifest
+	}{
+		{
+			name:  "Single file",
+			parts: []*filePart{newPart("export.csv", "content", 2, false)},
+			want: fileManifest{
+				FileName: "export.csv",
+				Size:     7,
+				RowCount: 2,
+				Checksum: "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73",
+			},
+		},
+		{
+			name: "Split files with a part in fallback bucket",
+			parts: []*filePart{
+				newPart("export-part-0001.csv", "content", 2, false),
+				newPart("export-part-0002.csv", "end", 1, true),
+			},
+			split:        true,
+			wantFallback: true,
+			want: fileManifest{
+				Size:     10,
+				RowCount: 3,
+				Parts: []manifestPart{
+					{FileName: "export-part-0001.csv", Size: 7, RowCount: 2, Checksum: "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"},
+					{FileName: "export-part-0002.csv", Size: 3, RowCount: 1, Checksum: "361e48d0308f20e32dba5fb56328baf18d72ef0ccb43b84f5c262d2a6a1fc6c8"},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := ""
+			mockFtp := &mocks.IFTPService{}
+			mockStorage := &mocks.IStorageService{}
+			if tt.wantFallback {
+				mockStorage.On("FallbackStoreFile", "export.csv.manifest.json", mock.Anything).Run(readAll(&content)).Return(nil)
+			} else {
+				mockFtp.On("Send", "export.csv.manifest.json", mock.Anything).Run(readAll(&content)).Return(nil)
+			}
+			target.service = mockFtp
+			controller := &bqToFtpController{
+				destinations:   []*destination{target},
+				storageService: mockStorage,
+				sidecarFormat:  format,
+			}
+
+			if err := controller.deliverManifest("export.csv", tt.parts, tt.split, window); err != nil {
+				t.Errorf("bqToFtpController.deliverManifest() error = %v", err)
+				return
+			}
+			manifest := fileManifest{}
+			if err := json.Unmarshal([]byte(content), &manifest); err != nil {
+				t.Errorf("bqToFtpController.deliverManifest() delivered an unreadable manifest with error %v", err)
+				return
+			}
+			if manifest.GeneratedAt.IsZero() || !manifest.WindowStart.Equal(window.Start) || !manifest.WindowEnd.Equal(window.End) {
+				t.Errorf("bqToFtpController.deliverManifest() manifest = %+v", manifest)
+			}
+			tt.want.ChecksumAlgorithm = checksumSha256
+			manifest.WindowStart, manifest.WindowEnd, manifest.GeneratedAt = time.Time{}, time.Time{}, time.Time{}
+			if !reflect.DeepEqual(manifest, tt.want) {
+				t.Errorf("bqToFtpController.deliverManifest() manifest = %+v, want %+v", manifest, tt.want)
+			}
+		})
+	}
+}
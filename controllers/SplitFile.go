@@ -0,0 +1,254 @@
+package controllers
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"cloud.google.com/go/bigquery"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Limits of the delivered files. A new file is started when the current one reaches a limit:
+  - maxRows: number of rows of a file. No limit if 0
+  - maxBytes: size of a delivered file, after the compression and the encryption. The file can exceed it by the content
+    buffered by the row writer and the stages, like a row, a PARQUET row group or a compressed block. No limit if 0
+*/
+type splitPolicy struct {
+	maxRows  int
+	maxBytes int64
+}
+
+/*
+Load the split policy from the environment variables. Wrong values are logged and ignored.
+Return nil if the files aren't split
+*/
+func newSplitPolicy(configService helpers.IConfigService) *splitPolicy {
+	policy := &splitPolicy{}
+
+	if maxRows := configService.GetEnvVar(models.SPLIT_MAX_ROWS); maxRows != "" {
+		rows, err := strconv.Atoi(maxRows)
+		if err != nil || rows < 0 {
+			log.Errorf("Impossible to convert to positive Integer the SPLIT_MAX_ROWS parameter %q. The rows aren't limited", maxRows)
+		} else {
+			policy.maxRows = rows
+		}
+	}
+
+	if maxBytes := configService.GetEnvVar(models.SPLIT_MAX_BYTES); maxBytes != "" {
+		size, err := strconv.ParseInt(maxBytes, 10, 64)
+		if err != nil || size < 0 {
+			log.Errorf("Impossible to convert to positive Integer the SPLIT_MAX_BYTES parameter %q. The size isn't limited", maxBytes)
+		} else {
+			policy.maxBytes = size
+		}
+	}
+
+	if policy.maxRows == 0 && policy.maxBytes == 0 {
+		return nil
+	}
+	return policy
+}
+
+/*
+Check if the part reached a limit. A part contains at least one row
+*/
+func (this *splitPolicy) isFull(part *filePart) bool {
+	if this == nil || part.rowCount == 0 {
+		return false
+	}
+	return (this.maxRows > 0 && part.rowCount >= this.maxRows) ||
+		(this.maxBytes > 0 && part.file.size >= this.maxBytes)
+}
+
+/*
+Delivered file, streamed to the FTP while the rows are written. The content written by the row writer goes through the
+stages to the streamed file
+*/
+type filePart struct {
+	file         *streamedFile
+	out          io.Writer
+	stageWriters []io.WriteCloser
+	rowWriter    rowWriter
+	rowCount     int
+}
+
+/*
+Row writer which writes the rows in the delivered files. A new file, with its own header, is started when the current
+one reaches the split policy. Each file is delivered with its sidecar files when it's complete.
+The files are delivered in the directories of the run of the destinations. The files of a partition have its value in
+their name, and are delivered in its directory if required
+*/
+type splitWriter struct {
+	controller   *bqToFtpController
+	newRowWriter rowWriterFactory
+	stages       []outputStage
+	runDate      time.Time
+	window       models.QueryWindow
+	directories  []string
+	partition    string
+	directory    string
+	schema       bigquery.Schema
+	current      *filePart
+	parts        []*filePart
+}
+
+func (controller *bqToFtpController) newSplitWriter(newRowWriter rowWriterFactory, runDate time.Time, window models.QueryWindow, directories []string, partition string, directory string) *splitWriter {
+	return &splitWriter{
+		controller:   controller,
+		newRowWriter: newRowWriter,
+		stages:       controller.outputStages(),
+		runDate:      runDate,
+		window:       window,
+		directories:  directories,
+		partition:    partition,
+		directory:    directory,
+	}
+}
+
+func (this *splitWriter) writeHeader(schema bigquery.Schema) error {
+	//The schema is kept for the header of the next parts
+	this.schema = schema
+	return this.startPart()
+}
+
+func (this *splitWriter) writeRow(values []bigquery.Value) error {
+	if this.controller.splitPolicy.isFull(this.current) {
+		if err := this.endPart(); err != nil {
+			return err
+		}
+		if err := this.startPart(); err != nil {
+			return err
+		}
+	}
+	this.current.rowCount++
+	return this.current.rowWriter.writeRow(values)
+}
+
+func (this *splitWriter) close() error {
+	return this.endPart()
+}
+
+/*
+Stop the delivery of the current file after a production error. The files already delivered are kept
+*/
+func (this *splitWriter) abort(productionErr error) {
+	if this.current != nil {
+		this.controller.closeStreamedFile(this.current.file, productionErr)
+		this.current = nil
+	}
+}
+
+/*
+Name of the file number sequence, before the stages. When the file name template doesn't use the partition, and the
+partition has no directory, the -<partition> suffix is added before the extension
+*/
+func (this *splitWriter) fileName(sequence int) (string, error) {
+	name, err := this.renderFileName(sequence, this.partition)
+	if err != nil || this.partition == "" || this.directory != "" {
+		return name, err
+	}
+	otherName, err := this.renderFileName(sequence, this.partition+"_")
+	if err != nil || otherName != name {
+		return name, err
+	}
+	return this.addNameSuffix(name, "-"+this.partition), nil
+}
+
+/*
+Name of the file number sequence, before the stages. When the files are split and the file name template doesn't use
+the sequence, the -part-0001 suffix is added before the extension
+*/
+func (this *splitWriter) partFileName(sequence int) (string, error) {
+	name, err := this.fileName(sequence)
+	if err != nil || this.controller.splitPolicy == nil {
+		return name, err
+	}
+	nextName, err := this.fileName(sequence + 1)
+	if err != nil || nextName != name {
+		return name, err
+	}
+	return this.addNameSuffix(name, fmt.Sprintf("-part-%04d", sequence)), nil
+}
+
+func (this *splitWriter) renderFileName(sequence int, partition string) (string, error) {
+	return this.controller.fileNameFormat.fileName(fileNameData{
+		RunTime:     this.runDate,
+		WindowStart: this.window.Start,
+		WindowEnd:   this.window.End,
+		Sequence:    sequence,
+		Partition:   partition,
+		Extension:   fileExtensions[this.controller.outputFormat],
+	})
+}
+
+/*
+Add the suffix before the extension of the file name
+*/
+func (this *splitWriter) addNameSuffix(name string, suffix string) string {
+	extension := "." + fileExtensions[this.controller.outputFormat]
+	if !strings.HasSuffix(name, extension) {
+		return name + suffix
+	}
+	return strings.TrimSuffix(name, extension) + suffix + extension
+}
+
+/*
+Delivered name of the run, used for the manifest. It's the name of the first file without the part suffix, in the
+directory of the partition
+*/
+func (this *splitWriter) runName() (string, error) {
+	name, err := this.fileName(1)
+	return this.directory + stagedFileName(name, this.stages), err
+}
+
+func (this *splitWriter) startPart() error {
+	name, err := this.partFileName(len(this.parts) + 1)
+	if err != nil {
+		return err
+	}
+	deliveredName := stagedFileName(name, this.stages)
+
+	//Stream the file to the FTP while the rows are read
+	file, err := this.controller.newStreamedFile(this.directory+deliveredName, this.directories)
+	if err != nil {
+		return err
+	}
+	part := &filePart{file: file}
+	this.current = part
+	if part.out, part.stageWriters, err = newStagedWriters(file, name, this.stages); err != nil {
+		return err
+	}
+	newRowWriter := this.controller.recordTemplates.wrap(this.newRowWriter, headerRecordData{
+		FileName:    deliveredName,
+		RunDate:     this.runDate,
+		WindowStart: this.window.Start,
+		WindowEnd:   this.window.End,
+	})
+	part.rowWriter = newRowWriter(part.out)
+	return part.rowWriter.writeHeader(this.schema)
+}
+
+func (this *splitWriter) endPart() error {
+	part := this.current
+	this.current = nil
+	err := part.rowWriter.close()
+	if err == nil {
+		err = closeStagedWriters(part.stageWriters)
+	}
+	part.file.metadata = fileMetadata(part.rowCount, this.window)
+	if err = this.controller.closeStreamedFile(part.file, err); err != nil {
+		return fmt.Errorf("impossible to deliver the file %q: %v", part.file.name, err)
+	}
+	this.parts = append(this.parts, part)
+
+	//Signal the completion of the file
+	if err = this.controller.deliverSidecars(part.file); err != nil {
+		return fmt.Errorf("impossible to deliver the sidecar files of %q: %v", part.file.name, err)
+	}
+	return nil
+}
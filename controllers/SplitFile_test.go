@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"bqToFtp/mocks"
+	"bqToFtp/models"
+	"cloud.google.com/go/bigquery"
+	"fmt"
+	"github.com/stretchr/testify/mock"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func Test_splitWriter(t *testing.T) {
+	rows := [][]bigquery.Value{{"1", "Joe", "x"}, {"2", "Jane", "y"}, {"3", "Jim", "z"}}
+	tests := []struct {
+		name         string
+		policy       *splitPolicy
+		nameTemplate string
+		want         map[string]string
+	}{
+		{
+			name:         "No split",
+			nameTemplate: defaultFileNameTemplate,
+			want: map[string]string{
+				"export-20190602013000.csv": "id,Name,Value\n1,Joe,x\n2,Jane,y\n3,Jim,z\n",
+			},
+		},
+		{
+			name:         "Split by rows",
+			policy:       &splitPolicy{maxRows: 2},
+			nameTemplate: defaultFileNameTemplate,
+			want: map[string]string{
+				"export-20190602013000-part-0001.csv": "id,Name,Value\n1,Joe,x\n2,Jane,y\n",
+				"export-20190602013000-part-0002.csv": "id,Name,Value\n3,Jim,z\n",
+			},
+		},
+		{
+			name:         "Split by bytes with the sequence in the template",
+			policy:       &splitPolicy{maxBytes: 20},
+			nameTemplate: `export_{{.Sequence}}.{{.Extension}}`,
+			want: map[string]string{
+				"export_1.csv": "id,Name,Value\n1,Joe,x\n",
+				"export_2.csv": "id,Name,Value\n2,Jane,y\n",
+				"export_3.csv": "id,Name,Value\n3,Jim,z\n",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lock := sync.Mutex{}
+			got := make(map[string]string)
+			mockFtp := &mocks.IFTPService{}
+			mockFtp.On("Send", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				content := ""
+				readAll(&content)(args)
+				lock.Lock()
+				got[args.String(0)] = content
+				lock.Unlock()
+			}).Return(nil)
+			controller := &bqToFtpController{
+				destinations:      singleDestination(mockFtp),
+				outputFormat:      outputFormatCsv,
+				compressionFormat: &compressionFormat{algorithm: compressionNone},
+				splitPolicy:       tt.policy,
+				fileNameFormat: &fileNameFormat{
+					template: template.Must(template.New("test").Parse(tt.nameTemplate)),
+					location: time.UTC,
+					prefix:   "export-",
+				},
+			}
+			newRowWriter := func(out io.Writer) rowWriter {
+				return newCsvWriter(out, true, newDefaultCsvFormat(), newDefaultValueFormat(), nil)
+			}
+			output := controller.newSplitWriter(newRowWriter, time.Date(2019, 6, 2, 1, 30, 0, 0, time.UTC), models.QueryWindow{}, []string{""}, "", "")
+			if err := createFile(output, &DummyRowIterator{Row: append([][]bigquery.Value{}, rows...)}); err != nil {
+				t.Errorf("createFile() error = %v", err)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitWriter delivered %v, want %v", got, tt.want)
+			}
+			if len(output.parts) != len(tt.want) {
+				t.Errorf("splitWriter parts = %d, want %d", len(output.parts), len(tt.want))
+			}
+		})
+	}
+}
+
+func Test_splitWriter_parquet(t *testing.T) {
+	const maxBytes = 64 * 1024
+	var rows [][]bigquery.Value
+	for i := 0; i < 20000; i++ {
+		rows = append(rows, []bigquery.Value{strconv.Itoa(i), fmt.Sprintf("name%d", i*7919), strconv.Itoa(i % 97)})
+	}
+
+	lock := sync.Mutex{}
+	got := make(map[string]string)
+	mockFtp := &mocks.IFTPService{}
+	mockFtp.On("Send", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		content := ""
+		readAll(&content)(args)
+		lock.Lock()
+		got[args.String(0)] = content
+		lock.Unlock()
+	}).Return(nil)
+	controller := &bqToFtpController{
+		destinations:      singleDestination(mockFtp),
+		outputFormat:      outputFormatParquet,
+		parquetFormat:     &parquetFormat{compression: parquet.CompressionCodec_SNAPPY, rowGroupSize: 128 * 1024 * 1024},
+		compressionFormat: &compressionFormat{algorithm: compressionNone},
+		splitPolicy:       &splitPolicy{maxBytes: maxBytes},
+		fileNameFormat: &fileNameFormat{
+			template: template.Must(template.New("test").Parse(defaultFileNameTemplate)),
+			location: time.UTC,
+			prefix:   "export-",
+		},
+	}
+	newRowWriter, err := controller.newRowWriterFactory()
+	if err != nil {
+		t.Fatalf("bqToFtpController.newRowWriterFactory() error = %v", err)
+	}
+	output := controller.newSplitWriter(newRowWriter, time.Date(2019, 6, 2, 1, 30, 0, 0, time.UTC), models.QueryWindow{}, []string{""}, "", "")
+	if err := createFile(output, &DummyRowIterator{Row: rows}); err != nil {
+		t.Fatalf("createFile() error = %v", err)
+	}
+
+	if len(got) < 2 {
+		t.Errorf("splitWriter delivered %d PARQUET files, want a split", len(got))
+	}
+	var rowCount int64
+	for name, content := range got {
+		//A file can exceed the limit by the last row group, a part of the limit
+		if len(content) > maxBytes*3/2 {
+			t.Errorf("splitWriter delivered %q of %d bytes, want about %d", name, len(content), maxBytes)
+		}
+		file, _ := buffer.NewBufferFile([]byte(content))
+		parquetReader, err := reader.NewParquetReader(file, nil, 1)
+		if err != nil {
+			t.Errorf("splitWriter delivered the unreadable file %q with error %v", name, err)
+			continue
+		}
+		rowCount += parquetReader.GetNumRows()
+	}
+	if rowCount != int64(len(rows)) {
+		t.Errorf("splitWriter delivered %d rows, want %d", rowCount, len(rows))
+	}
+}
@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"bqToFtp/services"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var errUploadStopped = errors.New("upload stopped before the end of the file")
+
+/*
+File sent to the destinations while it's written. The content is piped to the IFTPService.Send of each destination,
+which consume it concurrently while the rows are still arriving. The content is also spooled in a temporary file for
+allowing the retries and the fallback when a streamed upload fails.
+The destinations which store metadata with the files aren't streamed, the file is sent from the spool file when it's
+complete, with the metadata set before the close.
+The size and the checksum, if required by the sidecar files, are computed on the fly
+*/
+type streamedFile struct {
+	name     string
+	spool    *os.File
+	uploads  []*destinationUpload
+	size     int64
+	checksum hash.Hash
+	metadata map[string]string
+}
+
+/*
+Upload of the file to a destination. The file is delivered in the directory of the run of the destination. The state
+tells where the file is at the end: on the destination, in the fallback bucket, or nowhere. withMetadata is set when the
+file is only sent at the close, with its metadata
+*/
+type destinationUpload struct {
+	destination  *destination
+	directory    string
+	pipeWriter   *io.PipeWriter
+	streaming    bool
+	withMetadata bool
+	sendResult   chan error
+	state        deliveryState
+}
+
+/*
+Create the spool file and start the uploads in background. directories are the directories of the run of each
+destination
+*/
+func (controller *bqToFtpController) newStreamedFile(name string, directories []string) (file *streamedFile, err error) {
+	spool, err := ioutil.TempFile("", "bqToFtp-")
+	if err != nil {
+		return
+	}
+
+	file = &streamedFile{
+		name:     name,
+		spool:    spool,
+		checksum: controller.sidecarFormat.newHash(),
+	}
+	for i, destination := range controller.destinations {
+		if _, ok := destination.service.(services.IMetadataService); ok {
+			file.uploads = append(file.uploads, &destinationUpload{
+				destination:  destination,
+				directory:    directories[i],
+				withMetadata: true,
+			})
+			continue
+		}
+
+		pipeReader, pipeWriter := io.Pipe()
+		upload := &destinationUpload{
+			destination: destination,
+			directory:   directories[i],
+			pipeWriter:  pipeWriter,
+			streaming:   true,
+			sendResult:  make(chan error, 1),
+		}
+		file.uploads = append(file.uploads, upload)
+
+		go func() {
+			err := upload.destination.service.Send(upload.directory+name, pipeReader)
+			//Unblock the writer if the upload stops before the end of the file
+			pipeReader.CloseWithError(errUploadStopped)
+			upload.sendResult <- err
+		}()
+	}
+	return
+}
+
+/*
+Write in the spool file and in the upload streams. A stream error doesn't stop the writing, the content continues to be
+spooled for the retries
+*/
+func (this *streamedFile) Write(p []byte) (n int, err error) {
+	if n, err = this.spool.Write(p); err != nil {
+		return
+	}
+	this.size += int64(n)
+	if this.checksum != nil {
+		this.checksum.Write(p[:n])
+	}
+	for _, upload := range this.uploads {
+		if !upload.streaming {
+			continue
+		}
+		if _, streamErr := upload.pipeWriter.Write(p); streamErr != nil {
+			log.Warningf("Streamed upload of the file %q to %s interrupted with error %v. The file continues to be spooled", this.name, upload.destination, streamErr)
+			upload.streaming = false
+		}
+	}
+	return
+}
+
+/*
+End the uploads of the file. The file is sent from the spool file to the destinations with metadata. If a streamed
+upload failed, the retries are performed from the spool file, then the DELIVERY_POLICY is applied to the destinations which didn't receive the file. If the file production failed, the uploads
+are aborted and the production error is returned
+*/
+func (controller *bqToFtpController) closeStreamedFile(file *streamedFile, productionErr error) (err error) {
+	defer os.Remove(file.spool.Name())
+	defer file.spool.Close()
+
+	if productionErr != nil {
+		for _, upload := range file.uploads {
+			if !upload.withMetadata {
+				upload.pipeWriter.CloseWithError(productionErr)
+			}
+		}
+		for _, upload := range file.uploads {
+			if !upload.withMetadata {
+				<-upload.sendResult
+			}
+		}
+		return productionErr
+	}
+
+	for _, upload := range file.uploads {
+		if !upload.withMetadata {
+			upload.pipeWriter.Close()
+		}
+	}
+	//The failed uploads are retried concurrently, each from its own reader of the spool file
+	forEachDestination(len(file.uploads), func(i int) error {
+		upload := file.uploads[i]
+		if upload.withMetadata {
+			if err := upload.destination.sendFile(upload.directory+file.name, io.NewSectionReader(file.spool, 0, file.size), upload.destination.attempts, file.metadata); err != nil {
+				log.Errorf("Impossible to send the file to %s with error %v", upload.destination, err)
+				upload.state = stateFailed
+				return nil
+			}
+			upload.state = stateDelivered
+			return nil
+		}
+
+		err := <-upload.sendResult
+		if err == nil && upload.streaming {
+			//Correct send by ftp
+			upload.state = stateDelivered
+			return nil
+		}
+		if err == nil {
+			err = errUploadStopped
+		}
+		log.Warningf("Error while streaming the file to %s with error %v. Perform a retry", upload.destination, err)
+
+		if upload.destination.attempts <= 1 {
+			upload.state = stateFailed
+			return nil
+		}
+		if err = upload.destination.sendFile(upload.directory+file.name, io.NewSectionReader(file.spool, 0, file.size), upload.destination.attempts-1, nil); err != nil {
+			log.Errorf("Impossible to send the file to %s with error %v", upload.destination, err)
+			upload.state = stateFailed
+			return nil
+		}
+		upload.state = stateDelivered
+		return nil
+	})
+
+	var failed []*destinationUpload
+	var failedNames []string
+	for _, upload := range file.uploads {
+		if upload.state == stateFailed {
+			failed = append(failed, upload)
+			failedNames = append(failedNames, upload.destination.String())
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	if controller.deliveryPolicy == deliveryPolicyPartial && len(failed) < len(file.uploads) {
+		log.Errorf("The file %q isn't delivered to %s. It's delivered to the other destinations", file.name, strings.Join(failedNames, ", "))
+		return nil
+	}
+
+	for _, upload := range failed {
+		log.Errorf("Try to save the file %q of %s in fallback bucket", file.name, upload.destination)
+		name := upload.destination.fallbackName(upload.directory + file.name)
+		//save in fallback
+		if err = controller.storageService.FallbackStoreFile(name, io.NewSectionReader(file.spool, 0, file.size)); err != nil {
+			log.Errorf("Impossible to file in fallback bucket with error %v. The file %q is lost", err, name)
+			return
+		}
+		upload.state = stateFallback
+	}
+	if controller.deliveryPolicy == deliveryPolicyFail {
+		return fmt.Errorf("the file isn't delivered to %s, it's stored in the fallback bucket", strings.Join(failedNames, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"bqToFtp/mocks"
+	"errors"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+/*
+Read the full content of the source and keep it for the assertions
+*/
+func readAll(received *string) func(args mock.Arguments) {
+	return func(args mock.Arguments) {
+		content, _ := ioutil.ReadAll(args.Get(1).(io.Reader))
+		*received = string(content)
+	}
+}
+
+/*
+Mock of the FTP service which receives the streamed files. testify formats the arguments of the calls, the pipe of the
+upload is given behind an interface, formatted as its address, for not reading the pipe while it's written
+*/
+type streamedFtpService struct {
+	*mocks.IFTPService
+}
+
+func (this streamedFtpService) Send(name string, src io.Reader) error {
+	return this.IFTPService.Send(name, struct{ io.Reader }{src})
+}
+
+/*
+Single destination of the service, like without DESTINATIONS
+*/
+func singleDestination(service *mocks.IFTPService) []*destination {
+	return []*destination{{service: streamedFtpService{service}, attempts: maxSendAttempts}}
+}
+
+func Test_bqToFtpController_closeStreamedFile(t *testing.T) {
+	var sent, stored string
+
+	mockFtp := &mocks.IFTPService{}
+	mockFtp.On("Send", "streamed", mock.Anything).Run(readAll(&sent)).Return(nil)
+	mockFtp.On("Send", "retried", mock.Anything).Return(errors.New("error")).Once()
+	mockFtp.On("Send", "retried", mock.Anything).Run(readAll(&sent)).Return(nil)
+	mockFtp.On("Send", "fallback", mock.Anything).Return(errors.New("error"))
+	mockFtp.On("Send", "lost", mock.Anything).Return(errors.New("error"))
+	mockFtp.On("Send", "production error", mock.Anything).Run(readAll(&sent)).Return(errors.New("error"))
+
+	mockStorage := &mocks.IStorageService{}
+	mockStorage.On("FallbackStoreFile", "fallback", mock.Anything).Run(readAll(&stored)).Return(nil)
+	mockStorage.On("FallbackStoreFile", "lost", mock.Anything).Return(errors.New("error"))
+
+	tests := []struct {
+		name          string
+		fileName      string
+		productionErr error
+		wantSent      string
+		wantStored    string
+		wantErr       bool
+	}{
+		{
+			name:     "Streamed send",
+			fileName: "streamed",
+			wantSent: "content",
+		},
+		{
+			name:     "Send retried from the spool",
+			fileName: "retried",
+			wantSent: "content",
+		},
+		{
+			name:       "Stored in fallback",
+			fileName:   "fallback",
+			wantStored: "content",
+		},
+		{
+			name:     "Fallback in error",
+			fileName: "lost",
+			wantErr:  true,
+		},
+		{
+			name:          "Production in error",
+			fileName:      "production error",
+			productionErr: errors.New("read error"),
+			wantSent:      "content",
+			wantErr:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent, stored = "", ""
+			controller := &bqToFtpController{
+				destinations:   singleDestination(mockFtp),
+				storageService: mockStorage,
+			}
+			file, err := controller.newStreamedFile(tt.fileName, []string{""})
+			if err != nil {
+				t.Errorf("bqToFtpController.newStreamedFile() error = %v", err)
+				return
+			}
+			file.Write([]byte("con"))
+			file.Write([]byte("tent"))
+			if err := controller.closeStreamedFile(file, tt.productionErr); (err != nil) != tt.wantErr {
+				t.Errorf("bqToFtpController.closeStreamedFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if sent != tt.wantSent {
+				t.Errorf("bqToFtpController.closeStreamedFile() sent = %q, want %q", sent, tt.wantSent)
+			}
+			if stored != tt.wantStored {
+				t.Errorf("bqToFtpController.closeStreamedFile() stored = %q, want %q", stored, tt.wantStored)
+			}
+		})
+	}
+}
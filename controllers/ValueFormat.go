@@ -0,0 +1,207 @@
+package controllers
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"encoding/base64"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	complexFormatJson = "JSON"
+	complexFormatJoin = "JOIN"
+)
+
+/*
+Describe how the values are written as text in the CSV and fixed-width files:
+  - timestampLayout: Go layout of the TIMESTAMP values, like BigQuery exports by default
+  - location: time zone of the TIMESTAMP values, UTC by default
+  - dateLayout: Go layout of the DATE values, 2006-01-02 by default
+  - decimalPrecision: number of decimal digits of FLOAT and NUMERIC values. -1 (default) keeps all the significant digits
+  - decimalSeparator: separator of the decimal digits, dot by default
+  - trueLiteral, falseLiteral: text of the BOOLEAN values, true and false by default
+  - nullValue: text of the NULL values, empty by default
+  - complexFormat: JSON (default) to write the REPEATED and RECORD values as JSON, or JOIN to write their formatted
+    values separated by the complexSeparator
+*/
+type valueFormat struct {
+	timestampLayout  string
+	location         *time.Location
+	dateLayout       string
+	decimalPrecision int
+	decimalSeparator string
+	trueLiteral      string
+	falseLiteral     string
+	nullValue        string
+	complexFormat    string
+	complexSeparator string
+}
+
+func newDefaultValueFormat() *valueFormat {
+	return &valueFormat{
+		timestampLayout:  "2006-01-02 15:04:05.999999 MST",
+		location:         time.UTC,
+		dateLayout:       "2006-01-02",
+		decimalPrecision: -1,
+		decimalSeparator: ".",
+		trueLiteral:      "true",
+		falseLiteral:     "false",
+		nullValue:        "",
+		complexFormat:    complexFormatJson,
+		complexSeparator: "|",
+	}
+}
+
+/*
+Load the value format from the environment variables. Wrong values are logged and replaced by the default one
+*/
+func newValueFormat(configService helpers.IConfigService) *valueFormat {
+	format := newDefaultValueFormat()
+
+	if timestampLayout := configService.GetEnvVar(models.TIMESTAMP_FORMAT); timestampLayout != "" {
+		format.timestampLayout = timestampLayout
+	}
+
+	if timezone := configService.GetEnvVar(models.TIMEZONE); timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			log.Errorf("Unknown TIMEZONE parameter %q. Timezone is set to UTC", timezone)
+		} else {
+			format.location = location
+		}
+	}
+
+	if dateLayout := configService.GetEnvVar(models.DATE_FORMAT); dateLayout != "" {
+		format.dateLayout = dateLayout
+	}
+
+	if decimalPrecision := configService.GetEnvVar(models.DECIMAL_PRECISION); decimalPrecision != "" {
+		precision, err := strconv.Atoi(decimalPrecision)
+		if err != nil || precision < 0 {
+			log.Errorf("Impossible to convert to a positive number the DECIMAL_PRECISION parameter %q. All the significant digits are kept", decimalPrecision)
+		} else {
+			format.decimalPrecision = precision
+		}
+	}
+
+	if decimalSeparator := configService.GetEnvVar(models.DECIMAL_SEPARATOR); decimalSeparator != "" {
+		format.decimalSeparator = decimalSeparator
+	}
+
+	if trueLiteral := configService.GetEnvVar(models.BOOLEAN_TRUE); trueLiteral != "" {
+		format.trueLiteral = trueLiteral
+	}
+	if falseLiteral := configService.GetEnvVar(models.BOOLEAN_FALSE); falseLiteral != "" {
+		format.falseLiteral = falseLiteral
+	}
+
+	format.nullValue = configService.GetEnvVar(models.NULL_VALUE)
+
+	switch complexFormat := strings.ToUpper(configService.GetEnvVar(models.COMPLEX_FORMAT)); complexFormat {
+	case "":
+	case complexFormatJson, complexFormatJoin:
+		format.complexFormat = complexFormat
+	default:
+		log.Errorf("Unknown COMPLEX_FORMAT parameter %q. Complex format is set to %s", complexFormat, format.complexFormat)
+	}
+
+	if complexSeparator := configService.GetEnvVar(models.COMPLEX_SEPARATOR); complexSeparator != "" {
+		format.complexSeparator = complexSeparator
+	}
+	return format
+}
+
+/*
+Format the value of the field as text
+*/
+func (this *valueFormat) format(schemaField *bigquery.FieldSchema, value bigquery.Value) (string, error) {
+	if value == nil {
+		return this.nullValue, nil
+	}
+	if !schemaField.Repeated && schemaField.Type != bigquery.RecordFieldType {
+		return this.formatValue(schemaField, value)
+	}
+	if this.complexFormat == complexFormatJson {
+		buffer := bytes.Buffer{}
+		err := appendJsonField(&buffer, schemaField, value)
+		return buffer.String(), err
+	}
+
+	//JOIN format, the elements of the array or the fields of the record are separated
+	values, ok := value.([]bigquery.Value)
+	if !ok {
+		return "", fmt.Errorf("the field %q of type %s has a %T value", schemaField.Name, schemaField.Type, value)
+	}
+	elements := make([]string, len(values))
+	for i, element := range values {
+		var err error
+		switch {
+		case schemaField.Repeated:
+			elementField := *schemaField
+			elementField.Repeated = false
+			elements[i], err = this.format(&elementField, element)
+		case i < len(schemaField.Schema):
+			elements[i], err = this.format(schemaField.Schema[i], element)
+		default:
+			err = fmt.Errorf("the record %q has %d values for %d fields in the schema", schemaField.Name, len(values), len(schemaField.Schema))
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(elements, this.complexSeparator), nil
+}
+
+/*
+Format a single value. TIME and DATETIME values are written in the BigQuery canonical format and BYTES in base64
+*/
+func (this *valueFormat) formatValue(schemaField *bigquery.FieldSchema, value bigquery.Value) (string, error) {
+	switch typedValue := value.(type) {
+	case string:
+		return typedValue, nil
+	case int64:
+		return strconv.FormatInt(typedValue, 10), nil
+	case float64:
+		if math.IsNaN(typedValue) || math.IsInf(typedValue, 0) {
+			return formatNonFiniteFloat(typedValue), nil
+		}
+		return this.formatDecimal(strconv.FormatFloat(typedValue, 'f', this.decimalPrecision, 64)), nil
+	case *big.Rat:
+		if this.decimalPrecision < 0 {
+			return this.formatDecimal(formatRat(typedValue, bigquery.NumericScaleDigits)), nil
+		}
+		return this.formatDecimal(typedValue.FloatString(this.decimalPrecision)), nil
+	case bool:
+		if typedValue {
+			return this.trueLiteral, nil
+		}
+		return this.falseLiteral, nil
+	case []byte:
+		return base64.StdEncoding.EncodeToString(typedValue), nil
+	case time.Time:
+		return typedValue.In(this.location).Format(this.timestampLayout), nil
+	case civil.Date:
+		return typedValue.In(time.UTC).Format(this.dateLayout), nil
+	case civil.Time:
+		return bigquery.CivilTimeString(typedValue), nil
+	case civil.DateTime:
+		return bigquery.CivilDateTimeString(typedValue), nil
+	}
+	return "", fmt.Errorf("the field %q of type %s has a %T value", schemaField.Name, schemaField.Type, value)
+}
+
+func (this *valueFormat) formatDecimal(decimal string) string {
+	if this.decimalSeparator == "." {
+		return decimal
+	}
+	return strings.Replace(decimal, ".", this.decimalSeparator, 1)
+}
@@ -0,0 +1,155 @@
+package controllers
+
+import (
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func Test_valueFormat_format(t *testing.T) {
+	paris, _ := time.LoadLocation("Europe/Paris")
+	custom := &valueFormat{
+		timestampLayout:  "02/01/2006 15:04",
+		location:         paris,
+		dateLayout:       "20060102",
+		decimalPrecision: 2,
+		decimalSeparator: ",",
+		trueLiteral:      "Y",
+		falseLiteral:     "N",
+		nullValue:        "NULL",
+		complexFormat:    complexFormatJoin,
+		complexSeparator: ";",
+	}
+	recordField := &bigquery.FieldSchema{Name: "address", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+		{Name: "street", Type: bigquery.StringFieldType},
+		{Name: "zip", Type: bigquery.IntegerFieldType, Repeated: true},
+	}}
+	tests := []struct {
+		name        string
+		format      *valueFormat
+		schemaField *bigquery.FieldSchema
+		value       bigquery.Value
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:        "Default timestamp",
+			format:      newDefaultValueFormat(),
+			schemaField: &bigquery.FieldSchema{Type: bigquery.TimestampFieldType},
+			value:       time.Date(2019, 6, 1, 10, 0, 0, 500000000, time.UTC),
+			want:        "2019-06-01 10:00:00.5 UTC",
+		},
+		{
+			name:        "Custom timestamp in time zone",
+			format:      custom,
+			schemaField: &bigquery.FieldSchema{Type: bigquery.TimestampFieldType},
+			value:       time.Date(2019, 6, 1, 10, 0, 0, 0, time.UTC),
+			want:        "01/06/2019 12:00",
+		},
+		{
+			name:        "Custom date",
+			format:      custom,
+			schemaField: &bigquery.FieldSchema{Type: bigquery.DateFieldType},
+			value:       civil.Date{Year: 2019, Month: 6, Day: 1},
+			want:        "20190601",
+		},
+		{
+			name:        "Default numeric",
+			format:      newDefaultValueFormat(),
+			schemaField: &bigquery.FieldSchema{Type: bigquery.NumericFieldType},
+			value:       big.NewRat(3, 2),
+			want:        "1.5",
+		},
+		{
+			name:        "Custom numeric",
+			format:      custom,
+			schemaField: &bigquery.FieldSchema{Type: bigquery.NumericFieldType},
+			value:       big.NewRat(1, 3),
+			want:        "0,33",
+		},
+		{
+			name:        "Default float without exponent",
+			format:      newDefaultValueFormat(),
+			schemaField: &bigquery.FieldSchema{Type: bigquery.FloatFieldType},
+			value:       1e21,
+			want:        "1000000000000000000000",
+		},
+		{
+			name:        "Custom float",
+			format:      custom,
+			schemaField: &bigquery.FieldSchema{Type: bigquery.FloatFieldType},
+			value:       2.5,
+			want:        "2,50",
+		},
+		{
+			name:        "Custom boolean",
+			format:      custom,
+			schemaField: &bigquery.FieldSchema{Type: bigquery.BooleanFieldType},
+			value:       false,
+			want:        "N",
+		},
+		{
+			name:        "Default null",
+			format:      newDefaultValueFormat(),
+			schemaField: &bigquery.FieldSchema{Type: bigquery.StringFieldType},
+			value:       nil,
+			want:        "",
+		},
+		{
+			name:        "Custom null",
+			format:      custom,
+			schemaField: &bigquery.FieldSchema{Type: bigquery.StringFieldType},
+			value:       nil,
+			want:        "NULL",
+		},
+		{
+			name:        "Default array",
+			format:      newDefaultValueFormat(),
+			schemaField: &bigquery.FieldSchema{Type: bigquery.StringFieldType, Repeated: true},
+			value:       []bigquery.Value{"a", "b"},
+			want:        `["a","b"]`,
+		},
+		{
+			name:        "Joined array",
+			format:      custom,
+			schemaField: &bigquery.FieldSchema{Type: bigquery.StringFieldType, Repeated: true},
+			value:       []bigquery.Value{"a", nil},
+			want:        "a;NULL",
+		},
+		{
+			name:        "Default record",
+			format:      newDefaultValueFormat(),
+			schemaField: recordField,
+			value:       []bigquery.Value{"street", []bigquery.Value{int64(75001)}},
+			want:        `{"street":"street","zip":[75001]}`,
+		},
+		{
+			name:        "Joined record",
+			format:      custom,
+			schemaField: recordField,
+			value:       []bigquery.Value{"street", []bigquery.Value{int64(75001), int64(75002)}},
+			want:        "street;75001;75002",
+		},
+		{
+			name:        "Wrong value",
+			format:      newDefaultValueFormat(),
+			schemaField: &bigquery.FieldSchema{Type: bigquery.StringFieldType},
+			value:       []bigquery.Value{"a"},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.format.format(tt.schemaField, tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("valueFormat.format() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("valueFormat.format() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
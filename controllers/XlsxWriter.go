@@ -0,0 +1,324 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	//Row limit of an Excel sheet, header included
+	xlsxMaxRows = 1048576
+	//Length limit of an Excel sheet name, in characters
+	xlsxMaxSheetName = 31
+	//Length limit of an Excel cell text, in UTF-16 characters. Excel repairs the workbooks with longer texts
+	xlsxMaxCellText = 32767
+
+	xlsxStyleDate     = 1
+	xlsxStyleDateTime = 2
+	xlsxStyleTime     = 3
+)
+
+/*
+Excel day 0, the dates are the number of days since it
+*/
+var xlsxEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+/*
+Describe how the XLSX file is written:
+  - sheetName: name of the first sheet, Sheet1 by default. The next sheets are suffixed by their number
+*/
+type xlsxFormat struct {
+	sheetName string
+}
+
+/*
+Load the XLSX format from the environment variables. Wrong values are logged and replaced by the default one
+*/
+func newXlsxFormat(configService helpers.IConfigService) *xlsxFormat {
+	format := &xlsxFormat{
+		sheetName: "Sheet1",
+	}
+
+	if sheetName := configService.GetEnvVar(models.XLSX_SHEET_NAME); sheetName != "" {
+		if utf8.RuneCountInString(sheetName) > xlsxMaxSheetName || strings.ContainsAny(sheetName, `[]:*?/\`) || strings.HasPrefix(sheetName, "'") {
+			log.Errorf("The XLSX_SHEET_NAME parameter %q must have at most %d characters, without []:*?/\\ and not starting by a quote. Sheet name is set to %s", sheetName, xlsxMaxSheetName, format.sheetName)
+		} else {
+			format.sheetName = sheetName
+		}
+	}
+	return format
+}
+
+/*
+Write the rows in an Excel workbook, streamed in a zip archive. Each sheet starts with a header row of the column names.
+When a sheet is full, the next rows are written in a new sheet.
+Numbers and booleans are written as typed cells, TIMESTAMP (in UTC), DATETIME, DATE and TIME as dates formatted cells and
+the others as strings. RECORD and REPEATED fields are written as JSON strings
+*/
+type xlsxWriter struct {
+	rowWriter
+	zipWriter  *zip.Writer
+	format     *xlsxFormat
+	maxRows    int
+	schema     bigquery.Schema
+	sheetNames []string
+	sheet      io.Writer
+	sheetRows  int
+}
+
+func newXlsxWriter(writer io.Writer, format *xlsxFormat) *xlsxWriter {
+	return &xlsxWriter{
+		zipWriter: zip.NewWriter(writer),
+		format:    format,
+		maxRows:   xlsxMaxRows,
+	}
+}
+
+func (this *xlsxWriter) writeHeader(schema bigquery.Schema) error {
+	this.schema = schema
+	return this.newSheet()
+}
+
+func (this *xlsxWriter) writeRow(values []bigquery.Value) error {
+	if len(values) != len(this.schema) {
+		return fmt.Errorf("the record has %d values for %d fields in the schema", len(values), len(this.schema))
+	}
+	if this.sheetRows >= this.maxRows {
+		if err := this.closeSheet(); err != nil {
+			return err
+		}
+		if err := this.newSheet(); err != nil {
+			return err
+		}
+	}
+	buffer := bytes.Buffer{}
+	this.sheetRows++
+	fmt.Fprintf(&buffer, `<row r="%d">`, this.sheetRows)
+	for i, schemaField := range this.schema {
+		if err := appendXlsxCell(&buffer, xlsxCellReference(i, this.sheetRows), schemaField, values[i]); err != nil {
+			return err
+		}
+	}
+	buffer.WriteString("</row>")
+	_, err := this.sheet.Write(buffer.Bytes())
+	return err
+}
+
+/*
+End the last sheet and write the workbook parts which list the sheets
+*/
+func (this *xlsxWriter) close() error {
+	if err := this.closeSheet(); err != nil {
+		return err
+	}
+
+	contentTypes := bytes.Buffer{}
+	contentTypes.WriteString(xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>`)
+	workbook := bytes.Buffer{}
+	workbook.WriteString(xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets>`)
+	workbookRels := bytes.Buffer{}
+	workbookRels.WriteString(xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rIdStyles" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`)
+	for i, sheetName := range this.sheetNames {
+		fmt.Fprintf(&contentTypes, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, i+1)
+		fmt.Fprintf(&workbook, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(sheetName), i+1, i+1)
+		fmt.Fprintf(&workbookRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, i+1, i+1)
+	}
+	contentTypes.WriteString(`</Types>`)
+	workbook.WriteString(`</sheets></workbook>`)
+	workbookRels.WriteString(`</Relationships>`)
+
+	parts := []struct {
+		name    string
+		content []byte
+	}{
+		{"[Content_Types].xml", contentTypes.Bytes()},
+		{"_rels/.rels", []byte(xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`)},
+		{"xl/workbook.xml", workbook.Bytes()},
+		{"xl/_rels/workbook.xml.rels", workbookRels.Bytes()},
+		{"xl/styles.xml", []byte(xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<numFmts count="2"><numFmt numFmtId="164" formatCode="yyyy-mm-dd hh:mm:ss"/><numFmt numFmtId="165" formatCode="hh:mm:ss"/></numFmts>` +
+			`<fonts count="1"><font><sz val="11"/><name val="Calibri"/></font></fonts>` +
+			`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+			`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+			`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+			`<cellXfs count="4"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+			`<xf numFmtId="14" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+			`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+			`<xf numFmtId="165" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/></cellXfs>` +
+			`</styleSheet>`)},
+	}
+	for _, part := range parts {
+		partWriter, err := this.zipWriter.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err = partWriter.Write(part.content); err != nil {
+			return err
+		}
+	}
+	return this.zipWriter.Close()
+}
+
+/*
+Start a new sheet with the header row. The sheet content is written directly in the archive
+*/
+func (this *xlsxWriter) newSheet() (err error) {
+	this.sheetNames = append(this.sheetNames, xlsxSheetName(this.format.sheetName, len(this.sheetNames)+1))
+	if this.sheet, err = this.zipWriter.Create(fmt.Sprintf("xl/worksheets/sheet%d.xml", len(this.sheetNames))); err != nil {
+		return
+	}
+	buffer := bytes.Buffer{}
+	buffer.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	buffer.WriteString(`<row r="1">`)
+	for i, schemaField := range this.schema {
+		appendXlsxString(&buffer, xlsxCellReference(i, 1), schemaField.Name)
+	}
+	buffer.WriteString("</row>")
+	this.sheetRows = 1
+	_, err = this.sheet.Write(buffer.Bytes())
+	return
+}
+
+func (this *xlsxWriter) closeSheet() error {
+	_, err := this.sheet.Write([]byte(`</sheetData></worksheet>`))
+	return err
+}
+
+/*
+Name of the sheet of this number. The next sheets are suffixed by their number, the name is cut to fit the length limit
+*/
+func xlsxSheetName(sheetName string, number int) string {
+	if number == 1 {
+		return sheetName
+	}
+	suffix := fmt.Sprintf(" (%d)", number)
+	if runes := []rune(sheetName); len(runes)+len(suffix) > xlsxMaxSheetName {
+		sheetName = string(runes[:xlsxMaxSheetName-len(suffix)])
+	}
+	return sheetName + suffix
+}
+
+/*
+Reference of the cell in the A1 style, with the column index starting at 0 and the row at 1
+*/
+func xlsxCellReference(column int, row int) string {
+	letters := ""
+	for column++; column > 0; column = (column - 1) / 26 {
+		letters = string(rune('A'+(column-1)%26)) + letters
+	}
+	return letters + strconv.Itoa(row)
+}
+
+/*
+Append a typed cell. Null values are empty cells, which are omitted. Fails if a text is longer than the Excel limit
+*/
+func appendXlsxCell(buffer *bytes.Buffer, reference string, schemaField *bigquery.FieldSchema, value bigquery.Value) error {
+	if value == nil {
+		return nil
+	}
+	if schemaField.Repeated || schemaField.Type == bigquery.RecordFieldType {
+		jsonValue := bytes.Buffer{}
+		if err := appendJsonField(&jsonValue, schemaField, value); err != nil {
+			return err
+		}
+		return appendXlsxText(buffer, reference, schemaField, jsonValue.String())
+	}
+	switch typedValue := value.(type) {
+	case int64:
+		appendXlsxNumber(buffer, reference, 0, strconv.FormatInt(typedValue, 10))
+	case float64:
+		if math.IsNaN(typedValue) || math.IsInf(typedValue, 0) {
+			return appendXlsxText(buffer, reference, schemaField, formatNonFiniteFloat(typedValue))
+		} else {
+			appendXlsxNumber(buffer, reference, 0, strconv.FormatFloat(typedValue, 'g', -1, 64))
+		}
+	case *big.Rat:
+		appendXlsxNumber(buffer, reference, 0, formatRat(typedValue, bigquery.NumericScaleDigits))
+	case bool:
+		boolValue := "0"
+		if typedValue {
+			boolValue = "1"
+		}
+		fmt.Fprintf(buffer, `<c r="%s" t="b"><v>%s</v></c>`, reference, boolValue)
+	case time.Time:
+		appendXlsxNumber(buffer, reference, xlsxStyleDateTime, xlsxSerial(typedValue.UTC()))
+	case civil.DateTime:
+		appendXlsxNumber(buffer, reference, xlsxStyleDateTime, xlsxSerial(typedValue.In(time.UTC)))
+	case civil.Date:
+		appendXlsxNumber(buffer, reference, xlsxStyleDate, xlsxSerial(typedValue.In(time.UTC)))
+	case civil.Time:
+		appendXlsxNumber(buffer, reference, xlsxStyleTime, xlsxSerial(civil.DateTime{Date: civil.DateOf(xlsxEpoch), Time: typedValue}.In(time.UTC)))
+	case []byte:
+		return appendXlsxText(buffer, reference, schemaField, base64.StdEncoding.EncodeToString(typedValue))
+	case string:
+		return appendXlsxText(buffer, reference, schemaField, typedValue)
+	default:
+		return fmt.Errorf("the field %q of type %s has a %T value", schemaField.Name, schemaField.Type, value)
+	}
+	return nil
+}
+
+func appendXlsxNumber(buffer *bytes.Buffer, reference string, style int, number string) {
+	if style == 0 {
+		fmt.Fprintf(buffer, `<c r="%s"><v>%s</v></c>`, reference, number)
+	} else {
+		fmt.Fprintf(buffer, `<c r="%s" s="%d"><v>%s</v></c>`, reference, style, number)
+	}
+}
+
+/*
+Append the text of the field as a string cell, if it fits the Excel limit
+*/
+func appendXlsxText(buffer *bytes.Buffer, reference string, schemaField *bigquery.FieldSchema, text string) error {
+	if length := len(utf16.Encode([]rune(text))); length > xlsxMaxCellText {
+		return fmt.Errorf("the value of the field %q in the cell %s has %d characters, more than the %d characters of an Excel cell", schemaField.Name, reference, length, xlsxMaxCellText)
+	}
+	appendXlsxString(buffer, reference, text)
+	return nil
+}
+
+/*
+Append an inline string cell. The leading zeros and spaces are kept
+*/
+func appendXlsxString(buffer *bytes.Buffer, reference string, text string) {
+	fmt.Fprintf(buffer, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`, reference, xmlEscape(text))
+}
+
+/*
+Excel serial of the time: the number of days since the Excel epoch, with the time of day as fraction
+*/
+func xlsxSerial(date time.Time) string {
+	//Computed on the Unix seconds, a time.Duration overflows after 292 years
+	days := float64(date.Unix()-xlsxEpoch.Unix())/float64(24*time.Hour/time.Second) + float64(date.Nanosecond())/float64(24*time.Hour)
+	return strconv.FormatFloat(days, 'f', -1, 64)
+}
+
+func xmlEscape(text string) string {
+	buffer := bytes.Buffer{}
+	xml.EscapeText(&buffer, []byte(text))
+	return buffer.String()
+}
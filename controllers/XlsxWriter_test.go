@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bqToFtp/models"
+	"bytes"
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Read the parts of the archive by name
+*/
+func readXlsxParts(t *testing.T, content []byte) map[string]string {
+	zipReader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatalf("xlsxWriter wrote an unreadable archive with error %v", err)
+	}
+	parts := make(map[string]string)
+	for _, file := range zipReader.File {
+		reader, _ := file.Open()
+		content, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		parts[file.Name] = string(content)
+	}
+	return parts
+}
+
+func Test_xlsxWriter(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxRows     int
+		rowIterator *DummyRowIterator
+		wantSheets  map[string]string
+		wantNames   []string
+		wantErr     bool
+	}{
+		{
+			name:        "Typed cells",
+			maxRows:     xlsxMaxRows,
+			rowIterator: createNestedBqRow(),
+			wantSheets: map[string]string{
+				"xl/worksheets/sheet1.xml": `<row r="2"><c r="A2"><v>1</v></c><c r="B2"><v>1.5</v></c><c r="C2" s="2"><v>43617.416666666664</v></c>` +
+					`<c r="D2" s="1"><v>43617</v></c><c r="E2" t="inlineStr"><is><t xml:space="preserve">[&#34;a&#34;,&#34;b&#34;]</t></is></c>`,
+			},
+			wantNames: []string{"Sheet1"},
+		},
+		{
+			name:    "Leading zeros, booleans and times",
+			maxRows: xlsxMaxRows,
+			rowIterator: &DummyRowIterator{
+				Row: [][]bigquery.Value{
+					{"007", true, civil.Time{Hour: 12}},
+				},
+				Schema: bigquery.Schema{
+					{Name: "code", Type: bigquery.StringFieldType},
+					{Name: "ok", Type: bigquery.BooleanFieldType},
+					{Name: "at", Type: bigquery.TimeFieldType},
+				},
+			},
+			wantSheets: map[string]string{
+				"xl/worksheets/sheet1.xml": `<row r="2"><c r="A2" t="inlineStr"><is><t xml:space="preserve">007</t></is></c>` +
+					`<c r="B2" t="b"><v>1</v></c><c r="C2" s="3"><v>0.5</v></c></row>`,
+			},
+			wantNames: []string{"Sheet1"},
+		},
+		{
+			name:    "Sheet rollover",
+			maxRows: 2,
+			rowIterator: &DummyRowIterator{
+				Row: [][]bigquery.Value{
+					{"1", "a", "b"},
+					{"2", "c", "d"},
+					{"3", "e", "f"},
+				},
+			},
+			wantSheets: map[string]string{
+				"xl/worksheets/sheet1.xml": `<row r="2"><c r="A2" t="inlineStr"><is><t xml:space="preserve">1</t></is></c>`,
+				"xl/worksheets/sheet2.xml": `<row r="1"><c r="A1" t="inlineStr"><is><t xml:space="preserve">id</t></is></c>`,
+				"xl/worksheets/sheet3.xml": `<row r="2"><c r="A2" t="inlineStr"><is><t xml:space="preserve">3</t></is></c>`,
+			},
+			wantNames: []string{"Sheet1", "Sheet1 (2)", "Sheet1 (3)"},
+		},
+		{
+			name:    "Text at the cell limit",
+			maxRows: xlsxMaxRows,
+			rowIterator: &DummyRowIterator{
+				Row: [][]bigquery.Value{
+					{"1", strings.Repeat("a", xlsxMaxCellText), "b"},
+				},
+			},
+			wantSheets: map[string]string{
+				"xl/worksheets/sheet1.xml": `<c r="B2" t="inlineStr"><is><t xml:space="preserve">` + strings.Repeat("a", xlsxMaxCellText) + `</t>`,
+			},
+			wantNames: []string{"Sheet1"},
+		},
+		{
+			//An emoji is 2 UTF-16 characters in Excel
+			name:    "Text longer than the cell limit",
+			maxRows: xlsxMaxRows,
+			rowIterator: &DummyRowIterator{
+				Row: [][]bigquery.Value{
+					{"1", strings.Repeat("😀", xlsxMaxCellText/2+1), "b"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "Wrong value",
+			maxRows: xlsxMaxRows,
+			rowIterator: &DummyRowIterator{
+				Row: [][]bigquery.Value{
+					{time.Duration(1), "a", "b"},
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := bytes.Buffer{}
+			writer := newXlsxWriter(&buffer, &xlsxFormat{sheetName: "Sheet1"})
+			writer.maxRows = tt.maxRows
+			err := createFile(writer, tt.rowIterator)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("xlsxWriter error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			parts := readXlsxParts(t, buffer.Bytes())
+			for _, part := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/styles.xml"} {
+				if _, ok := parts[part]; !ok {
+					t.Errorf("xlsxWriter archive misses the part %s", part)
+				}
+			}
+			for name, want := range tt.wantSheets {
+				if !strings.Contains(parts[name], want) {
+					t.Errorf("xlsxWriter sheet %s = %s, want %s", name, parts[name], want)
+				}
+			}
+			for i, sheetName := range tt.wantNames {
+				if want := `<sheet name="` + sheetName + `" sheetId="` + string(rune('1'+i)); !strings.Contains(parts["xl/workbook.xml"], want) {
+					t.Errorf("xlsxWriter workbook = %s, want %s", parts["xl/workbook.xml"], want)
+				}
+			}
+		})
+	}
+}
+
+func Test_xlsxCellReference(t *testing.T) {
+	tests := []struct {
+		column int
+		row    int
+		want   string
+	}{
+		{column: 0, row: 1, want: "A1"},
+		{column: 25, row: 2, want: "Z2"},
+		{column: 26, row: 3, want: "AA3"},
+		{column: 16383, row: 1048576, want: "XFD1048576"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := xlsxCellReference(tt.column, tt.row); got != tt.want {
+				t.Errorf("xlsxCellReference() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_xlsxSheetName(t *testing.T) {
+	tests := []struct {
+		name      string
+		sheetName string
+		number    int
+		want      string
+	}{
+		{name: "First sheet", sheetName: "Export", number: 1, want: "Export"},
+		{name: "Next sheet", sheetName: "Export", number: 2, want: "Export (2)"},
+		{name: "Cut name", sheetName: "abcdefghijklmnopqrstuvwxyz01234", number: 10, want: "abcdefghijklmnopqrstuvwxyz (10)"},
+		{name: "Cut non-ASCII name", sheetName: strings.Repeat("é", 31), number: 2, want: strings.Repeat("é", 27) + " (2)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := xlsxSheetName(tt.sheetName, tt.number); got != tt.want {
+				t.Errorf("xlsxSheetName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_newXlsxFormat(t *testing.T) {
+	tests := []struct {
+		name          string
+		sheetName     string
+		wantSheetName string
+	}{
+		{name: "Default name", wantSheetName: "Sheet1"},
+		{name: "Non-ASCII name", sheetName: strings.Repeat("é", 31), wantSheetName: strings.Repeat("é", 31)},
+		{name: "Too long name", sheetName: strings.Repeat("é", 32), wantSheetName: "Sheet1"},
+		{name: "Forbidden character", sheetName: "a/b", wantSheetName: "Sheet1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newXlsxFormat(mapConfigService{models.XLSX_SHEET_NAME: tt.sheetName})
+			if got.sheetName != tt.wantSheetName {
+				t.Errorf("newXlsxFormat() sheet name = %q, want %q", got.sheetName, tt.wantSheetName)
+			}
+		})
+	}
+}
@@ -34,3 +34,22 @@ func (this *BergasOrOsEnvVarConfigService) GetEnvVar(enum EnvVarEnum) string {
 	}
 	return varEnv
 }
+
+/*
+Config service of a named part of the configuration, like a destination. The variables are read with the prefix, like
+PARTNER_FTP_SERVER for FTP_SERVER with the PARTNER_ prefix. The shared variables are read without prefix
+*/
+type PrefixedConfigService struct {
+	IConfigService
+	Prefix string
+	Shared []EnvVarEnum
+}
+
+func (this *PrefixedConfigService) GetEnvVar(enum EnvVarEnum) string {
+	for _, shared := range this.Shared {
+		if enum == shared {
+			return this.IConfigService.GetEnvVar(enum)
+		}
+	}
+	return this.IConfigService.GetEnvVar(EnvVarEnum(this.Prefix) + enum)
+}
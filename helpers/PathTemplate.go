@@ -0,0 +1,16 @@
+package helpers
+
+import "strings"
+
+/*
+Split a path template, like /exports/{{.Year}}/{{.Month}}, in its static directories, /exports/, and its templated
+part, {{.Year}}/{{.Month}}. The templated part is empty if the path has no template action
+*/
+func SplitPathTemplate(path string) (staticPath string, templatePath string) {
+	action := strings.Index(path, "{{")
+	if action < 0 {
+		return path, ""
+	}
+	directoryEnd := strings.LastIndex(path[:action], "/") + 1
+	return path[:directoryEnd], path[directoryEnd:]
+}
@@ -7,9 +7,14 @@ import (
 const (
 	QUERY_FILE_PATH helpers.EnvVarEnum = "QUERY_FILE_PATH"
 	FORCE_RELOAD    helpers.EnvVarEnum = "FORCE_RELOAD"
+	OUTPUT_FORMAT   helpers.EnvVarEnum = "OUTPUT_FORMAT"
 	HEADER          helpers.EnvVarEnum = "HEADER"
 	GCP_PROJECT     helpers.EnvVarEnum = "GCP_PROJECT"
 	SEPARATOR       helpers.EnvVarEnum = "SEPARATOR"
+	QUOTE_CHAR      helpers.EnvVarEnum = "QUOTE_CHAR"
+	QUOTE_POLICY    helpers.EnvVarEnum = "QUOTE_POLICY"
+	ESCAPE_STYLE    helpers.EnvVarEnum = "ESCAPE_STYLE"
+	LINE_TERMINATOR helpers.EnvVarEnum = "LINE_TERMINATOR"
 	FILE_PREFIX     helpers.EnvVarEnum = "FILE_PREFIX"
 	MINUTE_DELTA    helpers.EnvVarEnum = "MINUTE_DELTA"
 	LATENCY         helpers.EnvVarEnum = "LATENCY"
@@ -19,4 +24,95 @@ const (
 	FTP_LOGIN       helpers.EnvVarEnum = "FTP_LOGIN"
 	FTP_PASSWORD    helpers.EnvVarEnum = "FTP_PASSWORD"
 	FALLBACK_BUCKET helpers.EnvVarEnum = "FALLBACK_BUCKET"
+
+	FTP_PRIVATE_KEY            helpers.EnvVarEnum = "FTP_PRIVATE_KEY"
+	FTP_PRIVATE_KEY_PASSPHRASE helpers.EnvVarEnum = "FTP_PRIVATE_KEY_PASSPHRASE"
+	FTP_HOST_KEY               helpers.EnvVarEnum = "FTP_HOST_KEY"
+
+	FTP_TLS_MODE        helpers.EnvVarEnum = "FTP_TLS_MODE"
+	FTP_TLS_CA          helpers.EnvVarEnum = "FTP_TLS_CA"
+	FTP_TLS_CLIENT_CERT helpers.EnvVarEnum = "FTP_TLS_CLIENT_CERT"
+	FTP_TLS_CLIENT_KEY  helpers.EnvVarEnum = "FTP_TLS_CLIENT_KEY"
+	FTP_TLS_MIN_VERSION helpers.EnvVarEnum = "FTP_TLS_MIN_VERSION"
+	FTP_TLS_SKIP_VERIFY helpers.EnvVarEnum = "FTP_TLS_SKIP_VERIFY"
+
+	ATOMIC_UPLOAD      helpers.EnvVarEnum = "ATOMIC_UPLOAD"
+	UPLOAD_TEMP_PREFIX helpers.EnvVarEnum = "UPLOAD_TEMP_PREFIX"
+	UPLOAD_TEMP_SUFFIX helpers.EnvVarEnum = "UPLOAD_TEMP_SUFFIX"
+
+	FTP_CREATE_DIRECTORIES helpers.EnvVarEnum = "FTP_CREATE_DIRECTORIES"
+
+	DESTINATIONS     helpers.EnvVarEnum = "DESTINATIONS"
+	DELIVERY_POLICY  helpers.EnvVarEnum = "DELIVERY_POLICY"
+	SEND_ATTEMPTS    helpers.EnvVarEnum = "SEND_ATTEMPTS"
+	SEND_RETRY_DELAY helpers.EnvVarEnum = "SEND_RETRY_DELAY"
+
+	GCS_CREDENTIALS      helpers.EnvVarEnum = "GCS_CREDENTIALS"
+	GCS_OVERWRITE        helpers.EnvVarEnum = "GCS_OVERWRITE"
+	GCS_CONTENT_ENCODING helpers.EnvVarEnum = "GCS_CONTENT_ENCODING"
+
+	S3_ENDPOINT          helpers.EnvVarEnum = "S3_ENDPOINT"
+	S3_REGION            helpers.EnvVarEnum = "S3_REGION"
+	S3_ACCESS_KEY_ID     helpers.EnvVarEnum = "S3_ACCESS_KEY_ID"
+	S3_SECRET_ACCESS_KEY helpers.EnvVarEnum = "S3_SECRET_ACCESS_KEY"
+	S3_FORCE_PATH_STYLE  helpers.EnvVarEnum = "S3_FORCE_PATH_STYLE"
+	S3_PART_SIZE         helpers.EnvVarEnum = "S3_PART_SIZE"
+	S3_SSE               helpers.EnvVarEnum = "S3_SSE"
+	S3_SSE_KMS_KEY_ID    helpers.EnvVarEnum = "S3_SSE_KMS_KEY_ID"
+
+	PARQUET_COMPRESSION    helpers.EnvVarEnum = "PARQUET_COMPRESSION"
+	PARQUET_ROW_GROUP_SIZE helpers.EnvVarEnum = "PARQUET_ROW_GROUP_SIZE"
+
+	AVRO_COMPRESSION helpers.EnvVarEnum = "AVRO_COMPRESSION"
+
+	XLSX_SHEET_NAME helpers.EnvVarEnum = "XLSX_SHEET_NAME"
+
+	FIXED_WIDTH_LAYOUT helpers.EnvVarEnum = "FIXED_WIDTH_LAYOUT"
+
+	COLUMN_MAPPING helpers.EnvVarEnum = "COLUMN_MAPPING"
+
+	COLUMN_TRANSFORMS helpers.EnvVarEnum = "COLUMN_TRANSFORMS"
+	PII_HASH_KEY      helpers.EnvVarEnum = "PII_HASH_KEY"
+
+	TIMESTAMP_FORMAT  helpers.EnvVarEnum = "TIMESTAMP_FORMAT"
+	TIMEZONE          helpers.EnvVarEnum = "TIMEZONE"
+	DATE_FORMAT       helpers.EnvVarEnum = "DATE_FORMAT"
+	DECIMAL_PRECISION helpers.EnvVarEnum = "DECIMAL_PRECISION"
+	DECIMAL_SEPARATOR helpers.EnvVarEnum = "DECIMAL_SEPARATOR"
+	BOOLEAN_TRUE      helpers.EnvVarEnum = "BOOLEAN_TRUE"
+	BOOLEAN_FALSE     helpers.EnvVarEnum = "BOOLEAN_FALSE"
+	NULL_VALUE        helpers.EnvVarEnum = "NULL_VALUE"
+	COMPLEX_FORMAT    helpers.EnvVarEnum = "COMPLEX_FORMAT"
+	COMPLEX_SEPARATOR helpers.EnvVarEnum = "COMPLEX_SEPARATOR"
+
+	ENCODING         helpers.EnvVarEnum = "ENCODING"
+	ENCODING_BOM     helpers.EnvVarEnum = "ENCODING_BOM"
+	UNMAPPABLE_CHARS helpers.EnvVarEnum = "UNMAPPABLE_CHARS"
+
+	COMPRESSION       helpers.EnvVarEnum = "COMPRESSION"
+	COMPRESSION_LEVEL helpers.EnvVarEnum = "COMPRESSION_LEVEL"
+
+	PGP_PUBLIC_KEYS            helpers.EnvVarEnum = "PGP_PUBLIC_KEYS"
+	PGP_SIGNING_KEY            helpers.EnvVarEnum = "PGP_SIGNING_KEY"
+	PGP_SIGNING_KEY_PASSPHRASE helpers.EnvVarEnum = "PGP_SIGNING_KEY_PASSPHRASE"
+
+	CHECKSUM helpers.EnvVarEnum = "CHECKSUM"
+	MANIFEST helpers.EnvVarEnum = "MANIFEST"
+
+	HEADER_TEMPLATE  helpers.EnvVarEnum = "HEADER_TEMPLATE"
+	TRAILER_TEMPLATE helpers.EnvVarEnum = "TRAILER_TEMPLATE"
+	MARKER_SUFFIX    helpers.EnvVarEnum = "MARKER_SUFFIX"
+
+	FILE_NAME_TEMPLATE helpers.EnvVarEnum = "FILE_NAME_TEMPLATE"
+	FILE_NAME_TIMEZONE helpers.EnvVarEnum = "FILE_NAME_TIMEZONE"
+	JOB_NAME           helpers.EnvVarEnum = "JOB_NAME"
+
+	SPLIT_MAX_ROWS  helpers.EnvVarEnum = "SPLIT_MAX_ROWS"
+	SPLIT_MAX_BYTES helpers.EnvVarEnum = "SPLIT_MAX_BYTES"
+
+	PARTITION_COLUMN      helpers.EnvVarEnum = "PARTITION_COLUMN"
+	PARTITION_DIRECTORY   helpers.EnvVarEnum = "PARTITION_DIRECTORY"
+	PARTITION_DROP_COLUMN helpers.EnvVarEnum = "PARTITION_DROP_COLUMN"
+	PARTITION_SORTED      helpers.EnvVarEnum = "PARTITION_SORTED"
+	PARTITION_MAX_OPEN    helpers.EnvVarEnum = "PARTITION_MAX_OPEN"
 )
@@ -0,0 +1,13 @@
+package models
+
+import (
+	"time"
+)
+
+/*
+Time window of the query, between the START_TIMESTAMP and the END_TIMESTAMP
+*/
+type QueryWindow struct {
+	Start time.Time
+	End   time.Time
+}
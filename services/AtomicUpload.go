@@ -0,0 +1,72 @@
+package services
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	log "github.com/sirupsen/logrus"
+	"path"
+	"strconv"
+)
+
+const defaultUploadTempSuffix = ".part"
+
+/*
+Upload of the files under a temporary name, renamed to the final name only when the transfer is complete. The pollers
+of the partners never see a half-written file:
+  - enabled: false to upload directly under the final name
+  - prefix and suffix: added to the base name of the file for the temporary name. .part suffix by default
+*/
+type atomicUpload struct {
+	enabled bool
+	prefix  string
+	suffix  string
+}
+
+/*
+Load the atomic upload from the environment variables. Fatal if ATOMIC_UPLOAD isn't a Boolean
+*/
+func newAtomicUpload(configService helpers.IConfigService) atomicUpload {
+	upload := atomicUpload{
+		enabled: true,
+		prefix:  configService.GetEnvVar(models.UPLOAD_TEMP_PREFIX),
+		suffix:  configService.GetEnvVar(models.UPLOAD_TEMP_SUFFIX),
+	}
+	if enabled := configService.GetEnvVar(models.ATOMIC_UPLOAD); enabled != "" {
+		var err error
+		if upload.enabled, err = strconv.ParseBool(enabled); err != nil {
+			log.Fatalf("Impossible to convert to Boolean the ATOMIC_UPLOAD parameter %q", enabled)
+		}
+	}
+	if upload.prefix == "" && upload.suffix == "" {
+		upload.suffix = defaultUploadTempSuffix
+	}
+	return upload
+}
+
+/*
+Name of the file during the upload. The prefix is added to the base name, the file stays in its directory
+*/
+func (this atomicUpload) tempName(name string) string {
+	if !this.enabled {
+		return name
+	}
+	directory, base := path.Split(name)
+	return directory + this.prefix + base + this.suffix
+}
+
+/*
+Store the file under its temporary name, then rename it to its final name. The partial file is deleted if the transfer
+or the rename fails, a retry starts from a clean destination
+*/
+func (this atomicUpload) store(name string, store func(name string) error, rename func(from string, to string) error, remove func(name string) error) (err error) {
+	tempName := this.tempName(name)
+	if err = store(tempName); err == nil && tempName != name {
+		err = rename(tempName, name)
+	}
+	if err != nil {
+		if removeErr := remove(tempName); removeErr != nil {
+			log.Warningf("Impossible to delete the partial file %q with error %v", tempName, removeErr)
+		}
+	}
+	return
+}
@@ -0,0 +1,119 @@
+package services
+
+import (
+	"bqToFtp/models"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func Test_atomicUpload_tempName(t *testing.T) {
+	tests := []struct {
+		name   string
+		config mapConfigService
+		file   string
+		want   string
+	}{
+		{
+			name:   "Default suffix",
+			config: mapConfigService{},
+			file:   "/exports/file.csv",
+			want:   "/exports/file.csv.part",
+		},
+		{
+			name: "Prefix on the base name",
+			config: mapConfigService{
+				models.UPLOAD_TEMP_PREFIX: "tmp_",
+			},
+			file: "/exports/FR/file.csv",
+			want: "/exports/FR/tmp_file.csv",
+		},
+		{
+			name: "Prefix and suffix",
+			config: mapConfigService{
+				models.UPLOAD_TEMP_PREFIX: ".",
+				models.UPLOAD_TEMP_SUFFIX: ".tmp",
+			},
+			file: "/file.csv",
+			want: "/.file.csv.tmp",
+		},
+		{
+			name: "Disabled",
+			config: mapConfigService{
+				models.ATOMIC_UPLOAD: "false",
+			},
+			file: "/file.csv",
+			want: "/file.csv",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newAtomicUpload(tt.config).tempName(tt.file); got != tt.want {
+				t.Errorf("atomicUpload.tempName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_atomicUpload_store(t *testing.T) {
+	failure := errors.New("failure")
+	tests := []struct {
+		name      string
+		upload    atomicUpload
+		storeErr  error
+		renameErr error
+		wantCalls []string
+		wantErr   bool
+	}{
+		{
+			name:      "Stored then renamed",
+			upload:    atomicUpload{enabled: true, suffix: ".part"},
+			wantCalls: []string{"store /file.csv.part", "rename /file.csv.part /file.csv"},
+		},
+		{
+			name:      "Partial file deleted",
+			upload:    atomicUpload{enabled: true, suffix: ".part"},
+			storeErr:  failure,
+			wantCalls: []string{"store /file.csv.part", "remove /file.csv.part"},
+			wantErr:   true,
+		},
+		{
+			name:      "Rename failure",
+			upload:    atomicUpload{enabled: true, suffix: ".part"},
+			renameErr: failure,
+			wantCalls: []string{"store /file.csv.part", "rename /file.csv.part /file.csv", "remove /file.csv.part"},
+			wantErr:   true,
+		},
+		{
+			name:      "Direct upload",
+			upload:    atomicUpload{},
+			storeErr:  failure,
+			wantCalls: []string{"store /file.csv", "remove /file.csv"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			err := tt.upload.store("/file.csv",
+				func(name string) error {
+					calls = append(calls, "store "+name)
+					return tt.storeErr
+				},
+				func(from string, to string) error {
+					calls = append(calls, "rename "+from+" "+to)
+					return tt.renameErr
+				},
+				func(name string) error {
+					calls = append(calls, "remove "+name)
+					return nil
+				})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("atomicUpload.store() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(calls, tt.wantCalls) {
+				t.Errorf("atomicUpload.store() calls = %v, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
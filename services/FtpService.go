@@ -3,21 +3,70 @@ package services
 import (
 	"bqToFtp/helpers"
 	"bqToFtp/models"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	ftp "github.com/secsy/goftp"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"net"
+	"path"
+	"strconv"
 	"strings"
 )
 
+const (
+	tlsModeNone     = "NONE"
+	tlsModeExplicit = "EXPLICIT"
+	tlsModeImplicit = "IMPLICIT"
+
+	implicitTlsPort = "990"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
 type IFTPService interface {
 	Send(name string, src io.Reader) (err error)
 }
 
+/*
+Destination which stores metadata with the files, like the object metadata of Cloud Storage. The metadata are set by the
+upload, the file never exists without them
+*/
+type IMetadataService interface {
+	SendWithMetadata(name string, src io.Reader, metadata map[string]string) (err error)
+}
+
 type ftpService struct {
 	IBigQueryService
-	config ftp.Config
-	host   string
-	path   string
+	config            ftp.Config
+	host              string
+	path              string
+	upload            atomicUpload
+	createDirectories bool
+}
+
+/*
+Create the service which sends the file according with the scheme of the FTP_SERVER: sftp:// for SFTP, gs:// for
+Cloud Storage, s3:// for S3 compatible storages, else FTP
+*/
+func NewDestinationService(configService helpers.IConfigService) IFTPService {
+	server := strings.ToLower(configService.GetEnvVar(models.FTP_SERVER))
+	switch {
+	case strings.HasPrefix(server, sftpScheme):
+		return NewSftpService(configService)
+	case strings.HasPrefix(server, gcsScheme):
+		return NewGcsService(configService)
+	case strings.HasPrefix(server, s3Scheme):
+		return NewS3Service(configService)
+	}
+	return NewFtpService(configService)
 }
 
 func NewFtpService(configService helpers.IConfigService) *ftpService {
@@ -34,11 +83,121 @@ func NewFtpService(configService helpers.IConfigService) *ftpService {
 		Password: configService.GetEnvVar(models.FTP_PASSWORD),
 	}
 
-	this.path = formatFtpPath(configService.GetEnvVar(models.FTP_PATH))
+	tlsMode := strings.ToUpper(configService.GetEnvVar(models.FTP_TLS_MODE))
+	switch tlsMode {
+	case "", tlsModeNone:
+	case tlsModeExplicit, tlsModeImplicit:
+		tlsConfig, err := newTlsConfig(configService, this.host)
+		if err != nil {
+			log.Fatalf("Impossible to load the FTPS configuration with error %v", err)
+		}
+		this.config.TLSConfig = tlsConfig
+		this.config.TLSMode = ftp.TLSExplicit
+		if tlsMode == tlsModeImplicit {
+			this.config.TLSMode = ftp.TLSImplicit
+			//The implicit FTPS has its own port
+			if _, _, err := net.SplitHostPort(this.host); err != nil {
+				this.host = net.JoinHostPort(strings.Trim(this.host, "[]"), implicitTlsPort)
+			}
+		}
+	default:
+		log.Fatalf("Unknown FTP_TLS_MODE %q. Allowed values are NONE, EXPLICIT or IMPLICIT", tlsMode)
+	}
+
+	this.path = formatFtpPath(staticFtpPath(configService))
+	this.upload = newAtomicUpload(configService)
+	this.createDirectories = loadCreateDirectories(configService)
 
 	return this
 }
 
+/*
+Build the TLS configuration for FTPS. The CA bundle, the client certificate and its key are PEM content, and can be
+loaded by Berglas. Without CA bundle, the system root CAs are used.
+The TLS session of the control connection is reused by the data connections, as required by most of the servers
+*/
+func newTlsConfig(configService helpers.IConfigService, host string) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{
+		ServerName:         host,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if hostname, _, splitErr := net.SplitHostPort(host); splitErr == nil {
+		tlsConfig.ServerName = hostname
+	}
+
+	if caBundle := configService.GetEnvVar(models.FTP_TLS_CA); caBundle != "" {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM([]byte(caBundle)) {
+			return nil, errors.New("no certificate found in the FTP_TLS_CA bundle")
+		}
+	}
+
+	clientCert := configService.GetEnvVar(models.FTP_TLS_CLIENT_CERT)
+	clientKey := configService.GetEnvVar(models.FTP_TLS_CLIENT_KEY)
+	if clientCert != "" || clientKey != "" {
+		certificate, err := tls.X509KeyPair([]byte(clientCert), []byte(clientKey))
+		if err != nil {
+			return nil, fmt.Errorf("impossible to load the client certificate with error %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	if minVersion := configService.GetEnvVar(models.FTP_TLS_MIN_VERSION); minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown FTP_TLS_MIN_VERSION %q. Allowed values are 1.0, 1.1, 1.2 or 1.3", minVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if skipVerify := configService.GetEnvVar(models.FTP_TLS_SKIP_VERIFY); skipVerify != "" {
+		tlsConfig.InsecureSkipVerify, err = strconv.ParseBool(skipVerify)
+		if err != nil {
+			return nil, fmt.Errorf("impossible to convert to Boolean the FTP_TLS_SKIP_VERIFY parameter %q", skipVerify)
+		}
+		if tlsConfig.InsecureSkipVerify {
+			log.Warning("The FTPS server certificate is not verified. Use it only for lab servers")
+		}
+	}
+	return
+}
+
+/*
+Directories of the FTP_PATH before its template part. The template part is rendered in the file names
+*/
+func staticFtpPath(configService helpers.IConfigService) string {
+	staticPath, _ := helpers.SplitPathTemplate(configService.GetEnvVar(models.FTP_PATH))
+	return staticPath
+}
+
+/*
+Load the creation of the missing directories. Fatal if FTP_CREATE_DIRECTORIES isn't a Boolean
+*/
+func loadCreateDirectories(configService helpers.IConfigService) (createDirectories bool) {
+	if create := configService.GetEnvVar(models.FTP_CREATE_DIRECTORIES); create != "" {
+		var err error
+		if createDirectories, err = strconv.ParseBool(create); err != nil {
+			log.Fatalf("Impossible to convert to Boolean the FTP_CREATE_DIRECTORIES parameter %q", create)
+		}
+	}
+	return
+}
+
+/*
+Directories of the path, from the root one, like /a and /a/b for /a/b
+*/
+func parentDirectories(directory string) (directories []string) {
+	for i, c := range directory {
+		if c == '/' && i > 0 {
+			directories = append(directories, directory[:i])
+		}
+	}
+	if directory != "/" && directory != "" {
+		directories = append(directories, strings.TrimSuffix(directory, "/"))
+	}
+	return
+}
+
 func formatFtpPath(path string) (formattedPath string) {
 
 	formattedPath = path
@@ -54,7 +213,24 @@ func formatFtpPath(path string) (formattedPath string) {
 
 func (this *ftpService) Send(name string, src io.Reader) (err error) {
 	client, err := ftp.DialConfig(this.config, this.host)
+	if err != nil {
+		return
+	}
 	//Close the connection at the end
 	defer client.Close()
-	return client.Store(this.path+name, src)
+
+	if this.createDirectories {
+		//MKD level by level, the existing directories fail. A real failure is reported by the store
+		for _, directory := range parentDirectories(path.Dir(this.path + name)) {
+			if _, mkdirErr := client.Mkdir(directory); mkdirErr != nil {
+				log.Debugf("Directory %q not created with error %v", directory, mkdirErr)
+			}
+		}
+	}
+	return this.upload.store(this.path+name,
+		func(name string) error {
+			return client.Store(name, src)
+		},
+		client.Rename,
+		client.Delete)
 }
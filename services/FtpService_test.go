@@ -1,6 +1,25 @@
 package services
 
-import "testing"
+import (
+	"bqToFtp/models"
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
 
 func Test_formatFtpPath(t *testing.T) {
 	type args struct {
@@ -48,3 +67,361 @@ func Test_formatFtpPath(t *testing.T) {
 		})
 	}
 }
+
+func Test_staticFtpPath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{
+			name: "Static path",
+			path: "/exports/daily",
+			want: "/exports/daily",
+		},
+		{
+			name: "Template directories",
+			path: "/exports/{{.Year}}/{{.Month}}",
+			want: "/exports/",
+		},
+		{
+			name: "Template in a directory name",
+			path: "/exports/daily_{{.Year}}",
+			want: "/exports/",
+		},
+		{
+			name: "Relative template",
+			path: "{{.Year}}",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := staticFtpPath(mapConfigService{models.FTP_PATH: tt.path}); got != tt.want {
+				t.Errorf("staticFtpPath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parentDirectories(t *testing.T) {
+	tests := []struct {
+		name      string
+		directory string
+		want      []string
+	}{
+		{
+			name:      "Root",
+			directory: "/",
+		},
+		{
+			name:      "Nested directories",
+			directory: "/exports/2019/06",
+			want:      []string{"/exports", "/exports/2019", "/exports/2019/06"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parentDirectories(tt.directory); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parentDirectories() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+/*
+Generate a self signed certificate and its key, in PEM format
+*/
+func generateCertificate(t *testing.T) (certificate string, key string) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ftp.example.com"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"ftp.example.com"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	key = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	return
+}
+
+func Test_newTlsConfig(t *testing.T) {
+	certificate, key := generateCertificate(t)
+
+	tests := []struct {
+		name     string
+		config   mapConfigService
+		host     string
+		wantFunc func(*tls.Config) bool
+		wantErr  bool
+	}{
+		{
+			name:   "Default configuration",
+			config: mapConfigService{},
+			host:   "ftp.example.com:990",
+			wantFunc: func(config *tls.Config) bool {
+				return config.ServerName == "ftp.example.com" && config.RootCAs == nil && !config.InsecureSkipVerify
+			},
+		},
+		{
+			name: "Custom CA bundle",
+			config: mapConfigService{
+				models.FTP_TLS_CA: certificate,
+			},
+			host: "ftp.example.com",
+			wantFunc: func(config *tls.Config) bool {
+				return config.ServerName == "ftp.example.com" && config.RootCAs != nil
+			},
+		},
+		{
+			name: "Wrong CA bundle",
+			config: mapConfigService{
+				models.FTP_TLS_CA: "not a certificate",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Client certificate",
+			config: mapConfigService{
+				models.FTP_TLS_CLIENT_CERT: certificate,
+				models.FTP_TLS_CLIENT_KEY:  key,
+			},
+			wantFunc: func(config *tls.Config) bool {
+				return len(config.Certificates) == 1
+			},
+		},
+		{
+			name: "Client certificate without key",
+			config: mapConfigService{
+				models.FTP_TLS_CLIENT_CERT: certificate,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Min version",
+			config: mapConfigService{
+				models.FTP_TLS_MIN_VERSION: "1.2",
+			},
+			wantFunc: func(config *tls.Config) bool {
+				return config.MinVersion == tls.VersionTLS12
+			},
+		},
+		{
+			name: "Unknown min version",
+			config: mapConfigService{
+				models.FTP_TLS_MIN_VERSION: "2.0",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Skip verify",
+			config: mapConfigService{
+				models.FTP_TLS_SKIP_VERIFY: "true",
+			},
+			wantFunc: func(config *tls.Config) bool {
+				return config.InsecureSkipVerify
+			},
+		},
+		{
+			name: "Wrong skip verify",
+			config: mapConfigService{
+				models.FTP_TLS_SKIP_VERIFY: "maybe",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newTlsConfig(tt.config, tt.host)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newTlsConfig() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && !tt.wantFunc(got) {
+				t.Errorf("newTlsConfig() = %+v, unexpected configuration", got)
+			}
+		})
+	}
+}
+
+/*
+Implicit FTPS server which requires the reuse of the TLS session of the control connection by the data connections,
+like vsftpd with require_ssl_reuse
+*/
+type testFtpsServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	mutex     sync.Mutex
+	files     map[string]string
+}
+
+func newTestFtpsServer(t *testing.T, certificate string, key string) *testFtpsServer {
+	keyPair, err := tls.X509KeyPair([]byte(certificate), []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	this := &testFtpsServer{
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{keyPair}},
+		files:     make(map[string]string),
+	}
+	if this.listener, err = tls.Listen("tcp", "127.0.0.1:0", this.tlsConfig); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := this.listener.Accept()
+			if err != nil {
+				return
+			}
+			go this.serve(conn)
+		}
+	}()
+	return this
+}
+
+func (this *testFtpsServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+	var dataListener net.Listener
+	reply("220 ready")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		switch strings.ToUpper(command[0]) {
+		case "USER":
+			reply("331 password required")
+		case "PASS":
+			reply("230 logged in")
+		case "TYPE":
+			reply("200 type set")
+		case "EPSV":
+			if dataListener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 no data connection")
+				continue
+			}
+			reply("229 Entering Extended Passive Mode (|||%d|)", dataListener.Addr().(*net.TCPAddr).Port)
+		case "STOR":
+			reply("150 ok to send data")
+			dataConn, err := dataListener.Accept()
+			dataListener.Close()
+			if err != nil {
+				reply("425 no data connection")
+				continue
+			}
+			tlsConn := tls.Server(dataConn, this.tlsConfig)
+			if err = tlsConn.Handshake(); err != nil || !tlsConn.ConnectionState().DidResume {
+				dataConn.Close()
+				reply("522 SSL connection failed: session reuse required")
+				continue
+			}
+			content, _ := ioutil.ReadAll(tlsConn)
+			tlsConn.Close()
+			this.mutex.Lock()
+			this.files[command[1]] = string(content)
+			this.mutex.Unlock()
+			reply("226 transfer complete")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
+
+func Test_ftpService_Send_implicitTls(t *testing.T) {
+	certificate, key := generateCertificate(t)
+	server := newTestFtpsServer(t, certificate, key)
+	defer server.listener.Close()
+
+	config := mapConfigService{
+		models.GCP_PROJECT:   "project",
+		models.FTP_SERVER:    server.listener.Addr().String(),
+		models.FTP_LOGIN:     "user",
+		models.FTP_PASSWORD:  "password",
+		models.FTP_TLS_MODE:  "IMPLICIT",
+		models.FTP_TLS_CA:    certificate,
+		models.ATOMIC_UPLOAD: "false",
+	}
+	ftpService := NewFtpService(config)
+	if err := ftpService.Send("export.csv", strings.NewReader("content")); err != nil {
+		t.Fatalf("ftpService.Send() error = %v", err)
+	}
+	server.mutex.Lock()
+	got := server.files["/export.csv"]
+	server.mutex.Unlock()
+	if got != "content" {
+		t.Errorf("ftpService.Send() content = %q, want %q", got, "content")
+	}
+
+	//Without the session cache, the server rejects the data connection
+	ftpService = NewFtpService(config)
+	ftpService.config.TLSConfig.ClientSessionCache = nil
+	if err := ftpService.Send("rejected.csv", strings.NewReader("content")); err == nil || !strings.Contains(err.Error(), "522") {
+		t.Errorf("ftpService.Send() without session reuse error = %v, want the 522 reply", err)
+	}
+}
+
+func Test_NewFtpService_implicitTlsPort(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   string
+		tlsMode  string
+		wantHost string
+	}{
+		{
+			name:     "Implicit TLS default port",
+			server:   "ftp.example.com",
+			tlsMode:  "IMPLICIT",
+			wantHost: "ftp.example.com:990",
+		},
+		{
+			name:     "Implicit TLS custom port",
+			server:   "ftp.example.com:2990",
+			tlsMode:  "IMPLICIT",
+			wantHost: "ftp.example.com:2990",
+		},
+		{
+			name:     "Explicit TLS",
+			server:   "ftp.example.com",
+			tlsMode:  "EXPLICIT",
+			wantHost: "ftp.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ftpService := NewFtpService(mapConfigService{
+				models.GCP_PROJECT:  "project",
+				models.FTP_SERVER:   tt.server,
+				models.FTP_TLS_MODE: tt.tlsMode,
+			})
+			if ftpService.host != tt.wantHost {
+				t.Errorf("NewFtpService() host = %q, want %q", ftpService.host, tt.wantHost)
+			}
+			if ftpService.config.TLSConfig.ClientSessionCache == nil {
+				t.Errorf("NewFtpService() without TLS session cache")
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"cloud.google.com/go/storage"
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const gcsScheme = "gs://"
+
+const defaultContentType = "application/octet-stream"
+
+/*
+Content types of the file extensions
+*/
+var contentTypes = map[string]string{
+	".csv":     "text/csv",
+	".txt":     "text/plain",
+	".jsonl":   "application/x-ndjson",
+	".json":    "application/json",
+	".parquet": "application/octet-stream",
+	".avro":    "application/avro",
+	".xlsx":    "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".gz":      "application/gzip",
+	".zst":     "application/zstd",
+	".zip":     "application/zip",
+	".pgp":     "application/pgp-encrypted",
+	".md5":     "text/plain",
+	".sha256":  "text/plain",
+}
+
+type gcsService struct {
+	IFTPService
+	bucket          *storage.BucketHandle
+	path            string
+	overwrite       bool
+	contentEncoding bool
+}
+
+/*
+Create a Cloud Storage service for the FTP_SERVER with the gs:// scheme, like gs://bucket. The objects are named by the
+FTP_PATH followed by the file name. The service account of the service is used, or the GCS_CREDENTIALS key
+*/
+func NewGcsService(configService helpers.IConfigService) *gcsService {
+	var options []option.ClientOption
+	if credentials := configService.GetEnvVar(models.GCS_CREDENTIALS); credentials != "" {
+		options = append(options, option.WithCredentialsJSON([]byte(credentials)))
+	}
+	return newGcsService(configService, options...)
+}
+
+func newGcsService(configService helpers.IConfigService, options ...option.ClientOption) *gcsService {
+	this := &gcsService{}
+
+	server := configService.GetEnvVar(models.FTP_SERVER)
+	bucketName := strings.TrimSuffix(server[len(gcsScheme):], "/")
+	if bucketName == "" || strings.Contains(bucketName, "/") {
+		log.Fatalf("Error reading environment variables. The ftp server %s must be a bucket like gs://bucket", server)
+	}
+
+	client, err := storage.NewClient(context.Background(), options...)
+	if err != nil {
+		log.Fatalf("Impossible to connect to storage client with error %v", err)
+	}
+	this.bucket = client.Bucket(bucketName)
+
+	if overwrite := configService.GetEnvVar(models.GCS_OVERWRITE); overwrite != "" {
+		if this.overwrite, err = strconv.ParseBool(overwrite); err != nil {
+			log.Fatalf("Impossible to convert to Boolean the GCS_OVERWRITE parameter %q", overwrite)
+		}
+	}
+	if contentEncoding := configService.GetEnvVar(models.GCS_CONTENT_ENCODING); contentEncoding != "" {
+		if this.contentEncoding, err = strconv.ParseBool(contentEncoding); err != nil {
+			log.Fatalf("Impossible to convert to Boolean the GCS_CONTENT_ENCODING parameter %q", contentEncoding)
+		}
+	}
+
+	this.path = formatFtpPath(staticFtpPath(configService))
+
+	return this
+}
+
+/*
+Name of the object of the file, without the leading slash
+*/
+func (this *gcsService) object(name string) *storage.ObjectHandle {
+	return this.bucket.Object(strings.TrimPrefix(this.path+name, "/"))
+}
+
+/*
+Content type of the file by its extension. With the content encoding, the GZIP files have the type of their content
+and the gzip encoding, for the decompressive transcoding of Cloud Storage
+*/
+func (this *gcsService) contentType(name string) (contentType string, contentEncoding string) {
+	return fileContentType(name, this.contentEncoding)
+}
+
+/*
+Content type of the file by its extension, and its content encoding if withEncoding is set and the file is GZIP
+*/
+func fileContentType(name string, withEncoding bool) (contentType string, contentEncoding string) {
+	extension := path.Ext(name)
+	if withEncoding && extension == ".gz" {
+		contentEncoding = "gzip"
+		extension = path.Ext(strings.TrimSuffix(name, extension))
+	}
+	contentType, ok := contentTypes[extension]
+	if !ok {
+		contentType = defaultContentType
+	}
+	return
+}
+
+/*
+Upload the object. The upload is atomic, the object only exists when the upload is complete. Without GCS_OVERWRITE, the
+upload fails if the object already exists
+*/
+func (this *gcsService) Send(name string, src io.Reader) (err error) {
+	return this.SendWithMetadata(name, src, nil)
+}
+
+/*
+Upload the object with its custom metadata, like Send.
+An attempt can fail on the client side after the object is committed, the retry then finds the object. Without
+GCS_OVERWRITE, an existing object of the same size and CRC32C is considered as delivered
+*/
+func (this *gcsService) SendWithMetadata(name string, src io.Reader, metadata map[string]string) (err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	object := this.object(name)
+	if !this.overwrite {
+		object = object.If(storage.Conditions{DoesNotExist: true})
+	}
+	writer := object.NewWriter(ctx)
+	writer.ContentType, writer.ContentEncoding = this.contentType(name)
+	writer.Metadata = metadata
+	checksum := &gcsChecksum{hash: crc32.New(crc32.MakeTable(crc32.Castagnoli))}
+	if _, err = io.Copy(writer, io.TeeReader(src, checksum)); err != nil {
+		//Abort the upload, no object is created
+		cancel()
+		writer.Close()
+	} else {
+		err = writer.Close()
+	}
+	if apiErr, ok := err.(*googleapi.Error); !ok || apiErr.Code != http.StatusPreconditionFailed {
+		return
+	}
+
+	//Compare the existing object with the whole file
+	if _, copyErr := io.Copy(checksum, src); copyErr != nil {
+		return copyErr
+	}
+	attrs, attrsErr := this.object(name).Attrs(context.Background())
+	if attrsErr != nil {
+		return fmt.Errorf("the object %q already exists, impossible to compare it with error %v", name, attrsErr)
+	}
+	if attrs.Size != checksum.size || attrs.CRC32C != checksum.hash.Sum32() {
+		return fmt.Errorf("the object %q already exists with another content: %v", name, err)
+	}
+	log.Warningf("The object %q already exists with the same content, it's considered as delivered", name)
+	return nil
+}
+
+/*
+Size and CRC32C of the uploaded content
+*/
+type gcsChecksum struct {
+	hash hash.Hash32
+	size int64
+}
+
+func (this *gcsChecksum) Write(p []byte) (n int, err error) {
+	this.size += int64(len(p))
+	return this.hash.Write(p)
+}
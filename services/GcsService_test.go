@@ -0,0 +1,311 @@
+package services
+
+import (
+	"bqToFtp/models"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"google.golang.org/api/option"
+	"hash/crc32"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type gcsObject struct {
+	Name            string            `json:"name"`
+	Bucket          string            `json:"bucket"`
+	ContentType     string            `json:"contentType,omitempty"`
+	ContentEncoding string            `json:"contentEncoding,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	Generation      string            `json:"generation"`
+	Size            string            `json:"size"`
+	Crc32c          string            `json:"crc32c"`
+	content         string
+}
+
+/*
+Fake of the Cloud Storage JSON API, with the multipart uploads and the object attributes. The next failedCommits uploads
+are committed, then their connection is closed without response
+*/
+type fakeGcsServer struct {
+	*httptest.Server
+	mutex         sync.Mutex
+	objects       map[string]*gcsObject
+	failedCommits int
+}
+
+func newFakeGcsServer() *fakeGcsServer {
+	this := &fakeGcsServer{objects: make(map[string]*gcsObject)}
+	this.Server = httptest.NewServer(http.HandlerFunc(this.handle))
+	return this
+}
+
+func (this *fakeGcsServer) handle(w http.ResponseWriter, r *http.Request) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	var object *gcsObject
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/b/bucket/o":
+		object = &gcsObject{}
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		reader := multipart.NewReader(r.Body, params["boundary"])
+		attrs, err := reader.NextPart()
+		if err == nil {
+			err = json.NewDecoder(attrs).Decode(object)
+		}
+		var media *multipart.Part
+		if err == nil {
+			media, err = reader.NextPart()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		content, _ := ioutil.ReadAll(media)
+		object.setContent(string(content))
+		if _, exists := this.objects[object.Name]; exists && r.URL.Query().Get("ifGenerationMatch") == "0" {
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+		this.objects[object.Name] = object
+		if this.failedCommits > 0 {
+			//The connection is lost before the response
+			this.failedCommits--
+			if connection, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				connection.Close()
+			}
+			return
+		}
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/b/bucket/o/"):
+		if object = this.objects[strings.TrimPrefix(r.URL.Path, "/b/bucket/o/")]; object == nil {
+			http.NotFound(w, r)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	object.Bucket = "bucket"
+	object.Generation = "1"
+	json.NewEncoder(w).Encode(object)
+}
+
+/*
+Set the content of the object, with its size and its CRC32C
+*/
+func (this *gcsObject) setContent(content string) *gcsObject {
+	this.content = content
+	this.Size = strconv.Itoa(len(content))
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.Checksum([]byte(content), crc32.MakeTable(crc32.Castagnoli)))
+	this.Crc32c = base64.StdEncoding.EncodeToString(checksum)
+	return this
+}
+
+func (this *fakeGcsServer) newService(config mapConfigService) *gcsService {
+	config[models.FTP_SERVER] = "gs://bucket"
+	return newGcsService(config, option.WithEndpoint(this.URL+"/"), option.WithoutAuthentication())
+}
+
+func Test_gcsService_Send(t *testing.T) {
+	tests := []struct {
+		name                string
+		config              mapConfigService
+		fileName            string
+		existing            bool
+		wantName            string
+		wantContentType     string
+		wantContentEncoding string
+		wantErr             bool
+	}{
+		{
+			name:            "Object in the path",
+			config:          mapConfigService{models.FTP_PATH: "/exports"},
+			fileName:        "2019/export.csv",
+			wantName:        "exports/2019/export.csv",
+			wantContentType: "text/csv",
+		},
+		{
+			name:            "GZIP object",
+			config:          mapConfigService{},
+			fileName:        "export.csv.gz",
+			wantName:        "export.csv.gz",
+			wantContentType: "application/gzip",
+		},
+		{
+			name:                "GZIP object with content encoding",
+			config:              mapConfigService{models.GCS_CONTENT_ENCODING: "true"},
+			fileName:            "export.csv.gz",
+			wantName:            "export.csv.gz",
+			wantContentType:     "text/csv",
+			wantContentEncoding: "gzip",
+		},
+		{
+			name:     "Existing object",
+			config:   mapConfigService{},
+			fileName: "export.csv",
+			existing: true,
+			wantErr:  true,
+		},
+		{
+			name:            "Existing object overwritten",
+			config:          mapConfigService{models.GCS_OVERWRITE: "true"},
+			fileName:        "export.csv",
+			existing:        true,
+			wantName:        "export.csv",
+			wantContentType: "text/csv",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeGcsServer()
+			defer server.Close()
+			if tt.existing {
+				server.objects[tt.fileName] = (&gcsObject{Name: tt.fileName}).setContent("old")
+			}
+
+			gcsService := server.newService(tt.config)
+			if err := gcsService.Send(tt.fileName, strings.NewReader("content")); (err != nil) != tt.wantErr {
+				t.Errorf("gcsService.Send() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				if server.objects[tt.fileName].content != "old" {
+					t.Errorf("gcsService.Send() overwrote the existing object")
+				}
+				return
+			}
+			object := server.objects[tt.wantName]
+			if object == nil {
+				t.Errorf("gcsService.Send() objects = %v, want %q", server.objects, tt.wantName)
+				return
+			}
+			if object.content != "content" || object.ContentType != tt.wantContentType || object.ContentEncoding != tt.wantContentEncoding {
+				t.Errorf("gcsService.Send() object = %+v, want content type %q and encoding %q", object, tt.wantContentType, tt.wantContentEncoding)
+			}
+		})
+	}
+}
+
+func Test_gcsService_Send_retry(t *testing.T) {
+	tests := []struct {
+		name          string
+		overwrite     string
+		retryContent  string
+		wantRetryErr  bool
+		wantErrDetail string
+	}{
+		{
+			name:         "Retry of the committed object",
+			retryContent: "content",
+		},
+		{
+			name:          "Retry of another content",
+			retryContent:  "other content",
+			wantRetryErr:  true,
+			wantErrDetail: "already exists",
+		},
+		{
+			name:         "Retry with overwrite",
+			overwrite:    "true",
+			retryContent: "other content",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeGcsServer()
+			defer server.Close()
+			//The first attempt is committed, then fails on the client side
+			server.failedCommits = 1
+
+			gcsService := server.newService(mapConfigService{models.GCS_OVERWRITE: tt.overwrite})
+			if err := gcsService.Send("export.csv", strings.NewReader("content")); err == nil {
+				t.Fatalf("gcsService.Send() first attempt error = nil, want error")
+			}
+			err := gcsService.Send("export.csv", strings.NewReader(tt.retryContent))
+			if (err != nil) != tt.wantRetryErr {
+				t.Errorf("gcsService.Send() retry error = %v, wantErr %v", err, tt.wantRetryErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErrDetail) {
+				t.Errorf("gcsService.Send() retry error = %v, want %q", err, tt.wantErrDetail)
+			}
+		})
+	}
+}
+
+func Test_gcsService_SendWithMetadata(t *testing.T) {
+	server := newFakeGcsServer()
+	defer server.Close()
+
+	gcsService := server.newService(mapConfigService{models.FTP_PATH: "/exports/"})
+	metadata := map[string]string{"rowCount": "42"}
+	if err := gcsService.SendWithMetadata("export.csv", strings.NewReader("content"), metadata); err != nil {
+		t.Errorf("gcsService.SendWithMetadata() error = %v", err)
+		return
+	}
+	object := server.objects["exports/export.csv"]
+	if object == nil || object.content != "content" {
+		t.Errorf("gcsService.SendWithMetadata() object = %+v, want content %q", object, "content")
+		return
+	}
+	if !reflect.DeepEqual(object.Metadata, metadata) {
+		t.Errorf("gcsService.SendWithMetadata() metadata = %v, want %v", object.Metadata, metadata)
+	}
+}
+
+func Test_gcsService_contentType(t *testing.T) {
+	tests := []struct {
+		name                string
+		contentEncoding     bool
+		fileName            string
+		wantContentType     string
+		wantContentEncoding string
+	}{
+		{
+			name:            "CSV",
+			fileName:        "export.csv",
+			wantContentType: "text/csv",
+		},
+		{
+			name:            "Unknown extension",
+			fileName:        "export.dat",
+			wantContentType: defaultContentType,
+		},
+		{
+			name:            "GZIP without content encoding",
+			fileName:        "export.jsonl.gz",
+			wantContentType: "application/gzip",
+		},
+		{
+			name:                "GZIP with content encoding",
+			contentEncoding:     true,
+			fileName:            "export.jsonl.gz",
+			wantContentType:     "application/x-ndjson",
+			wantContentEncoding: "gzip",
+		},
+		{
+			name:            "ZSTD with content encoding",
+			contentEncoding: true,
+			fileName:        "export.csv.zst",
+			wantContentType: "application/zstd",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			this := &gcsService{contentEncoding: tt.contentEncoding}
+			gotContentType, gotContentEncoding := this.contentType(tt.fileName)
+			if gotContentType != tt.wantContentType || gotContentEncoding != tt.wantContentEncoding {
+				t.Errorf("gcsService.contentType() = %q, %q, want %q, %q", gotContentType, gotContentEncoding, tt.wantContentType, tt.wantContentEncoding)
+			}
+		})
+	}
+}
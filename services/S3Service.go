@@ -0,0 +1,193 @@
+package services
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const s3Scheme = "s3://"
+
+const (
+	defaultS3Region   = "us-east-1"
+	defaultS3Endpoint = "https://s3.amazonaws.com"
+
+	//Server side encryptions of S3_SSE
+	s3SseAes256 = "AES256"
+	s3SseAwsKms = "aws:kms"
+
+	//Minimum size of the parts of a multipart upload, also the default size
+	s3MinPartSize = 5 * 1024 * 1024
+	//Maximum number of parts of a multipart upload
+	s3MaxParts = 10000
+)
+
+type s3Service struct {
+	IFTPService
+	client   *minio.Client
+	bucket   string
+	path     string
+	partSize int64
+	sse      encrypt.ServerSide
+}
+
+/*
+Create a S3 service for the FTP_SERVER with the s3:// scheme, like s3://bucket. The objects are keyed by the FTP_PATH
+followed by the file name. AWS S3 is used, or the S3_ENDPOINT of a S3 compatible storage, like MinIO. The
+S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are used, or the default credentials of AWS: the environment variables, the
+shared credentials file, then the IAM role
+*/
+func NewS3Service(configService helpers.IConfigService) *s3Service {
+	this := &s3Service{partSize: s3MinPartSize}
+
+	server := configService.GetEnvVar(models.FTP_SERVER)
+	this.bucket = strings.TrimSuffix(server[len(s3Scheme):], "/")
+	if this.bucket == "" || strings.Contains(this.bucket, "/") {
+		log.Fatalf("Error reading environment variables. The ftp server %s must be a bucket like s3://bucket", server)
+	}
+
+	options := &minio.Options{
+		Region:       defaultS3Region,
+		BucketLookup: minio.BucketLookupAuto,
+	}
+	if region := configService.GetEnvVar(models.S3_REGION); region != "" {
+		options.Region = region
+	}
+	endpoint := defaultS3Endpoint
+	if value := configService.GetEnvVar(models.S3_ENDPOINT); value != "" {
+		endpoint = value
+	}
+	//The endpoint is HTTPS when the scheme is missing
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	endpointUrl, err := url.Parse(endpoint)
+	if err != nil || (endpointUrl.Scheme != "http" && endpointUrl.Scheme != "https") || endpointUrl.Host == "" {
+		log.Fatalf("Impossible to use the S3_ENDPOINT parameter %q. Use an URL like https://host:port", endpoint)
+	}
+	options.Secure = endpointUrl.Scheme == "https"
+	if forcePathStyle := configService.GetEnvVar(models.S3_FORCE_PATH_STYLE); forcePathStyle != "" {
+		value, err := strconv.ParseBool(forcePathStyle)
+		if err != nil {
+			log.Fatalf("Impossible to convert to Boolean the S3_FORCE_PATH_STYLE parameter %q", forcePathStyle)
+		}
+		options.BucketLookup = minio.BucketLookupDNS
+		if value {
+			options.BucketLookup = minio.BucketLookupPath
+		}
+	}
+
+	accessKeyId := configService.GetEnvVar(models.S3_ACCESS_KEY_ID)
+	secretAccessKey := configService.GetEnvVar(models.S3_SECRET_ACCESS_KEY)
+	if (accessKeyId == "") != (secretAccessKey == "") {
+		log.Fatalf("Error reading environment variables. S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set together")
+	}
+	if accessKeyId != "" {
+		options.Creds = credentials.NewStaticV4(accessKeyId, secretAccessKey, "")
+	} else {
+		options.Creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+
+	this.client, err = minio.New(endpointUrl.Host, options)
+	if err != nil {
+		log.Fatalf("Impossible to create the S3 client with error %v", err)
+	}
+
+	//Large files are uploaded by parts, the part size is the threshold of the multipart upload
+	if size := configService.GetEnvVar(models.S3_PART_SIZE); size != "" {
+		value, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || value < s3MinPartSize {
+			log.Fatalf("Impossible to convert to Integer of at least %d bytes the S3_PART_SIZE parameter %q", s3MinPartSize, size)
+		}
+		this.partSize = value
+	}
+
+	kmsKeyId := configService.GetEnvVar(models.S3_SSE_KMS_KEY_ID)
+	switch sse := configService.GetEnvVar(models.S3_SSE); sse {
+	case "":
+	case s3SseAes256:
+		this.sse = encrypt.NewSSE()
+	case s3SseAwsKms:
+		if this.sse, err = encrypt.NewSSEKMS(kmsKeyId, nil); err != nil {
+			log.Fatalf("Impossible to use the S3_SSE_KMS_KEY_ID parameter %q with error %v", kmsKeyId, err)
+		}
+	default:
+		log.Fatalf("Unknown S3_SSE parameter %q. Use %s or %s", sse, s3SseAes256, s3SseAwsKms)
+	}
+	if kmsKeyId != "" && configService.GetEnvVar(models.S3_SSE) != s3SseAwsKms {
+		log.Fatalf("Error reading environment variables. S3_SSE_KMS_KEY_ID requires the S3_SSE %s", s3SseAwsKms)
+	}
+
+	this.path = formatFtpPath(staticFtpPath(configService))
+
+	return this
+}
+
+/*
+Upload the object, in a single request if it's smaller than a part, else by parts. The upload is atomic, the object
+only exists when the upload is complete. The parts are deleted if the multipart upload fails
+*/
+func (this *s3Service) Send(name string, src io.Reader) (err error) {
+	key := strings.TrimPrefix(this.path+name, "/")
+	options := minio.PutObjectOptions{
+		PartSize:             uint64(this.partSize),
+		ServerSideEncryption: this.sse,
+	}
+	options.ContentType, _ = fileContentType(name, false)
+
+	first := make([]byte, this.partSize)
+	n, err := io.ReadFull(src, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		_, err = this.client.PutObject(context.Background(), this.bucket, key, bytes.NewReader(first[:n]), int64(n), options)
+		return
+	}
+	if err != nil {
+		return
+	}
+	//The size is unknown, the parts are uploaded while the file is read
+	src = &s3SizeLimit{
+		Reader:    io.MultiReader(bytes.NewReader(first), src),
+		remaining: this.partSize * s3MaxParts,
+	}
+	_, err = this.client.PutObject(context.Background(), this.bucket, key, src, -1, options)
+	return
+}
+
+/*
+Reader which fails when the file is larger than the remaining bytes. The multipart upload stops at the last part, the
+rest of a larger file would be lost
+*/
+type s3SizeLimit struct {
+	io.Reader
+	remaining int64
+}
+
+func (this *s3SizeLimit) Read(p []byte) (n int, err error) {
+	if int64(len(p)) > this.remaining {
+		p = p[:this.remaining]
+	}
+	n, err = this.Reader.Read(p)
+	this.remaining -= int64(n)
+	if this.remaining > 0 || err != nil {
+		return
+	}
+	//Check that nothing is left after the limit
+	if _, err = io.ReadFull(this.Reader, make([]byte, 1)); err == nil {
+		err = fmt.Errorf("the file is larger than the %d parts of the multipart upload, increase the S3_PART_SIZE", s3MaxParts)
+	}
+	return
+}
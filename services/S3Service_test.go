@@ -0,0 +1,258 @@
+package services
+
+import (
+	"bqToFtp/models"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type s3Object struct {
+	content     string
+	contentType string
+	sse         string
+	kmsKeyId    string
+}
+
+/*
+Stub of the S3 API, with the single and the multipart uploads in path style, signed by chunks on HTTP
+*/
+type s3Stub struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	objects map[string]*s3Object
+	uploads map[string]map[int][]byte
+	parts   int
+	aborted int
+}
+
+func newS3Stub() *s3Stub {
+	this := &s3Stub{
+		objects: make(map[string]*s3Object),
+		uploads: make(map[string]map[int][]byte),
+	}
+	this.Server = httptest.NewServer(http.HandlerFunc(this.handle))
+	return this
+}
+
+func (this *s3Stub) handle(w http.ResponseWriter, r *http.Request) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if !strings.HasPrefix(r.URL.Path, "/bucket/") {
+		http.NotFound(w, r)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	query := r.URL.Query()
+	body, _ := ioutil.ReadAll(r.Body)
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		body = decodeAwsChunked(body)
+	}
+	object := &s3Object{
+		content:     string(body),
+		contentType: r.Header.Get("Content-Type"),
+		sse:         r.Header.Get("X-Amz-Server-Side-Encryption"),
+		kmsKeyId:    r.Header.Get("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"),
+	}
+
+	_, initiate := query["uploads"]
+	uploadId := query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPut && uploadId == "":
+		this.objects[key] = object
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == http.MethodPost && initiate:
+		uploadId = strconv.Itoa(len(this.uploads) + 1)
+		this.uploads[uploadId] = make(map[int][]byte)
+		//The attributes of the object are given when the upload starts
+		this.objects[key+"#"+uploadId] = object
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key, uploadId)
+	case r.Method == http.MethodPut:
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		this.uploads[uploadId][partNumber] = body
+		this.parts++
+		w.Header().Set("ETag", fmt.Sprintf(`"etag%d"`, partNumber))
+	case r.Method == http.MethodPost:
+		var numbers []int
+		for number := range this.uploads[uploadId] {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		content := &bytes.Buffer{}
+		for _, number := range numbers {
+			content.Write(this.uploads[uploadId][number])
+		}
+		object = this.objects[key+"#"+uploadId]
+		object.content = content.String()
+		delete(this.objects, key+"#"+uploadId)
+		this.objects[key] = object
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><ETag>\"etag\"</ETag></CompleteMultipartUploadResult>", key)
+	case r.Method == http.MethodDelete:
+		delete(this.uploads, uploadId)
+		delete(this.objects, key+"#"+uploadId)
+		this.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+/*
+Content of a body signed by chunks, like <size>;chunk-signature=<signature>\r\n<data>\r\n, up to the chunk of size 0
+*/
+func decodeAwsChunked(body []byte) []byte {
+	content := &bytes.Buffer{}
+	for {
+		end := bytes.Index(body, []byte("\r\n"))
+		if end < 0 {
+			return content.Bytes()
+		}
+		size, _ := strconv.ParseInt(string(bytes.SplitN(body[:end], []byte(";"), 2)[0]), 16, 64)
+		if size == 0 {
+			return content.Bytes()
+		}
+		body = body[end+2:]
+		content.Write(body[:size])
+		body = body[size+2:]
+	}
+}
+
+func (this *s3Stub) newService(config mapConfigService) *s3Service {
+	config[models.FTP_SERVER] = "s3://bucket"
+	config[models.S3_ENDPOINT] = this.URL
+	config[models.S3_FORCE_PATH_STYLE] = "true"
+	config[models.S3_ACCESS_KEY_ID] = "access"
+	config[models.S3_SECRET_ACCESS_KEY] = "secret"
+	return NewS3Service(config)
+}
+
+func Test_s3Service_Send(t *testing.T) {
+	large := strings.Repeat("0123456789", s3MinPartSize/10*2+1)
+
+	tests := []struct {
+		name            string
+		config          mapConfigService
+		fileName        string
+		content         string
+		wantKey         string
+		wantContentType string
+		wantSse         string
+		wantKmsKeyId    string
+		wantParts       int
+	}{
+		{
+			name:            "Object in the path",
+			config:          mapConfigService{models.FTP_PATH: "/exports"},
+			fileName:        "2019/export.csv",
+			content:         "content",
+			wantKey:         "exports/2019/export.csv",
+			wantContentType: "text/csv",
+		},
+		{
+			name:            "Server side encryption",
+			config:          mapConfigService{models.S3_SSE: "AES256"},
+			fileName:        "export.csv.gz",
+			content:         "content",
+			wantKey:         "export.csv.gz",
+			wantContentType: "application/gzip",
+			wantSse:         "AES256",
+		},
+		{
+			name:            "Server side encryption with KMS key",
+			config:          mapConfigService{models.S3_SSE: "aws:kms", models.S3_SSE_KMS_KEY_ID: "key"},
+			fileName:        "export.csv",
+			content:         "content",
+			wantKey:         "export.csv",
+			wantContentType: "text/csv",
+			wantSse:         "aws:kms",
+			wantKmsKeyId:    "key",
+		},
+		{
+			name:            "Multipart upload",
+			config:          mapConfigService{models.S3_SSE: "AES256"},
+			fileName:        "export.csv",
+			content:         large,
+			wantKey:         "export.csv",
+			wantContentType: "text/csv",
+			wantSse:         "AES256",
+			wantParts:       3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newS3Stub()
+			defer server.Close()
+
+			s3Service := server.newService(tt.config)
+			if err := s3Service.Send(tt.fileName, strings.NewReader(tt.content)); err != nil {
+				t.Errorf("s3Service.Send() error = %v", err)
+				return
+			}
+			object := server.objects[tt.wantKey]
+			if object == nil {
+				t.Errorf("s3Service.Send() objects = %v, want %q", server.objects, tt.wantKey)
+				return
+			}
+			if object.content != tt.content {
+				t.Errorf("s3Service.Send() content of %d bytes, want %d bytes", len(object.content), len(tt.content))
+			}
+			if object.contentType != tt.wantContentType || object.sse != tt.wantSse || object.kmsKeyId != tt.wantKmsKeyId {
+				t.Errorf("s3Service.Send() object = %+v, want content type %q, sse %q and kms key %q", object, tt.wantContentType, tt.wantSse, tt.wantKmsKeyId)
+			}
+			if server.parts != tt.wantParts {
+				t.Errorf("s3Service.Send() parts = %d, want %d", server.parts, tt.wantParts)
+			}
+		})
+	}
+}
+
+func Test_s3Service_Send_aborted(t *testing.T) {
+	server := newS3Stub()
+	defer server.Close()
+
+	s3Service := server.newService(mapConfigService{})
+	content := strings.Repeat("0", s3MinPartSize+1)
+	if err := s3Service.Send("export.csv", &failingReader{Reader: strings.NewReader(content)}); err == nil {
+		t.Fatalf("s3Service.Send() error = nil, want the production error")
+	}
+	if len(server.objects) != 0 || server.aborted != 1 {
+		t.Errorf("s3Service.Send() objects = %v, aborted = %d, want the multipart upload aborted", server.objects, server.aborted)
+	}
+}
+
+func Test_s3SizeLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name:    "File in the limit",
+			content: "0123456789",
+		},
+		{
+			name:    "File larger than the limit",
+			content: "0123456789X",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := ioutil.ReadAll(&s3SizeLimit{Reader: strings.NewReader(tt.content), remaining: 10})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("s3SizeLimit error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if string(content) != "0123456789" {
+				t.Errorf("s3SizeLimit read %q, want %q", content, "0123456789")
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package services
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"path"
+	"strings"
+)
+
+const sftpScheme = "sftp://"
+
+type sftpService struct {
+	IFTPService
+	config            *ssh.ClientConfig
+	host              string
+	path              string
+	upload            atomicUpload
+	createDirectories bool
+}
+
+/*
+Create a SFTP service for the FTP_SERVER with the sftp:// scheme. Authentication can be done by password, by private key
+or both. The host key of the server must be pinned with FTP_HOST_KEY
+*/
+func NewSftpService(configService helpers.IConfigService) *sftpService {
+	this := &sftpService{}
+
+	server := configService.GetEnvVar(models.FTP_SERVER)
+	this.host = formatSftpHost(server)
+	if this.host == "" {
+		log.Fatalf("Error reading environment variables. Here the known variables: ftp server %s", server)
+	}
+
+	var auths []ssh.AuthMethod
+	if privateKey := configService.GetEnvVar(models.FTP_PRIVATE_KEY); privateKey != "" {
+		signer, err := parsePrivateKey([]byte(privateKey), []byte(configService.GetEnvVar(models.FTP_PRIVATE_KEY_PASSPHRASE)))
+		if err != nil {
+			log.Fatalf("Impossible to parse the sftp private key with error %v", err)
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+	if password := configService.GetEnvVar(models.FTP_PASSWORD); password != "" {
+		auths = append(auths, ssh.Password(password))
+	}
+
+	hostKeyCallback, err := newHostKeyCallback(configService.GetEnvVar(models.FTP_HOST_KEY))
+	if err != nil {
+		log.Fatalf("Impossible to load the sftp host key with error %v", err)
+	}
+
+	this.config = &ssh.ClientConfig{
+		User:            configService.GetEnvVar(models.FTP_LOGIN),
+		Auth:            auths,
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	this.path = formatFtpPath(staticFtpPath(configService))
+	this.upload = newAtomicUpload(configService)
+	this.createDirectories = loadCreateDirectories(configService)
+
+	return this
+}
+
+/*
+Remove the sftp:// scheme and add the default port 22 if missing. The IPv6 hosts are in brackets, like [::1]. Empty if
+the scheme is missing
+*/
+func formatSftpHost(server string) (host string) {
+	if !strings.HasPrefix(server, sftpScheme) {
+		return
+	}
+	host = strings.TrimSuffix(server[len(sftpScheme):], "/")
+	if host == "" {
+		return
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "22")
+	}
+	return
+}
+
+func parsePrivateKey(privateKey []byte, passphrase []byte) (ssh.Signer, error) {
+	if len(passphrase) > 0 {
+		return ssh.ParsePrivateKeyWithPassphrase(privateKey, passphrase)
+	}
+	return ssh.ParsePrivateKey(privateKey)
+}
+
+/*
+Pin the host key of the server. The host key can be provided as
+  - a fingerprint, SHA256:... as displayed by ssh-keygen -l, or MD5:... for the legacy format
+  - a known_hosts entry (the host patterns aren't checked, only the key)
+  - a public key in authorized_keys format
+*/
+func newHostKeyCallback(hostKey string) (ssh.HostKeyCallback, error) {
+	hostKey = strings.TrimSpace(hostKey)
+	switch {
+	case hostKey == "":
+		return nil, errors.New("no host key provided, FTP_HOST_KEY is required for sftp")
+	case strings.HasPrefix(hostKey, "SHA256:"):
+		return fingerprintCallback(hostKey, ssh.FingerprintSHA256), nil
+	case strings.HasPrefix(hostKey, "MD5:"):
+		return fingerprintCallback(strings.TrimPrefix(hostKey, "MD5:"), ssh.FingerprintLegacyMD5), nil
+	}
+
+	if _, _, publicKey, _, _, err := ssh.ParseKnownHosts([]byte(hostKey)); err == nil {
+		return ssh.FixedHostKey(publicKey), nil
+	}
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+	if err != nil {
+		return nil, fmt.Errorf("host key %q is neither a fingerprint, a known_hosts entry nor a public key", hostKey)
+	}
+	return ssh.FixedHostKey(publicKey), nil
+}
+
+func fingerprintCallback(fingerprint string, hash func(ssh.PublicKey) string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if hash(key) != fingerprint {
+			return fmt.Errorf("host key fingerprint %s of %s doesn't match the expected one", hash(key), hostname)
+		}
+		return nil
+	}
+}
+
+func (this *sftpService) Send(name string, src io.Reader) (err error) {
+	conn, err := ssh.Dial("tcp", this.host, this.config)
+	if err != nil {
+		return
+	}
+	//Close the connection at the end
+	defer conn.Close()
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	if this.createDirectories {
+		if err = client.MkdirAll(path.Dir(this.path + name)); err != nil {
+			return
+		}
+	}
+	return this.upload.store(this.path+name,
+		func(name string) error {
+			file, err := client.Create(name)
+			if err != nil {
+				return err
+			}
+			if _, err = io.Copy(file, src); err != nil {
+				file.Close()
+				return err
+			}
+			return file.Close()
+		},
+		func(from string, to string) error {
+			return renameOverwriting(client, from, to)
+		},
+		client.Remove)
+}
+
+/*
+Rename the file and replace the existing one. The SFTP rename fails if the target exists, it's deleted first
+*/
+func renameOverwriting(client *sftp.Client, from string, to string) error {
+	err := client.Rename(from, to)
+	if err == nil {
+		return nil
+	}
+	if _, statErr := client.Stat(to); statErr != nil {
+		return err
+	}
+	if err = client.Remove(to); err != nil {
+		return err
+	}
+	return client.Rename(from, to)
+}
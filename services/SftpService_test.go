@@ -0,0 +1,399 @@
+package services
+
+import (
+	"bqToFtp/helpers"
+	"bqToFtp/models"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+/*
+Config service backed by a map, for building the services in the tests
+*/
+type mapConfigService map[helpers.EnvVarEnum]string
+
+func (this mapConfigService) GetEnvVar(enum helpers.EnvVarEnum) string {
+	return this[enum]
+}
+
+/*
+In-process SSH server which serves the sftp subsystem on an in-memory filesystem
+*/
+type testSftpServer struct {
+	address   string
+	hostKey   ssh.PublicKey
+	handlers  sftp.Handlers
+	listener  net.Listener
+	clientKey ssh.PublicKey
+}
+
+func newTestSftpServer(t *testing.T, clientKey ssh.PublicKey) *testSftpServer {
+	_, hostPrivateKey, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &testSftpServer{
+		hostKey:   hostSigner.PublicKey(),
+		handlers:  sftp.InMemHandler(),
+		clientKey: clientKey,
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == "user" && string(password) == "password" {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if server.clientKey != nil && bytes.Equal(key.Marshal(), server.clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	server.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.address = server.listener.Addr().String()
+
+	go func() {
+		for {
+			conn, err := server.listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, config)
+		}
+	}()
+	return server
+}
+
+func (this *testSftpServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for request := range channelRequests {
+				isSftp := request.Type == "subsystem" && string(request.Payload[4:]) == "sftp"
+				request.Reply(isSftp, nil)
+				if isSftp {
+					server := sftp.NewRequestServer(channel, this.handlers)
+					go func() {
+						server.Serve()
+						server.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+/*
+Connect a client to the server. The returned function closes the connection
+*/
+func (this *testSftpServer) connect(t *testing.T) (*sftp.Client, func()) {
+	conn, err := ssh.Dial("tcp", this.address, &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.Password("password")},
+		HostKeyCallback: ssh.FixedHostKey(this.hostKey),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		conn.Close()
+	}
+}
+
+/*
+Read a file from the in-memory filesystem of the server
+*/
+func (this *testSftpServer) read(t *testing.T, path string) string {
+	client, closeClient := this.connect(t)
+	defer closeClient()
+	file, err := client.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	content, _ := ioutil.ReadAll(file)
+	return string(content)
+}
+
+/*
+Check if a file exists on the in-memory filesystem of the server
+*/
+func (this *testSftpServer) exists(t *testing.T, path string) bool {
+	client, closeClient := this.connect(t)
+	defer closeClient()
+	_, err := client.Stat(path)
+	return err == nil
+}
+
+func Test_sftpService_Send(t *testing.T) {
+	clientKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	clientPublicKey, _ := ssh.NewPublicKey(&clientKey.PublicKey)
+	encryptedBlock, _ := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(clientKey), []byte("passphrase"), x509.PEMCipherAES256)
+	encryptedKey := string(pem.EncodeToMemory(encryptedBlock))
+
+	server := newTestSftpServer(t, clientPublicKey)
+	defer server.listener.Close()
+
+	authorizedHostKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(server.hostKey)))
+
+	tests := []struct {
+		name    string
+		config  mapConfigService
+		wantErr bool
+	}{
+		{
+			name: "Password with fingerprint",
+			config: mapConfigService{
+				models.FTP_LOGIN:    "user",
+				models.FTP_PASSWORD: "password",
+				models.FTP_HOST_KEY: ssh.FingerprintSHA256(server.hostKey),
+			},
+		},
+		{
+			name: "Private key with passphrase and known_hosts entry",
+			config: mapConfigService{
+				models.FTP_LOGIN:                  "user",
+				models.FTP_PRIVATE_KEY:            encryptedKey,
+				models.FTP_PRIVATE_KEY_PASSPHRASE: "passphrase",
+				models.FTP_HOST_KEY:               "127.0.0.1 " + authorizedHostKey,
+			},
+		},
+		{
+			name: "Wrong password",
+			config: mapConfigService{
+				models.FTP_LOGIN:    "user",
+				models.FTP_PASSWORD: "wrong",
+				models.FTP_HOST_KEY: authorizedHostKey,
+			},
+			wantErr: true,
+		},
+		{
+			name: "Wrong host key",
+			config: mapConfigService{
+				models.FTP_LOGIN:    "user",
+				models.FTP_PASSWORD: "password",
+				models.FTP_HOST_KEY: "SHA256:wrong",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config[models.FTP_SERVER] = sftpScheme + server.address
+			tt.config[models.FTP_PATH] = "/"
+			sftpService := NewSftpService(tt.config)
+			name := strings.ReplaceAll(tt.name, " ", "_") + ".csv"
+			err := sftpService.Send(name, strings.NewReader("content"))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("sftpService.Send() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil {
+				if got := server.read(t, "/"+name); got != "content" {
+					t.Errorf("sftpService.Send() content = %q, want %q", got, "content")
+				}
+			}
+		})
+	}
+}
+
+func Test_formatSftpHost(t *testing.T) {
+	tests := []struct {
+		name     string
+		server   string
+		wantHost string
+	}{
+		{
+			name:     "with port",
+			server:   "sftp://host:2222",
+			wantHost: "host:2222",
+		},
+		{
+			name:     "without port",
+			server:   "sftp://host",
+			wantHost: "host:22",
+		},
+		{
+			name:     "with trailing /",
+			server:   "sftp://host/",
+			wantHost: "host:22",
+		},
+		{
+			name:     "without host",
+			server:   "sftp://",
+			wantHost: "",
+		},
+		{
+			name:     "IPv6 without port",
+			server:   "sftp://[::1]",
+			wantHost: "[::1]:22",
+		},
+		{
+			name:     "IPv6 with port",
+			server:   "sftp://[::1]:2222",
+			wantHost: "[::1]:2222",
+		},
+		{
+			name:     "without scheme",
+			server:   "sftp:",
+			wantHost: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if gotHost := formatSftpHost(tt.server); gotHost != tt.wantHost {
+				t.Errorf("formatSftpHost() = %v, want %v", gotHost, tt.wantHost)
+			}
+		})
+	}
+}
+
+func Test_newHostKeyCallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		hostKey string
+		wantErr bool
+	}{
+		{
+			name:    "empty",
+			hostKey: "",
+			wantErr: true,
+		},
+		{
+			name:    "not a key",
+			hostKey: "not a key",
+			wantErr: true,
+		},
+		{
+			name:    "legacy md5 fingerprint",
+			hostKey: "MD5:aa:bb",
+			wantErr: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newHostKeyCallback(tt.hostKey); (err != nil) != tt.wantErr {
+				t.Errorf("newHostKeyCallback() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+/*
+Reader which fails after its content, like a file production error
+*/
+type failingReader struct {
+	io.Reader
+}
+
+func (this *failingReader) Read(p []byte) (int, error) {
+	n, err := this.Reader.Read(p)
+	if err == io.EOF {
+		return n, errors.New("production error")
+	}
+	return n, err
+}
+
+func Test_sftpService_Send_atomic(t *testing.T) {
+	server := newTestSftpServer(t, nil)
+	defer server.listener.Close()
+
+	sftpService := NewSftpService(mapConfigService{
+		models.FTP_SERVER:         sftpScheme + server.address,
+		models.FTP_LOGIN:          "user",
+		models.FTP_PASSWORD:       "password",
+		models.FTP_HOST_KEY:       ssh.FingerprintSHA256(server.hostKey),
+		models.UPLOAD_TEMP_PREFIX: "tmp_",
+	})
+
+	//The existing file is replaced at the end of the transfer
+	for _, content := range []string{"first", "second"} {
+		if err := sftpService.Send("atomic.csv", strings.NewReader(content)); err != nil {
+			t.Fatalf("sftpService.Send() error = %v", err)
+		}
+	}
+	if got := server.read(t, "/atomic.csv"); got != "second" {
+		t.Errorf("sftpService.Send() content = %q, want %q", got, "second")
+	}
+	if server.exists(t, "/tmp_atomic.csv") {
+		t.Errorf("sftpService.Send() left the temporary file")
+	}
+
+	//The partial file is deleted, the existing file is kept
+	if err := sftpService.Send("atomic.csv", &failingReader{Reader: strings.NewReader("partial")}); err == nil {
+		t.Fatalf("sftpService.Send() error = nil, want the production error")
+	}
+	if got := server.read(t, "/atomic.csv"); got != "second" {
+		t.Errorf("sftpService.Send() content = %q, want %q", got, "second")
+	}
+	if server.exists(t, "/tmp_atomic.csv") {
+		t.Errorf("sftpService.Send() left the partial file")
+	}
+}
+
+func Test_sftpService_Send_createDirectories(t *testing.T) {
+	server := newTestSftpServer(t, nil)
+	defer server.listener.Close()
+
+	config := mapConfigService{
+		models.FTP_SERVER:   sftpScheme + server.address,
+		models.FTP_LOGIN:    "user",
+		models.FTP_PASSWORD: "password",
+		models.FTP_HOST_KEY: ssh.FingerprintSHA256(server.hostKey),
+		models.FTP_PATH:     "/exports/{{.Year}}",
+	}
+	if err := NewSftpService(config).Send("2019/06/file.csv", strings.NewReader("content")); err == nil {
+		t.Errorf("sftpService.Send() error = nil, want missing directory error")
+	}
+
+	config[models.FTP_CREATE_DIRECTORIES] = "true"
+	sftpService := NewSftpService(config)
+	//The second file is sent in the existing directories
+	for _, name := range []string{"2019/06/file.csv", "2019/06/other.csv"} {
+		if err := sftpService.Send(name, strings.NewReader("content")); err != nil {
+			t.Fatalf("sftpService.Send() error = %v", err)
+		}
+		if got := server.read(t, "/exports/"+name); got != "content" {
+			t.Errorf("sftpService.Send() content = %q, want %q", got, "content")
+		}
+	}
+}
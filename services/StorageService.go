@@ -6,7 +6,9 @@ import (
 	"cloud.google.com/go/storage"
 	"context"
 	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
 	"strconv"
 	"strings"
@@ -14,17 +16,25 @@ import (
 )
 
 type IStorageService interface {
-	FallbackStoreFile(name string, src []byte) (err error)
-	GetQuery() string
+	FallbackStoreFile(name string, src io.Reader) (err error)
+	GetQuery() (string, models.QueryWindow)
+	GetLayout() (string, error)
+	GetColumnMapping() (string, error)
+	ReadFile(path string) ([]byte, error)
 }
 
 type storageService struct {
 	IStorageService
-	query             string
-	bucketQueryObject *storage.ObjectHandle
-	latency           int
-	minuteDelta       int
-	fallbackBucket    *storage.BucketHandle
+	query              string
+	bucketQueryObject  *storage.ObjectHandle
+	latency            int
+	minuteDelta        int
+	fallbackBucket     *storage.BucketHandle
+	layout             string
+	bucketLayoutObject *storage.ObjectHandle
+	columnMapping      string
+	bucketMapObject    *storage.ObjectHandle
+	client             *storage.Client
 }
 
 /*
@@ -45,6 +55,7 @@ func NewStorageService(configService helpers.IConfigService) *storageService {
 	if err != nil {
 		log.Fatal("Impossible to connect to storage client")
 	}
+	this.client = clients
 
 	if !strings.HasPrefix(query, "gs://") {
 		log.Fatalf("Error reading queryFilePath environment variables. No linked to a GCP Bucket file %q", query)
@@ -71,6 +82,11 @@ func NewStorageService(configService helpers.IConfigService) *storageService {
 		log.Fatalf("Impossible to parse the minute delta %q", minuteDeltaEnvVar)
 	}
 
+	//Load the fixed-width layout and the column mapping, like the query
+	forceReload := isForceReload(configService.GetEnvVar(models.FORCE_RELOAD))
+	this.bucketLayoutObject, this.layout = loadConfigFile(clients, models.FIXED_WIDTH_LAYOUT, configService.GetEnvVar(models.FIXED_WIDTH_LAYOUT), forceReload)
+	this.bucketMapObject, this.columnMapping = loadConfigFile(clients, models.COLUMN_MAPPING, configService.GetEnvVar(models.COLUMN_MAPPING), forceReload)
+
 	//Load the fallback bucket
 	if fallbackBucket := configService.GetEnvVar(models.FALLBACK_BUCKET); fallbackBucket != "" {
 		bucketName, _ = extractBucketPath(fallbackBucket)
@@ -97,6 +113,41 @@ func loadQuery(bucketQueryObject *storage.ObjectHandle) string {
 	return string(content)
 }
 
+/*
+Load a configuration file of the bucket. The content is only read when used in case of force reload.
+Return a nil object if the path is empty
+*/
+func loadConfigFile(clients *storage.Client, envVar helpers.EnvVarEnum, path string, forceReload bool) (object *storage.ObjectHandle, content string) {
+	if path == "" {
+		return
+	}
+	if !strings.HasPrefix(path, "gs://") {
+		log.Fatalf("Error reading %s environment variables. No linked to a GCP Bucket file %q", envVar, path)
+	}
+	bucketName, pathName := extractBucketPath(path)
+	object = clients.Bucket(bucketName).Object(pathName)
+	if !forceReload {
+		var err error
+		if content, err = readObject(object); err != nil {
+			log.Fatalf("Impossible to read the %s file %q with error %v", envVar, path, err)
+		}
+	}
+	return
+}
+
+/*
+Read the whole content of the object
+*/
+func readObject(object *storage.ObjectHandle) (string, error) {
+	objectReader, err := object.NewReader(context.Background())
+	if err != nil {
+		return "", err
+	}
+	defer objectReader.Close()
+	content, err := ioutil.ReadAll(objectReader)
+	return string(content), err
+}
+
 /*
  Return true is the FORCE_RELOAD param is set to TRUE (any case) or to 1
 */
@@ -121,7 +172,7 @@ Replace the START_TIMESTAMP and END_TIMESTAMP in the original Query.
 END value is calculated by taking the current minute of the execution (seconds at 0) and by subtracting the LATENCY var env value
 START value is calculated by taking END value and by subtracting the MINUTE_DELTA var env value
 */
-func (this *storageService) formatQuery() string {
+func (this *storageService) formatQuery() (string, models.QueryWindow) {
 	query := this.query
 	//Test if the query if empty. If yes, this means a force reload
 	if query == "" {
@@ -135,24 +186,71 @@ func (this *storageService) formatQuery() string {
 	endDate := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), 0, 0, now.Location())
 	endDate = endDate.Add(-time.Duration(this.latency) * time.Minute)
 	startDate := endDate.Add(-time.Duration(this.minuteDelta) * time.Minute)
-	return strings.ReplaceAll(strings.ReplaceAll(query, "START_TIMESTAMP", startDate.Format(format)), "END_TIMESTAMP", endDate.Format(format))
+	window := models.QueryWindow{Start: startDate, End: endDate}
+	return strings.ReplaceAll(strings.ReplaceAll(query, "START_TIMESTAMP", startDate.Format(format)), "END_TIMESTAMP", endDate.Format(format)), window
 }
 
-func (this *storageService) GetQuery() string {
+/*
+Return the query to run and its time window
+*/
+func (this *storageService) GetQuery() (string, models.QueryWindow) {
 	return this.formatQuery()
 }
 
+/*
+Return the fixed-width layout. Reloaded from the bucket on each call in case of force reload
+*/
+func (this *storageService) GetLayout() (string, error) {
+	if this.bucketLayoutObject == nil {
+		return "", errors.New("no FIXED_WIDTH_LAYOUT defined")
+	}
+	if this.layout != "" {
+		return this.layout, nil
+	}
+	return readObject(this.bucketLayoutObject)
+}
+
+/*
+Return the column mapping, empty if no COLUMN_MAPPING is defined. Reloaded from the bucket on each call in case of
+force reload
+*/
+func (this *storageService) GetColumnMapping() (string, error) {
+	if this.bucketMapObject == nil || this.columnMapping != "" {
+		return this.columnMapping, nil
+	}
+	return readObject(this.bucketMapObject)
+}
+
+/*
+Read the whole content of a file on Cloud Storage, with a path like gs://bucket/path/file
+*/
+func (this *storageService) ReadFile(path string) ([]byte, error) {
+	if !strings.HasPrefix(path, "gs://") {
+		return nil, fmt.Errorf("the file %q isn't linked to a GCP Bucket", path)
+	}
+	bucketName, pathName := extractBucketPath(path)
+	content, err := readObject(this.client.Bucket(bucketName).Object(pathName))
+	return []byte(content), err
+}
+
 /*
 Store the file in the fallback bucket in case of ftp error
 */
-func (this *storageService) FallbackStoreFile(name string, src []byte) (err error) {
+func (this *storageService) FallbackStoreFile(name string, src io.Reader) (err error) {
 	if this.fallbackBucket == nil {
 		log.Error("No fallback bucket defined or available. Impossible to save file")
 		return errors.New("no fallback bucket defined")
 	}
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	writer := this.fallbackBucket.Object(name).NewWriter(ctx)
-	defer writer.Close()
-	_, err = writer.Write(src)
-	return
+	if _, err = io.Copy(writer, src); err != nil {
+		//Abort the upload, no object is created
+		cancel()
+		writer.Close()
+		return
+	}
+	//The upload is only committed, or in error, on close
+	return writer.Close()
 }
@@ -126,7 +126,10 @@ func Test_storageService_formatQuery(t *testing.T) {
 				minuteDelta:     tt.fields.minuteDelta,
 				fallbackBucket:  tt.fields.fallbackBucket,
 			}
-			got := storageService.formatQuery()
+			got, window := storageService.formatQuery()
+			if window.End.Sub(window.Start) != time.Duration(tt.fields.minuteDelta)*time.Minute {
+				t.Errorf("formatQuery() window = %v, want %d minutes", window, tt.fields.minuteDelta)
+			}
 			start, end := tt.wantFunc(got)
 			if !assert.EqualValues(t, start, tt.wantStart) {
 				t.Errorf("formatQuery() startValue = %v, want %v", start, tt.wantStart)